@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	executionStatusDetailType = "Step Functions Execution Status Change"
+	completionSource          = "Squyre"
+)
+
+var (
+	// NotifyOutput abstracts the invokeOutputFunction function to allow for testing
+	NotifyOutput = invokeOutputFunction
+)
+
+// executionStatus holds the details of a Step Functions execution status change, as sent by EventBridge
+// See https://docs.aws.amazon.com/step-functions/latest/dg/cw-events.html
+type executionStatus struct {
+	ExecutionArn    string `json:"executionArn"`
+	StateMachineArn string `json:"stateMachineArn"`
+	Status          string `json:"status"`
+	Input           string `json:"input"`
+	Error           string `json:"error"`
+	Cause           string `json:"cause"`
+}
+
+// handleExecutionStatus reports enrichment executions that did not succeed to the output function, so that
+// alerts are not silently lost when the conductor is not waiting around for the result. Outside async mode the
+// conductor waits for each execution and reports failures itself, so status changes are ignored.
+func handleExecutionStatus(event events.CloudWatchEvent) (string, error) {
+	var status executionStatus
+	err := json.Unmarshal(event.Detail, &status)
+	if err != nil {
+		return "Aborted", err
+	}
+
+	if strings.ToLower(AsyncMode) != "true" {
+		log.Infof("Execution %s is %s, already reported by the conductor as async mode is off.", status.ExecutionArn, status.Status)
+		return "Async mode off, nothing to report.", nil
+	}
+
+	if status.Status == "SUCCEEDED" || status.Status == "RUNNING" {
+		log.Infof("Execution %s is %s, nothing to report.", status.ExecutionArn, status.Status)
+		return fmt.Sprintf("Execution %s.", status.Status), nil
+	}
+
+	var alert squyre.Alert
+	err = json.Unmarshal([]byte(status.Input), &alert)
+	if err != nil {
+		log.Errorf("Could not read alert from execution %s input: %s", status.ExecutionArn, err)
+		return "Aborted", err
+	}
+
+	message := fmt.Sprintf("Enrichment did not complete (%s).", status.Status)
+	if status.Error != "" || status.Cause != "" {
+		message = fmt.Sprintf("%s\n%s: %s", message, status.Error, status.Cause)
+	}
+	message = fmt.Sprintf("%s\nExecution: %s", message, status.ExecutionArn)
+
+	alert.Results = append(alert.Results, squyre.Result{
+		Source:         completionSource,
+		AttributeValue: "all subjects",
+		Message:        message,
+		Success:        false,
+	})
+
+	log.WithFields(log.Fields{
+		"alert": alert.ID,
+	}).Warnf("Execution %s %s, reporting to output", status.ExecutionArn, status.Status)
+
+	err = NotifyOutput(alert)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Error("Failed to report execution status to output")
+		return "Failed to notify output", err
+	}
+	return fmt.Sprintf("Reported %s execution to output.", status.Status), nil
+}
+
+// invokeOutputFunction sends an alert directly to the output function, in the same form the state machine uses
+func invokeOutputFunction(alert squyre.Alert) error {
+	alertJSON, _ := json.Marshal(alert)
+	payload, _ := json.Marshal([][]string{{string(alertJSON)}})
+
+	functionName, err := Stack.getStackResourceArn("OutputFunction")
+	if err != nil {
+		return err
+	}
+
+	client := lambdaservice.New(session.Must(session.NewSession()))
+	_, err = client.Invoke(&lambdaservice.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: aws.String(lambdaservice.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
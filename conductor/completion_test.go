@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+func statusEvent(status string) map[string]interface{} {
+	alertJSON, _ := json.Marshal(squyre.Alert{ID: "1234", Name: "Test Alert"})
+	detail, _ := json.Marshal(executionStatus{
+		ExecutionArn: "testExecArn",
+		Status:       status,
+		Input:        string(alertJSON),
+		Error:        "States.Timeout",
+		Cause:        "Task timed out",
+	})
+
+	var event map[string]interface{}
+	json.Unmarshal([]byte(`{"source": "aws.states", "detail-type": "Step Functions Execution Status Change", "detail": `+string(detail)+`}`), &event)
+	return event
+}
+
+func TestExecutionStatusFailed(t *testing.T) {
+	defer func() { NotifyOutput = invokeOutputFunction }()
+	defer func() { AsyncMode = "" }()
+	AsyncMode = "true"
+
+	var notified []squyre.Alert
+	NotifyOutput = func(alert squyre.Alert) error {
+		notified = append(notified, alert)
+		return nil
+	}
+
+	_, err := handleRequest(Ctx, statusEvent("TIMED_OUT"))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(notified) != 1 || notified[0].ID != "1234" || len(notified[0].Results) != 1 {
+		t.Fatalf("Unexpected notifications: %v", notified)
+	}
+
+	result := notified[0].Results[0]
+	if result.Success || result.Source != completionSource || !strings.Contains(result.Message, "States.Timeout: Task timed out") {
+		t.Fatalf("Unexpected result: %v", result)
+	}
+}
+
+func TestExecutionStatusSucceeded(t *testing.T) {
+	defer func() { NotifyOutput = invokeOutputFunction }()
+	defer func() { AsyncMode = "" }()
+	AsyncMode = "true"
+
+	NotifyOutput = func(alert squyre.Alert) error {
+		t.Fatalf("Unexpected notification for %v", alert)
+		return nil
+	}
+
+	have, err := handleRequest(Ctx, statusEvent("SUCCEEDED"))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := "Execution SUCCEEDED."
+	if have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestExecutionStatusSyncMode(t *testing.T) {
+	defer func() { NotifyOutput = invokeOutputFunction }()
+
+	// The conductor already reported the failure to the alert source, while waiting for the execution
+	NotifyOutput = func(alert squyre.Alert) error {
+		t.Fatalf("Unexpected notification for %v", alert)
+		return nil
+	}
+
+	have, err := handleRequest(Ctx, statusEvent("FAILED"))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := "Async mode off, nothing to report."
+	if have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+// domainRule is an entry in our list of domains we never send to enrichment providers
+type domainRule struct {
+	pattern string
+	source  string
+}
+
+// domainList holds the ignored domains, split by how they match
+type domainList struct {
+	exact    map[string]domainRule // Only the domain itself e.g. '=example.com'
+	suffix   map[string]domainRule // The domain and all its subdomains e.g. 'example.com'
+	wildcard []domainRule          // Glob style patterns e.g. '*.example.*'
+}
+
+// setupIgnoredDomains builds the ignored domain list from the comma separated IGNORE_DOMAIN
+// env var, plus any list file pointed to by the IGNORE_DOMAINS_FILE env var
+func setupIgnoredDomains() {
+	ignoredDomains = &domainList{
+		exact:  make(map[string]domainRule),
+		suffix: make(map[string]domainRule),
+	}
+
+	if IgnoreDomain != "" {
+		for _, entry := range strings.Split(IgnoreDomain, ",") {
+			ignoredDomains.add(entry, "IGNORE_DOMAIN env var")
+		}
+	}
+
+	if IgnoreDomainsFile != "" {
+		err := ignoredDomains.load(IgnoreDomainsFile)
+		if err != nil {
+			log.Errorf("Could not load domains from %s: %s", IgnoreDomainsFile, err)
+		}
+	}
+
+	if ignoredDomains.size() == 0 {
+		log.Warn("No domains to ignore! Set env var IGNORE_DOMAIN and/or IGNORE_DOMAINS_FILE.")
+	}
+}
+
+// load reads domains to ignore from a file, one per line. Lines in CSV format (such as the
+// Tranco top sites list, e.g. '1,google.com') use the last column as the domain.
+// Anything after a '#' is treated as a comment.
+func (list *domainList) load(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Split(line, ",")
+		list.add(fields[len(fields)-1], fileName)
+	}
+
+	return scanner.Err()
+}
+
+// add parses a domain entry and adds it to the list
+func (list *domainList) add(entry string, source string) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return
+	}
+
+	switch {
+	case strings.Contains(entry, "*"):
+		if _, err := path.Match(entry, ""); err != nil {
+			log.Errorf("Ignoring invalid domain pattern '%s' from %s: %s", entry, source, err)
+			return
+		}
+		list.wildcard = append(list.wildcard, domainRule{pattern: entry, source: source})
+	case strings.HasPrefix(entry, "="):
+		entry = strings.TrimPrefix(entry, "=")
+		list.exact[entry] = domainRule{pattern: entry, source: source}
+	default:
+		entry = strings.TrimPrefix(entry, ".")
+		// Never ignore every domain under a public suffix like 'github.io' or 'co.uk', just the suffix itself
+		if suffix, _ := publicsuffix.PublicSuffix(entry); suffix == entry {
+			log.Warnf("Domain '%s' from %s is a public suffix, only ignoring exact matches.", entry, source)
+			list.exact[entry] = domainRule{pattern: entry, source: source}
+			return
+		}
+		list.suffix[entry] = domainRule{pattern: entry, source: source}
+	}
+}
+
+func (list *domainList) size() int {
+	return len(list.exact) + len(list.suffix) + len(list.wildcard)
+}
+
+// match checks if a domain should be ignored, and if so why
+func (list *domainList) match(domain string) (string, bool) {
+	domain = strings.ToLower(domain)
+
+	if rule, ok := list.exact[domain]; ok {
+		return fmt.Sprintf("exactly matches '%s' from %s", rule.pattern, rule.source), true
+	}
+
+	// Walk up through the parent domains looking for a suffix match
+	for parent := domain; parent != ""; {
+		if rule, ok := list.suffix[parent]; ok {
+			return fmt.Sprintf("is within '%s' from %s", rule.pattern, rule.source), true
+		}
+		idx := strings.Index(parent, ".")
+		if idx < 0 {
+			break
+		}
+		parent = parent[idx+1:]
+	}
+
+	for _, rule := range list.wildcard {
+		if matched, _ := path.Match(rule.pattern, domain); matched {
+			return fmt.Sprintf("matches pattern '%s' from %s", rule.pattern, rule.source), true
+		}
+	}
+
+	return "", false
+}
+
+// ignoredDomainReason checks if a domain is on our ignore list, and if so why
+func ignoredDomainReason(domain string) (string, bool) {
+	if ignoredDomains == nil {
+		setupIgnoredDomains()
+	}
+	return ignoredDomains.match(domain)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetIgnoredDomains() {
+	IgnoreDomain = ""
+	IgnoreDomainsFile = ""
+	setupIgnoredDomains()
+}
+
+func TestIgnoredDomainMatching(t *testing.T) {
+	defer resetIgnoredDomains()
+	IgnoreDomain = "corp.example, =exact.com,*.cdn.*,github.io"
+	setupIgnoredDomains()
+
+	tests := map[string]bool{
+		"corp.example":         true,
+		"mail.corp.example":    true,
+		"notcorp.example":      false,
+		"exact.com":            true,
+		"sub.exact.com":        false,
+		"assets.cdn.net":       true,
+		"cdn.net":              false,
+		"github.io":            true,
+		"attacker.github.io":   false,
+		"evil.com":             false,
+		"MAIL.CORP.EXAMPLE":    true,
+		"corp.example.evil.io": false,
+	}
+	for domain, want := range tests {
+		reason, have := ignoredDomainReason(domain)
+		if have != want {
+			t.Fatalf("Unexpected result for %s. \nHave: %t (%s)\nWant: %t", domain, have, reason, want)
+		}
+	}
+}
+
+func TestIgnoredDomainsFile(t *testing.T) {
+	defer resetIgnoredDomains()
+
+	fileName := filepath.Join(t.TempDir(), "tranco.csv")
+	content := "1,google.com\n2,microsoft.com\n# our SaaS vendors\nslack.com\n"
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	IgnoreDomainsFile = fileName
+	setupIgnoredDomains()
+
+	reason, ok := ignoredDomainReason("login.microsoft.com")
+	if !ok {
+		t.Fatal("Expected login.microsoft.com to be ignored")
+	}
+	if !strings.Contains(reason, fileName) {
+		t.Fatalf("Unexpected reason: %s", reason)
+	}
+
+	if _, ok := ignoredDomainReason("app.slack.com"); !ok {
+		t.Fatal("Expected app.slack.com to be ignored")
+	}
+
+	subjects := extractDomains("google.com evil.com slack.com")
+	if len(subjects) != 1 || subjects[0].Value != "evil.com" {
+		t.Fatalf("Unexpected subjects: %v", subjects)
+	}
+}
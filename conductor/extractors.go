@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+// customExtractor defines an organisation specific subject type and the pattern used to find it
+type customExtractor struct {
+	Type  string `json:"type"`  // The type of subject found e.g. 'employee_id'
+	Regex string `json:"regex"` // Go regular expression matching the subject e.g. 'E\\d{6}'
+}
+
+// setupExtractors registers the built in extractors, followed by any custom extractors from the
+// CUSTOM_EXTRACTORS env var, which is a JSON list e.g. [{"type": "employee_id", "regex": "E\\d{6}"}]
+func setupExtractors() {
+	Extractors = squyre.NewExtractorRegistry(
+		squyre.NewExtractor("public IP addresses", extractIPs),
+		squyre.NewExtractor("public IPv6 addresses", extractIPv6s),
+		squyre.NewExtractor("domains", extractDomains),
+		squyre.NewExtractor("email addresses", extractEmailsAndDomains),
+	)
+
+	if HostRegex == "" {
+		log.Warn("Env var HOST_REGEX is not set, will not extract hosts!")
+	} else {
+		hosts, err := squyre.NewRegexExtractor("hostname", HostRegex)
+		if err != nil {
+			log.Errorf("Could not compile HOST_REGEX: %s", err)
+		} else {
+			Extractors.Register(hosts)
+		}
+	}
+
+	Extractors.Register(squyre.NewExtractor("urls", extractUrlsAndHosts))
+	Extractors.Register(squyre.NewExtractor("file hashes", extractHashes))
+
+	if CustomExtractors == "" {
+		return
+	}
+
+	var custom []customExtractor
+	err := json.Unmarshal([]byte(CustomExtractors), &custom)
+	if err != nil {
+		log.Errorf("Could not parse CUSTOM_EXTRACTORS env var: %s", err)
+		return
+	}
+
+	for _, definition := range custom {
+		if definition.Type == "" {
+			log.Errorf("Ignoring custom extractor '%s' with no type", definition.Regex)
+			continue
+		}
+		extractor, err := squyre.NewRegexExtractor(definition.Type, definition.Regex)
+		if err != nil {
+			log.Errorf("Ignoring custom extractor for type '%s': %s", definition.Type, err)
+			continue
+		}
+		Extractors.Register(extractor)
+	}
+}
+
+// extractEmailsAndDomains finds email addresses, pivoting on their domains too so domain providers get a look at them
+func extractEmailsAndDomains(details string) []squyre.Subject {
+	var subjectList []squyre.Subject
+
+	for _, sub := range extractEmails(details) {
+		subjectList = append(subjectList, sub, squyre.Subject{
+			Type:   "domain",
+			Value:  emailDomain(sub.Value),
+			Parent: sub.Value,
+		})
+	}
+	return subjectList
+}
+
+// extractUrlsAndHosts finds URLs, along with their hosts so that domain and IP providers get a look at them too
+func extractUrlsAndHosts(details string) []squyre.Subject {
+	var subjectList []squyre.Subject
+
+	for _, sub := range extractUrls(details) {
+		subjectList = append(subjectList, sub)
+
+		parsed, err := url.Parse(sub.Value)
+		if err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		host := strings.ToLower(parsed.Hostname())
+
+		// Hosts are held to the same rules as those found elsewhere in the alert
+		var hosts []squyre.Subject
+		if ip := net.ParseIP(host); ip == nil {
+			hosts = extractDomains(host)
+		} else if ip.To4() != nil {
+			hosts = extractIPs(host)
+		} else {
+			hosts = extractIPv6s(host)
+		}
+
+		for _, hostSub := range hosts {
+			hostSub.Parent = sub.Value
+			subjectList = append(subjectList, hostSub)
+		}
+	}
+	return subjectList
+}
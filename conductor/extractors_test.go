@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fatih/structs"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+func resetExtractors() {
+	HostRegex = ""
+	CustomExtractors = ""
+	Extractors = nil
+}
+
+func TestSetupExtractors(t *testing.T) {
+	defer resetExtractors()
+
+	HostRegex = `ABC-\d{5}`
+	CustomExtractors = `[{"type": "employee_id", "regex": "E\\d{6}"}, {"type": "broken", "regex": "E("}, {"regex": "X"}]`
+	setupExtractors()
+
+	var have []string
+	for _, extractor := range Extractors.Extractors() {
+		have = append(have, extractor.Name())
+	}
+	want := []string{"public IP addresses", "public IPv6 addresses", "domains", "email addresses", "hostname", "urls", "file hashes", "employee_id"}
+
+	if len(have) != len(want) {
+		t.Fatalf("Unexpected extractors. \nHave: %v\nWant: %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("Unexpected extractors. \nHave: %v\nWant: %v", have, want)
+		}
+	}
+}
+
+func TestHandlerCustomExtractor(t *testing.T) {
+	setup()
+	setupIgnoredDomains()
+	defer resetIgnoredDomains()
+	defer resetExtractors()
+
+	CustomExtractors = `[{"type": "employee_id", "regex": "E\\d{6}"}]`
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"search_name\": \"Test Alert\", \"message\": \"E123456 emailed bob@example.com about example.com\", \"correlation_id\": \"1234\"}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// The domain is also the email's, so it's linked to the email
+	want := []squyre.Subject{
+		{Type: "domain", Value: "example.com", Parent: "bob@example.com"},
+		{Type: "email", Value: "bob@example.com"},
+		{Type: "employee_id", Value: "E123456"},
+	}
+	if len(sent.Subjects) != len(want) {
+		t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", sent.Subjects, want)
+	}
+	for i := range want {
+		if sent.Subjects[i] != want[i] {
+			t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", sent.Subjects, want)
+		}
+	}
+
+	if sent.Scope != "domain,email,employee_id" {
+		t.Fatalf("Unexpected scope. \nHave: %s\nWant: %s", sent.Scope, "domain,email,employee_id")
+	}
+}
+
+func TestExtractUrlsAndHosts(t *testing.T) {
+	setupIgnoredDomains()
+	defer resetIgnoredDomains()
+
+	message := "Downloaded http://1.2.3.4/payload and http://10.0.0.1/x then visited https://EVIL.com/x and http://[2606:4700::1111]/y"
+	subjects := extractUrlsAndHosts(message)
+
+	want := []squyre.Subject{
+		{Type: "url", Value: "http://1.2.3.4/payload"},
+		{Type: "ipv4", Value: "1.2.3.4", Parent: "http://1.2.3.4/payload"},
+		{Type: "url", Value: "http://10.0.0.1/x"},
+		{Type: "url", Value: "https://EVIL.com/x"},
+		{Type: "domain", Value: "evil.com", Parent: "https://EVIL.com/x"},
+		{Type: "url", Value: "http://[2606:4700::1111]/y"},
+		{Type: "ipv6", Value: "2606:4700::1111", Parent: "http://[2606:4700::1111]/y"},
+	}
+
+	if len(subjects) != len(want) {
+		t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", subjects, want)
+	}
+	for i := range want {
+		if subjects[i] != want[i] {
+			t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", subjects, want)
+		}
+	}
+}
+
+func TestHandlerLinksUrlHosts(t *testing.T) {
+	setup()
+	setupIgnoredDomains()
+	defer resetIgnoredDomains()
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"search_name\": \"Test Alert\", \"message\": \"evil.com served http://evil.com/x from http://1.2.3.4/payload\", \"correlation_id\": \"1234\"}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if have, want := sent.Describe("evil.com"), "evil.com (from http://evil.com/x)"; have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if have, want := sent.Describe("1.2.3.4"), "1.2.3.4 (from http://1.2.3.4/payload)"; have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if sent.Scope != "domain,url,ipv4" {
+		t.Fatalf("Unexpected scope. \nHave: %s\nWant: %s", sent.Scope, "domain,url,ipv4")
+	}
+}
+
+func TestExtractIPsFromJSON(t *testing.T) {
+	details := `{"source":{"ip":"8.8.8.8"},"destination":"1.1.1.1:443","client":{"ip":"2606:4700:4700::1111"},"version":"11.1.1.10a"}`
+
+	var have []string
+	for _, subject := range append(extractIPs(details), extractIPv6s(details)...) {
+		have = append(have, subject.Value)
+	}
+	want := "8.8.8.8,1.1.1.1,2606:4700:4700::1111"
+
+	if strings.Join(have, ",") != want {
+		t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %s", have, want)
+	}
+}
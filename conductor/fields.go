@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+// fieldMapping maps a field in the structured alert payload to a subject type
+type fieldMapping struct {
+	Path  string `json:"path"`  // Dot separated path to the field e.g. 'result.src_ip'
+	Type  string `json:"type"`  // The type of subject the field holds e.g. 'ipv4'
+	Label string `json:"label"` // Optional friendly name for the field e.g. 'source IP'
+}
+
+// fieldExtractors are used to validate and filter the value of a mapped field, by subject type
+var fieldExtractors = map[string]func(string) []squyre.Subject{
+	"ipv4":     extractIPs,
+	"ipv6":     extractIPv6s,
+	"domain":   extractDomains,
+	"email":    extractEmailsAndDomains,
+	"hostname": extractHosts,
+	"url":      extractUrls,
+	"md5":      extractHashes,
+	"sha1":     extractHashes,
+	"sha256":   extractHashes,
+}
+
+// setupFieldMappings loads field mappings from the FIELD_MAP env var, which is a JSON list e.g.
+// [{"path": "result.src_ip", "type": "ipv4", "label": "source IP"}]
+func setupFieldMappings() {
+	fieldMappings = []fieldMapping{}
+
+	var mappings []fieldMapping
+	err := json.Unmarshal([]byte(FieldMap), &mappings)
+	if err != nil {
+		log.Errorf("Could not parse FIELD_MAP env var: %s", err)
+		return
+	}
+
+	for _, mapping := range mappings {
+		if _, ok := fieldExtractors[mapping.Type]; !ok || mapping.Path == "" {
+			log.Errorf("Ignoring invalid field mapping '%s' to type '%s'", mapping.Path, mapping.Type)
+			continue
+		}
+		fieldMappings = append(fieldMappings, mapping)
+	}
+}
+
+// extractionMode decides how subjects are extracted, based on the EXTRACTION_MODE and FIELD_MAP env vars
+func extractionMode() string {
+	if fieldMappings == nil && FieldMap != "" {
+		setupFieldMappings()
+	}
+
+	mode := strings.ToLower(ExtractionMode)
+	switch mode {
+	case "":
+		if len(fieldMappings) > 0 {
+			return "both"
+		}
+		return "regex"
+	case "regex", "fields", "both":
+	default:
+		log.Warnf("Unknown extraction mode '%s', scanning the alert message.", ExtractionMode)
+		return "regex"
+	}
+
+	if mode != "regex" && len(fieldMappings) == 0 {
+		log.Warn("Field extraction requested, but no valid field mappings set in FIELD_MAP! Scanning the alert message.")
+		return "regex"
+	}
+	return mode
+}
+
+// extractFields pulls subjects from the mapped fields of a structured alert payload
+func extractFields(payload string, mappings []fieldMapping) []squyre.Subject {
+	var subjectList []squyre.Subject
+
+	for _, mapping := range mappings {
+		field := mapping.Label
+		if field == "" {
+			field = mapping.Path
+		}
+
+		values := squyre.ValuesAtPath(payload, mapping.Path)
+		for _, value := range values {
+			details, refanged := refang(value)
+
+			subjects := fieldExtractors[mapping.Type](details)
+			markDefanged(subjects, refanged)
+
+			for _, subject := range subjects {
+				// Hash extraction finds all hash types, only keep the mapped one, and any subjects derived from it
+				if (subject.Type != mapping.Type && subject.Parent == "") || hasSubject(subjectList, subject) {
+					continue
+				}
+				subject.Field = field
+				subjectList = append(subjectList, subject)
+			}
+		}
+	}
+	return subjectList
+}
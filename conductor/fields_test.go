@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func resetFieldMappings() {
+	FieldMap = ""
+	ExtractionMode = ""
+	fieldMappings = nil
+}
+
+func TestExtractFields(t *testing.T) {
+	payload := `{"result": {"src_ip": "8.8.8.8", "dest_ip": "10.0.0.1", "url": "hxxp://evil[.]com/x", "note": "1.1.1.1"}}`
+	mappings := []fieldMapping{
+		{Path: "result.src_ip", Type: "ipv4", Label: "source IP"},
+		{Path: "result.dest_ip", Type: "ipv4", Label: "destination IP"},
+		{Path: "result.url", Type: "url"},
+	}
+
+	subjects := extractFields(payload, mappings)
+
+	if len(subjects) != 2 {
+		t.Fatalf("Unexpected number of subjects. \nHave: %d\nWant: %d\nGot: %v", len(subjects), 2, subjects)
+	}
+
+	if subjects[0].Value != "8.8.8.8" || subjects[0].Field != "source IP" {
+		t.Fatalf("Unexpected first subject: %v", subjects[0])
+	}
+
+	if subjects[1].Value != "http://evil.com/x" || subjects[1].Field != "result.url" || !subjects[1].Defanged {
+		t.Fatalf("Unexpected second subject: %v", subjects[1])
+	}
+}
+
+// tests email fields pivot on their domains, as when scanning the message
+func TestExtractFieldsEmail(t *testing.T) {
+	payload := `{"result": {"sender": "bob@evil.com"}}`
+	mappings := []fieldMapping{
+		{Path: "result.sender", Type: "email", Label: "sender"},
+	}
+
+	subjects := extractFields(payload, mappings)
+
+	if len(subjects) != 2 {
+		t.Fatalf("Unexpected number of subjects. \nHave: %d\nWant: %d\nGot: %v", len(subjects), 2, subjects)
+	}
+
+	if subjects[0].Type != "email" || subjects[0].Value != "bob@evil.com" || subjects[0].Field != "sender" {
+		t.Fatalf("Unexpected first subject: %v", subjects[0])
+	}
+
+	if subjects[1].Type != "domain" || subjects[1].Value != "evil.com" || subjects[1].Parent != "bob@evil.com" || subjects[1].Field != "sender" {
+		t.Fatalf("Unexpected second subject: %v", subjects[1])
+	}
+}
+
+func TestExtractionMode(t *testing.T) {
+	defer resetFieldMappings()
+
+	resetFieldMappings()
+	if mode := extractionMode(); mode != "regex" {
+		t.Fatalf("Expected regex mode without field mappings, got %s", mode)
+	}
+
+	resetFieldMappings()
+	FieldMap = `[{"path": "result.src_ip", "type": "ipv4"}, {"path": "result.other", "type": "unknown"}]`
+	if mode := extractionMode(); mode != "both" {
+		t.Fatalf("Expected both mode with field mappings, got %s", mode)
+	}
+	if len(fieldMappings) != 1 {
+		t.Fatalf("Expected invalid mapping to be dropped, got %v", fieldMappings)
+	}
+
+	ExtractionMode = "fields"
+	if mode := extractionMode(); mode != "fields" {
+		t.Fatalf("Expected fields mode, got %s", mode)
+	}
+}
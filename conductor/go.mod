@@ -18,3 +18,5 @@ require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
+
+replace github.com/gyrospectre/squyre/pkg/squyre => ../pkg/squyre
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ipBlock is a range of IP addresses we never send to enrichment providers
+type ipBlock struct {
+	network *net.IPNet
+	reason  string
+}
+
+// defaultIgnoredBlocks covers the IANA special-purpose address registries, plus multicast.
+// See https://www.iana.org/assignments/iana-ipv4-special-registry and
+// https://www.iana.org/assignments/iana-ipv6-special-registry
+var defaultIgnoredBlocks = []struct {
+	cidr   string
+	reason string
+}{
+	// IPv4
+	{"0.0.0.0/8", "'This network' (RFC791)"},
+	{"10.0.0.0/8", "Private-Use (RFC1918)"},
+	{"100.64.0.0/10", "Shared Address Space / CGNAT (RFC6598)"},
+	{"127.0.0.0/8", "Loopback (RFC1122)"},
+	{"169.254.0.0/16", "Link Local (RFC3927)"},
+	{"172.16.0.0/12", "Private-Use (RFC1918)"},
+	{"192.0.0.0/24", "IETF Protocol Assignments (RFC6890)"},
+	{"192.0.2.0/24", "Documentation TEST-NET-1 (RFC5737)"},
+	{"192.31.196.0/24", "AS112-v4 (RFC7535)"},
+	{"192.52.193.0/24", "AMT (RFC7450)"},
+	{"192.88.99.0/24", "Deprecated 6to4 Relay Anycast (RFC7526)"},
+	{"192.168.0.0/16", "Private-Use (RFC1918)"},
+	{"192.175.48.0/24", "Direct Delegation AS112 Service (RFC7534)"},
+	{"198.18.0.0/15", "Benchmarking (RFC2544)"},
+	{"198.51.100.0/24", "Documentation TEST-NET-2 (RFC5737)"},
+	{"203.0.113.0/24", "Documentation TEST-NET-3 (RFC5737)"},
+	{"224.0.0.0/4", "Multicast (RFC5771)"},
+	{"240.0.0.0/4", "Reserved (RFC1112)"},
+	{"255.255.255.255/32", "Limited Broadcast (RFC919)"},
+
+	// IPv6
+	{"::1/128", "Loopback Address (RFC4291)"},
+	{"::/128", "Unspecified Address (RFC4291)"},
+	{"64:ff9b::/96", "IPv4-IPv6 Translation (RFC6052)"},
+	{"64:ff9b:1::/48", "Local-Use IPv4/IPv6 Translation (RFC8215)"},
+	{"100::/64", "Discard-Only Address Block (RFC6666)"},
+	{"2001::/23", "IETF Protocol Assignments (RFC2928)"},
+	{"2001:db8::/32", "Documentation (RFC3849)"},
+	{"2002::/16", "6to4 (RFC3056)"},
+	{"2620:4f:8000::/48", "Direct Delegation AS112 Service (RFC7534)"},
+	{"3fff::/20", "Documentation (RFC9637)"},
+	{"5f00::/16", "Segment Routing SIDs (RFC9602)"},
+	{"fc00::/7", "Unique-Local (RFC4193)"},
+	{"fe80::/10", "Link-Local Unicast (RFC4291)"},
+	{"ff00::/8", "Multicast (RFC4291)"},
+}
+
+// setupIPBlocks builds the list of ignored IP ranges from our defaults, plus any extra
+// CIDRs configured via the IGNORE_CIDRS and IGNORE_CIDRS_FILE env vars
+func setupIPBlocks() {
+	ignoredBlocks = nil
+
+	for _, block := range defaultIgnoredBlocks {
+		addIgnoredBlock(block.cidr, block.reason)
+	}
+
+	if IgnoreCIDRs != "" {
+		for _, cidr := range strings.Split(IgnoreCIDRs, ",") {
+			addIgnoredBlock(cidr, "excluded by IGNORE_CIDRS env var")
+		}
+	}
+
+	if IgnoreCIDRsFile != "" {
+		err := loadIgnoredBlocks(IgnoreCIDRsFile)
+		if err != nil {
+			log.Errorf("Could not load CIDRs from %s: %s", IgnoreCIDRsFile, err)
+		}
+	}
+}
+
+// loadIgnoredBlocks reads CIDRs to ignore from a file, one per line. Anything after a '#' is
+// treated as a comment, and used as the reason for ignoring the range if present.
+func loadIgnoredBlocks(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		reason := fmt.Sprintf("excluded by %s", fileName)
+
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			if comment := strings.TrimSpace(line[idx+1:]); comment != "" {
+				reason = fmt.Sprintf("%s (%s)", reason, comment)
+			}
+			line = line[:idx]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		addIgnoredBlock(line, reason)
+	}
+
+	return scanner.Err()
+}
+
+// addIgnoredBlock adds a CIDR to the ignored list. Single addresses are treated as a /32 or /128.
+func addIgnoredBlock(cidr string, reason string) {
+	cidr = strings.TrimSpace(cidr)
+	if cidr == "" {
+		return
+	}
+
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr = cidr + "/32"
+		} else {
+			cidr = cidr + "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Errorf("Ignoring invalid CIDR '%s': %s", cidr, err)
+		return
+	}
+
+	ignoredBlocks = append(ignoredBlocks, ipBlock{
+		network: network,
+		reason:  reason,
+	})
+}
+
+// ignoredIPReason checks if an IP address falls in an ignored range, and if so why
+func ignoredIPReason(ipStr string) (string, bool) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return "not a valid IP address", true
+	}
+
+	for _, block := range ignoredBlocks {
+		if block.network.Contains(ip) {
+			return fmt.Sprintf("in %s, %s", block.network, block.reason), true
+		}
+	}
+	return "", false
+}
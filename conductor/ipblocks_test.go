@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetIPBlocks() {
+	IgnoreCIDRs = ""
+	IgnoreCIDRsFile = ""
+	setupIPBlocks()
+}
+
+func TestDefaultIgnoredBlocks(t *testing.T) {
+	defer resetIPBlocks()
+	resetIPBlocks()
+
+	ignored := []string{"100.64.1.1", "169.254.169.254", "224.0.0.251", "192.0.2.10", "2001:db8::1", "ff02::1"}
+	for _, ip := range ignored {
+		if _, ok := ignoredIPReason(ip); !ok {
+			t.Fatalf("Expected %s to be ignored", ip)
+		}
+	}
+
+	allowed := []string{"8.8.8.8", "2001:4860:4860::8888"}
+	for _, ip := range allowed {
+		if reason, ok := ignoredIPReason(ip); ok {
+			t.Fatalf("Expected %s to be allowed, but was ignored: %s", ip, reason)
+		}
+	}
+}
+
+func TestEnvIgnoredBlocks(t *testing.T) {
+	defer resetIPBlocks()
+	IgnoreCIDRs = "8.8.8.0/24, 1.1.1.1,not-a-cidr"
+	setupIPBlocks()
+
+	reason, ok := ignoredIPReason("8.8.8.8")
+	if !ok {
+		t.Fatal("Expected 8.8.8.8 to be ignored")
+	}
+	if !strings.Contains(reason, "IGNORE_CIDRS") {
+		t.Fatalf("Unexpected reason: %s", reason)
+	}
+
+	if _, ok := ignoredIPReason("1.1.1.1"); !ok {
+		t.Fatal("Expected single address 1.1.1.1 to be ignored")
+	}
+
+	if _, ok := ignoredIPReason("1.1.1.2"); ok {
+		t.Fatal("Expected 1.1.1.2 to be allowed")
+	}
+}
+
+func TestFileIgnoredBlocks(t *testing.T) {
+	defer resetIPBlocks()
+
+	fileName := filepath.Join(t.TempDir(), "cidrs.txt")
+	content := "# Our egress ranges\n151.101.0.0/16 # CDN egress\n\n2606:4700::/32\n"
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	IgnoreCIDRsFile = fileName
+	setupIPBlocks()
+
+	reason, ok := ignoredIPReason("151.101.29.67")
+	if !ok {
+		t.Fatal("Expected 151.101.29.67 to be ignored")
+	}
+	if !strings.Contains(reason, "CDN egress") {
+		t.Fatalf("Unexpected reason: %s", reason)
+	}
+
+	if _, ok := ignoredIPReason("2606:4700:4700::1111"); !ok {
+		t.Fatal("Expected 2606:4700:4700::1111 to be ignored")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+// subjectLimit reads a limit on the number of subjects from an env var, where zero or unset means no limit
+func subjectLimit(name string, value string) int {
+	if value == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Errorf("Ignoring invalid %s '%s', must be a positive number", name, value)
+		return 0
+	}
+	return limit
+}
+
+// prioritiseSubjects orders subjects by importance, according to the SUBJECT_PRIORITY env var. Either
+// "first-seen", the order they were found in the alert, or "frequency", how often they appear in it.
+func prioritiseSubjects(subjects []squyre.Subject, details string) []squyre.Subject {
+	prioritised := make([]squyre.Subject, len(subjects))
+	copy(prioritised, subjects)
+
+	switch strings.ToLower(SubjectPriority) {
+	case "", "first-seen":
+	case "frequency":
+		lower := strings.ToLower(details)
+		counts := make(map[string]int)
+		for _, subject := range prioritised {
+			counts[subject.Value] = countSubject(lower, strings.ToLower(subject.Value))
+		}
+		sort.SliceStable(prioritised, func(i, j int) bool {
+			return counts[prioritised[i].Value] > counts[prioritised[j].Value]
+		})
+	default:
+		log.Warnf("Unknown subject priority '%s', using first-seen order.", SubjectPriority)
+	}
+	return prioritised
+}
+
+// continuesSubject reports whether a character could be part of a subject, so a match next to it is really part of
+// something longer e.g. 1.1.1.1 in 11.1.1.10, or evil.com in not.evil.com
+func continuesSubject(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(".-_:", c) >= 0
+}
+
+// countSubject counts how often a subject appears in the text on its own, rather than as part of something longer
+func countSubject(text string, value string) int {
+	if value == "" {
+		return 0
+	}
+
+	count := 0
+	for start := 0; ; {
+		idx := strings.Index(text[start:], value)
+		if idx < 0 {
+			return count
+		}
+		idx += start
+		end := idx + len(value)
+		start = idx + 1
+
+		if idx > 0 && continuesSubject(text[idx-1]) {
+			continue
+		}
+		// Allow for a full stop at the end of a sentence
+		if end < len(text) && continuesSubject(text[end]) && !(text[end] == '.' && (end+1 == len(text) || !continuesSubject(text[end+1]))) {
+			continue
+		}
+		count++
+	}
+}
+
+// limitSubjects keeps the most important subjects within the MAX_SUBJECTS and MAX_SUBJECTS_PER_TYPE limits,
+// returning them in their original order along with how many were left out
+func limitSubjects(subjects []squyre.Subject, details string) ([]squyre.Subject, int) {
+	maxSubjects := subjectLimit("MAX_SUBJECTS", MaxSubjects)
+	maxPerType := subjectLimit("MAX_SUBJECTS_PER_TYPE", MaxSubjectsPerType)
+	if maxSubjects == 0 && maxPerType == 0 {
+		return subjects, 0
+	}
+
+	kept := make(map[squyre.Subject]bool)
+	perType := make(map[string]int)
+	total := 0
+	for _, subject := range prioritiseSubjects(subjects, details) {
+		if maxPerType > 0 && perType[subject.Type] >= maxPerType {
+			continue
+		}
+		if maxSubjects > 0 && total >= maxSubjects {
+			continue
+		}
+		kept[subject] = true
+		perType[subject.Type]++
+		total++
+	}
+
+	var limited []squyre.Subject
+	for _, subject := range subjects {
+		if kept[subject] {
+			limited = append(limited, subject)
+		}
+	}
+	return limited, len(subjects) - len(limited)
+}
+
+// scopeOf lists the types of subjects present, in the order of the original scope
+func scopeOf(subjects []squyre.Subject, scope []string) []string {
+	present := make(map[string]bool)
+	for _, subject := range subjects {
+		present[subject.Type] = true
+	}
+
+	var limited []string
+	for _, subjectType := range scope {
+		if present[subjectType] {
+			limited = append(limited, subjectType)
+		}
+	}
+	return limited
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fatih/structs"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+func resetLimits() {
+	MaxSubjects = ""
+	MaxSubjectsPerType = ""
+	SubjectPriority = ""
+}
+
+func values(subjects []squyre.Subject) []string {
+	var list []string
+	for _, subject := range subjects {
+		list = append(list, subject.Value)
+	}
+	return list
+}
+
+func TestLimitSubjects(t *testing.T) {
+	defer resetLimits()
+
+	subjects := []squyre.Subject{
+		{Type: "ipv4", Value: "1.1.1.1"},
+		{Type: "ipv4", Value: "2.2.2.2"},
+		{Type: "domain", Value: "a.com"},
+		{Type: "ipv4", Value: "3.3.3.3"},
+		{Type: "domain", Value: "b.com"},
+	}
+	details := "1.1.1.1 2.2.2.2 a.com 3.3.3.3 b.com 3.3.3.3 b.com b.com"
+
+	tests := []struct {
+		max       string
+		perType   string
+		priority  string
+		want      []string
+		truncated int
+	}{
+		{"", "", "", []string{"1.1.1.1", "2.2.2.2", "a.com", "3.3.3.3", "b.com"}, 0},
+		{"3", "", "", []string{"1.1.1.1", "2.2.2.2", "a.com"}, 2},
+		{"", "1", "", []string{"1.1.1.1", "a.com"}, 3},
+		{"", "1", "frequency", []string{"3.3.3.3", "b.com"}, 3},
+		{"3", "2", "frequency", []string{"1.1.1.1", "3.3.3.3", "b.com"}, 2},
+		{"bad", "", "unknown", []string{"1.1.1.1", "2.2.2.2", "a.com", "3.3.3.3", "b.com"}, 0},
+	}
+
+	for _, test := range tests {
+		MaxSubjects = test.max
+		MaxSubjectsPerType = test.perType
+		SubjectPriority = test.priority
+
+		limited, truncated := limitSubjects(subjects, details)
+		have := values(limited)
+		if len(have) != len(test.want) || truncated != test.truncated {
+			t.Fatalf("Unexpected subjects for %v. \nHave: %v (%d truncated)\nWant: %v (%d truncated)", test, have, truncated, test.want, test.truncated)
+		}
+		for i := range have {
+			if have[i] != test.want[i] {
+				t.Fatalf("Unexpected subjects for %v. \nHave: %v\nWant: %v", test, have, test.want)
+			}
+		}
+	}
+}
+
+func TestCountSubject(t *testing.T) {
+	details := "11.1.1.10 1.1.1.1, 1.1.1.10 a.evil.com evil.com/x evil.com. bob@evil.com evil.community https://evil.com"
+
+	tests := map[string]int{
+		"1.1.1.1":  1,
+		"1.1.1.10": 1,
+		"evil.com": 4,
+		"nope.com": 0,
+	}
+	for value, want := range tests {
+		if have := countSubject(details, value); have != want {
+			t.Errorf("Unexpected count for %s. \nHave: %d\nWant: %d", value, have, want)
+		}
+	}
+}
+
+func TestLimitSubjectsFrequencyBoundaries(t *testing.T) {
+	defer resetLimits()
+	MaxSubjects = "1"
+	SubjectPriority = "frequency"
+
+	// 1.1.1.1 shows up inside the other addresses, but only appears once on its own
+	subjects := []squyre.Subject{
+		{Type: "ipv4", Value: "1.1.1.1"},
+		{Type: "ipv4", Value: "11.1.1.10"},
+	}
+	limited, _ := limitSubjects(subjects, "1.1.1.1 11.1.1.10 11.1.1.10")
+
+	if have := values(limited); len(have) != 1 || have[0] != "11.1.1.10" {
+		t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", have, []string{"11.1.1.10"})
+	}
+}
+
+func TestHandlerLimitsSubjects(t *testing.T) {
+	setup()
+	defer resetLimits()
+	MaxSubjectsPerType = "1"
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"search_name\": \"Test Alert\", \"message\": \"hi 8.8.8.8, 9.9.9.9, 1.1.1.1\", \"correlation_id\": \"1234\"}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(sent.Subjects) != 1 || sent.Subjects[0].Value != "8.8.8.8" || sent.Truncated != 2 {
+		t.Fatalf("Unexpected alert: %v", sent)
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
-	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -15,6 +18,7 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
@@ -27,7 +31,12 @@ import (
 )
 
 var (
-	privateBlocks []*net.IPNet
+	ignoredBlocks  []ipBlock
+	ignoredDomains *domainList
+	fieldMappings  []fieldMapping
+	genericMapping *squyre.GenericAlertMapping
+	// Extractors finds subjects in alert messages, is populated on first use
+	Extractors *squyre.ExtractorRegistry
 	// Stack defines the main stack in use
 	Stack CloudformationStack
 	// SendAlert abstracts the sendAlertToSfn function to allow for testing
@@ -36,8 +45,36 @@ var (
 	BuildDestination = BuildStateMachine
 	// HostRegex defines the pattern for hostnames in your organisation, comes from an env var
 	HostRegex = os.Getenv("HOST_REGEX")
-	// IgnoreDomain optionally specifies a domain to ignore when extracting domains, comes from an env var
+	// IgnoreDomain optionally specifies a comma separated list of domains to ignore when extracting domains, comes from an env var
 	IgnoreDomain = os.Getenv("IGNORE_DOMAIN")
+	// IgnoreDomainsFile optionally specifies a file listing domains to ignore when extracting domains, comes from an env var
+	IgnoreDomainsFile = os.Getenv("IGNORE_DOMAINS_FILE")
+	// FieldMap optionally specifies, as JSON, the alert fields to extract subjects from, comes from an env var
+	FieldMap = os.Getenv("FIELD_MAP")
+	// ExtractionMode specifies whether to extract subjects by scanning the alert message ("regex"), from mapped
+	// alert fields ("fields") or "both", comes from an env var
+	ExtractionMode = os.Getenv("EXTRACTION_MODE")
+	// IgnoreCIDRs optionally specifies a comma separated list of extra CIDRs to ignore when extracting IPs, comes from an env var
+	IgnoreCIDRs = os.Getenv("IGNORE_CIDRS")
+	// IgnoreCIDRsFile optionally specifies a file listing extra CIDRs to ignore when extracting IPs, comes from an env var
+	IgnoreCIDRsFile = os.Getenv("IGNORE_CIDRS_FILE")
+	// GenericAlertMap optionally specifies, as JSON, the paths to alert details in payloads from other webhook sources, comes from an env var
+	GenericAlertMap = os.Getenv("GENERIC_ALERT_MAP")
+	// AsyncMode, if "true", returns as soon as enrichment has started rather than waiting for it to finish, comes from an env var
+	AsyncMode = os.Getenv("ASYNC_MODE")
+	// SignedSources optionally specifies a comma separated list of alert sources (or "*" for all) that must sign
+	// alerts sent via API GW, comes from an env var
+	SignedSources = os.Getenv("SIGNED_SOURCES")
+	// SignatureTolerance optionally specifies how many seconds old a signed alert can be, comes from an env var
+	SignatureTolerance = os.Getenv("SIGNATURE_TOLERANCE")
+	// MaxSubjects optionally limits the number of subjects enriched per alert, comes from an env var
+	MaxSubjects = os.Getenv("MAX_SUBJECTS")
+	// MaxSubjectsPerType optionally limits the number of subjects of each type enriched per alert, comes from an env var
+	MaxSubjectsPerType = os.Getenv("MAX_SUBJECTS_PER_TYPE")
+	// SubjectPriority decides which subjects to keep when over the limits, "first-seen" or "frequency", comes from an env var
+	SubjectPriority = os.Getenv("SUBJECT_PRIORITY")
+	// CustomExtractors optionally specifies, as JSON, extra subject types to extract using regular expressions, comes from an env var
+	CustomExtractors = os.Getenv("CUSTOM_EXTRACTORS")
 )
 
 const (
@@ -79,10 +116,11 @@ type StateMachine struct {
 	FunctionArn string
 }
 
-// Execute starts a step function execution with the provided input data
-func (s *StateMachine) Execute(input string) (*sfn.StartExecutionOutput, error) {
+// Execute starts a named step function execution with the provided input data
+func (s *StateMachine) Execute(name string, input string) (*sfn.StartExecutionOutput, error) {
 	result, err := s.Client.StartExecution(&sfn.StartExecutionInput{
 		StateMachineArn: aws.String(s.FunctionArn),
+		Name:            aws.String(name),
 		Input:           aws.String(input),
 	})
 	if err != nil {
@@ -92,6 +130,17 @@ func (s *StateMachine) Execute(input string) (*sfn.StartExecutionOutput, error)
 	return result, err
 }
 
+// Status returns the status of a step function execution e.g. RUNNING
+func (s *StateMachine) Status(execArn string) (string, error) {
+	result, err := s.Client.DescribeExecution(&sfn.DescribeExecutionInput{
+		ExecutionArn: aws.String(execArn),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.Status), nil
+}
+
 // WaitForExecCompletion waits for a given step function execution to complete
 func (s *StateMachine) WaitForExecCompletion(execArn *string) error {
 	iter := 1
@@ -127,22 +176,6 @@ func (s *StateMachine) WaitForExecCompletion(execArn *string) error {
 	return errors.New("Step function timed out")
 }
 
-func setupIPBlocks() {
-	privateBlockStrs := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"127.0.0.0/8",
-	}
-
-	privateBlocks = make([]*net.IPNet, len(privateBlockStrs))
-
-	for i, blockStr := range privateBlockStrs {
-		_, block, _ := net.ParseCIDR(blockStr)
-		privateBlocks[i] = block
-	}
-}
-
 func init() {
 	sess := session.Must(session.NewSession())
 
@@ -152,22 +185,11 @@ func init() {
 	}
 }
 
-func isPrivateIP(ipStr string) bool {
-	ip := net.ParseIP(ipStr)
-
-	for _, priv := range privateBlocks {
-		if priv.Contains(ip) {
-			return true
-		}
-	}
-	return false
-}
-
 func removeDuplicateTrimmedStr(strSlice []string) []string {
 	allKeys := make(map[string]bool)
 	list := []string{}
 	for _, item := range strSlice {
-		trimmed := strings.Trim(item, " {}=[],")
+		trimmed := strings.Trim(item, " {}=[],\"")
 		if _, value := allKeys[trimmed]; !value {
 			allKeys[trimmed] = true
 			list = append(list, trimmed)
@@ -178,53 +200,92 @@ func removeDuplicateTrimmedStr(strSlice []string) []string {
 
 func extractHosts(details string) []squyre.Subject {
 	if HostRegex == "" {
-		log.Warn("Env var IGNORE_DOMAIN is not set!")
+		log.Warn("Env var HOST_REGEX is not set!")
 		return nil
 	}
-	var subjectList []squyre.Subject
 
-	regex := `(^|[ =\{\}\[])` + HostRegex + `($|[ ,\{\}\]])`
+	extractor, err := squyre.NewRegexExtractor("hostname", HostRegex)
+	if err != nil {
+		log.Errorf("Could not compile HOST_REGEX: %s", err)
+		return nil
+	}
+	return extractor.Extract(details)
+}
+
+func extractIPs(details string) []squyre.Subject {
+	var subjectList []squyre.Subject
 
-	re := regexp.MustCompile(regex)
+	// Only match IP addresses bounded by space, start/end of line, '=', braces, quotes or colons, so
+	// addresses in JSON values and host:port pairs are found. Prevents a lot of false positive matches!
+	re := regexp.MustCompile(`(^|[ =\{\}\[":])(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)(\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)){3}($|[ ,\{\}\]":])`)
 
 	submatchall := re.FindAllString(details, -1)
+	for i, address := range submatchall {
+		submatchall[i] = strings.Trim(address, ":")
+	}
+
+	if len(ignoredBlocks) < 1 {
+		setupIPBlocks()
+	}
+
 	submatchall = removeDuplicateTrimmedStr(submatchall)
 
-	for _, hostname := range submatchall {
+	for _, address := range submatchall {
 		var subject = squyre.Subject{
-			Type:  "hostname",
-			Value: hostname,
+			Type:  "ipv4",
+			Value: address,
+		}
+
+		// Ignore private, special purpose and excluded IP addresses
+		if reason, ignored := ignoredIPReason(address); ignored {
+			log.Infof("Ignoring IP address %s: %s.", address, reason)
+			continue
 		}
 		subjectList = append(subjectList, subject)
 	}
 	return subjectList
 }
 
-func extractIPs(details string) []squyre.Subject {
+func extractIPv6s(details string) []squyre.Subject {
 	var subjectList []squyre.Subject
 
-	// Only match IP addresses bounded by space, start/end of line, '=' or braces.
-	// Prevents a lot of false positive matches!
-	re := regexp.MustCompile(`(^|[ =\{\}\[])(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)(\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)){3}($|[ ,\{\}\]])`)
+	// IPv6 addresses are too varied to match precisely with a regex, so grab anything that looks
+	// vaguely like one (hex digits, colons and dots) using the same boundaries as for IPv4, bar
+	// colons which are part of the address, then validate each candidate properly.
+	re := regexp.MustCompile(`(^|[ =\{\}\["])[0-9A-Fa-f]{0,4}:[0-9A-Fa-f:.]*:[0-9A-Fa-f.]*($|[ ,\{\}\]"])`)
 
 	submatchall := re.FindAllString(details, -1)
 
-	if len(privateBlocks) < 1 {
+	if len(ignoredBlocks) < 1 {
 		setupIPBlocks()
 	}
 
 	submatchall = removeDuplicateTrimmedStr(submatchall)
 
-	for _, address := range submatchall {
+	seen := make(map[string]bool)
+	for _, candidate := range submatchall {
+		ip := net.ParseIP(candidate)
+		// Skip anything that isn't a valid address, and IPv4-mapped addresses
+		if ip == nil || ip.To4() != nil {
+			continue
+		}
+		address := ip.String()
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
 		var subject = squyre.Subject{
-			Type:  "ipv4",
+			Type:  "ipv6",
 			Value: address,
 		}
 
-		// Ignore private IP addresses
-		if isPrivateIP(address) == false {
-			subjectList = append(subjectList, subject)
+		// Ignore private, special purpose and excluded IP addresses
+		if reason, ignored := ignoredIPReason(address); ignored {
+			log.Infof("Ignoring IP address %s: %s.", address, reason)
+			continue
 		}
+		subjectList = append(subjectList, subject)
 	}
 	return subjectList
 }
@@ -237,31 +298,89 @@ func extractDomains(details string) []squyre.Subject {
 
 	submatchall = removeDuplicateTrimmedStr(submatchall)
 
-	if IgnoreDomain == "" {
-		log.Warn("Env var IGNORE_DOMAIN is not set!")
+	for _, domain := range submatchall {
+		if reason, ignored := ignoredDomainReason(domain); ignored {
+			log.Infof("Ignoring domain %s: %s.", domain, reason)
+			continue
+		}
+		// Ignore TLDs that are not official
+		if _, icann := publicsuffix.PublicSuffix(domain); !icann {
+			log.Infof("Ignoring internal domain %s.", domain)
+			continue
+		}
+
+		var subject = squyre.Subject{
+			Type:  "domain",
+			Value: domain,
+		}
+		log.Infof("Adding domain %s.", domain)
+		subjectList = append(subjectList, subject)
 	}
+	return subjectList
+}
 
-	for _, domain := range submatchall {
-		if (IgnoreDomain != "" || !strings.Contains(domain, IgnoreDomain)) || IgnoreDomain == "" {
-			var subject = squyre.Subject{
-				Type:  "domain",
-				Value: domain,
-			}
-			// Ignore TLDs that are not official
-			_, icann := publicsuffix.PublicSuffix(domain)
-			if icann {
-				log.Infof("Adding domain %s.", domain)
-				subjectList = append(subjectList, subject)
-			} else {
-				log.Infof("Ignoring internal domain %s.", domain)
-			}
-		} else if IgnoreDomain != "" {
-			log.Infof("Ignoring domain %s per env var.", domain)
+func extractEmails(details string) []squyre.Subject {
+	var subjectList []squyre.Subject
+
+	re := regexp.MustCompile(`(?i)\b[a-z0-9._%+\-]+@(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,}\b`)
+
+	submatchall := re.FindAllString(details, -1)
+	for i, address := range submatchall {
+		submatchall[i] = strings.ToLower(address)
+	}
+	submatchall = removeDuplicateTrimmedStr(submatchall)
+
+	for _, address := range submatchall {
+		domain := emailDomain(address)
+
+		if reason, ignored := ignoredDomainReason(domain); ignored {
+			log.Infof("Ignoring email address %s: domain %s.", address, reason)
+			continue
+		}
+		// Ignore TLDs that are not official
+		if _, icann := publicsuffix.PublicSuffix(domain); !icann {
+			log.Infof("Ignoring internal email address %s.", address)
+			continue
 		}
+
+		var subject = squyre.Subject{
+			Type:  "email",
+			Value: address,
+		}
+		subjectList = append(subjectList, subject)
 	}
 	return subjectList
 }
 
+// emailDomain returns the domain part of an email address
+func emailDomain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+func containsStr(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSubject checks if a subject with the same type and value is already in a list of subjects
+func hasSubject(subjects []squyre.Subject, subject squyre.Subject) bool {
+	return subjectIndex(subjects, subject) >= 0
+}
+
+// subjectIndex finds a subject with the same type and value in a list of subjects, or returns -1
+func subjectIndex(subjects []squyre.Subject, subject squyre.Subject) int {
+	for i, existing := range subjects {
+		if existing.Type == subject.Type && existing.Value == subject.Value {
+			return i
+		}
+	}
+	return -1
+}
+
 func extractUrls(details string) []squyre.Subject {
 	var subjectList []squyre.Subject
 
@@ -269,9 +388,16 @@ func extractUrls(details string) []squyre.Subject {
 	submatchall := rxStrict.FindAllString(details, -1)
 	submatchall = removeDuplicateTrimmedStr(submatchall)
 
-	for _, url := range submatchall {
-		if strings.Contains(url, "safelinks.protection.outlook.com") {
-			url = normaliseAtpSafeLink(url)
+	for _, link := range submatchall {
+		// Find where links rewritten by email security products really go
+		url, domain := unwrapURL(link)
+		if domain != "" {
+			// Only the domain could be recovered, which is held to the same rules as other domains
+			for _, sub := range extractDomains(domain) {
+				sub.Parent = link
+				subjectList = append(subjectList, sub)
+			}
+			continue
 		}
 
 		var subject = squyre.Subject{
@@ -284,28 +410,104 @@ func extractUrls(details string) []squyre.Subject {
 	return subjectList
 }
 
-// normaliseAtpSafeLink extracts the target Url from a M365 ATP safe link. It will return the raw safe link if parsing fails for any reason.
-func normaliseAtpSafeLink(safeurl string) string {
-	splitUrl := strings.Split(safeurl, "?url=")
-	if len(splitUrl) < 2 {
-		log.Error("Could not parse ATP Safe Link! URL missing.")
-		return safeurl
+// refangers undo the common ways indicators are defanged, in the order they must be applied
+var refangers = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`(?i)\bh(?:xx|\*\*|__)p(s?)\b`), "http$1"},
+	{regexp.MustCompile(`(?i)\bfxp\b`), "ftp"},
+	{regexp.MustCompile(`\[://\]|\[:\]//`), "://"},
+	{regexp.MustCompile(`\[:\]`), ":"},
+	{regexp.MustCompile(`\[/\]`), "/"},
+	{regexp.MustCompile(`(?i)\[(?:\.|dot)\]|\((?:\.|dot)\)|\{(?:\.|dot)\}|\\\.`), "."},
+	{regexp.MustCompile(`(?i)\[(?:@|at)\]|\((?:@|at)\)|\{(?:@|at)\}`), "@"},
+}
+
+// refang normalises defanged indicators e.g. hxxp://evil[.]com so that the extractors can find them.
+// Returns the refanged text, along with each of the words that needed refanging.
+func refang(details string) (string, []string) {
+	var refanged []string
+
+	words := regexp.MustCompile(`\S+`)
+	details = words.ReplaceAllStringFunc(details, func(word string) string {
+		fanged := word
+		for _, r := range refangers {
+			fanged = r.re.ReplaceAllString(fanged, r.with)
+		}
+		if fanged != word {
+			refanged = append(refanged, fanged)
+		}
+		return fanged
+	})
+
+	return details, refanged
+}
+
+// markDefanged flags subjects found within a refanged word, so outputs know to defang them again
+func markDefanged(subjects []squyre.Subject, refanged []string) {
+	values := defangedValues(refanged)
+	for i, subject := range subjects {
+		if values[strings.ToLower(subject.Value)] {
+			subjects[i].Defanged = true
+		}
 	}
-	encodedUrl := splitUrl[1]
-	decodedUrl, err := url.PathUnescape(encodedUrl)
-	if err != nil {
-		log.Errorf("Could not parse ATP Safe Link!: %s", err)
-		return safeurl
+}
+
+// isValueSeparator reports whether a character separates the parts of a word that could be subjects, e.g. the
+// host in a URL, or the domain in an email address
+func isValueSeparator(c rune) bool {
+	return strings.ContainsRune("/@?#&=,;()[]{}<>\"'", c)
+}
+
+// defangedValues lists the values in refanged words that could be subjects. That's each whole word, less any
+// surrounding punctuation, along with each part of it e.g. evil.com in https://evil.com:443/payload.
+func defangedValues(refanged []string) map[string]bool {
+	values := make(map[string]bool)
+	for _, word := range refanged {
+		word = strings.ToLower(strings.Trim(word, ".,;:!?()[]{}<>\"'"))
+		values[word] = true
+
+		for _, part := range strings.FieldsFunc(word, isValueSeparator) {
+			part = strings.Trim(part, ".:")
+			values[part] = true
+			// Drop any port from a host, which IPv6 addresses have too many colons to be mistaken for
+			if strings.Count(part, ":") == 1 {
+				values[part[:strings.Index(part, ":")]] = true
+			}
+		}
 	}
+	return values
+}
+
+// hashTypes maps the length of a hex encoded file hash to its subject type
+var hashTypes = map[int]string{
+	32: "md5",
+	40: "sha1",
+	64: "sha256",
+}
+
+func extractHashes(details string) []squyre.Subject {
+	var subjectList []squyre.Subject
 
-	splitUrl = strings.Split(decodedUrl, "&")
+	// Match hex strings of exactly the length of an MD5, SHA1 or SHA256 hash.
+	// Word boundaries stop us matching fragments of longer hex strings.
+	re := regexp.MustCompile(`\b([a-fA-F0-9]{64}|[a-fA-F0-9]{40}|[a-fA-F0-9]{32})\b`)
 
-	if len(splitUrl) == 1 {
-		log.Error("Could not parse ATP Safe Link! Data missing.")
-		return safeurl
+	submatchall := re.FindAllString(details, -1)
+	for i, hash := range submatchall {
+		submatchall[i] = strings.ToLower(hash)
 	}
+	submatchall = removeDuplicateTrimmedStr(submatchall)
 
-	return splitUrl[0]
+	for _, hash := range submatchall {
+		var subject = squyre.Subject{
+			Type:  hashTypes[len(hash)],
+			Value: hash,
+		}
+		subjectList = append(subjectList, subject)
+	}
+	return subjectList
 }
 
 func convertSplunkAlert(alertBody string) squyre.Alert {
@@ -329,6 +531,44 @@ func convertSumoAlert(alertBody string) squyre.Alert {
 	return messageObject.Normaliser()
 }
 
+func convertEventBridgeAlert(alertBody string) squyre.Alert {
+	var messageObject squyre.EventBridgeAlert
+	json.Unmarshal([]byte(alertBody), &messageObject)
+
+	return messageObject.Normaliser()
+}
+
+func convertElasticAlert(alertBody string) squyre.Alert {
+	var messageObject squyre.ElasticAlert
+	json.Unmarshal([]byte(alertBody), &messageObject)
+
+	return messageObject.Normaliser()
+}
+
+// setupGenericMapping loads the generic alert mapping from the GENERIC_ALERT_MAP env var, which is a JSON object e.g.
+// {"id": "event.id", "name": "rule.title", "url": "event.link", "timestamp": "event.created", "message": "event.data"}
+func setupGenericMapping() {
+	genericMapping = &squyre.GenericAlertMapping{}
+
+	err := json.Unmarshal([]byte(GenericAlertMap), genericMapping)
+	if err != nil {
+		log.Errorf("Could not parse GENERIC_ALERT_MAP env var: %s", err)
+	}
+}
+
+func convertGenericAlert(alertBody string) squyre.Alert {
+	if genericMapping == nil {
+		setupGenericMapping()
+	}
+
+	messageObject := squyre.GenericAlert{
+		Payload: alertBody,
+		Mapping: *genericMapping,
+	}
+
+	return messageObject.Normaliser()
+}
+
 // BuildStateMachine builds a connection to the Step Function at the provided arn
 func BuildStateMachine(arn string) StateMachine {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
@@ -339,34 +579,99 @@ func BuildStateMachine(arn string) StateMachine {
 		FunctionArn: arn,
 	}
 }
-func sendAlertToSfn(alert squyre.Alert, sfnName string) error {
+
+// maxExecutionRetries limits how many times an alert whose enrichment failed is sent again. Retries are named
+// '<name>-r<n>', which keeps names within the 80 character limit.
+const maxExecutionRetries = 9
+
+// executionName names executions after the alert and the delivery it arrived in e.g. the SNS or SQS message ID, so
+// that a redelivery of the same message doesn't start a second execution, but sending the alert again does. Without
+// a delivery ID, the name is unique.
+func executionName(alertID string, deliveryID string) string {
+	invalid := regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+	prefix := invalid.ReplaceAllString(alertID, "-")
+	if len(prefix) > 60 {
+		prefix = prefix[:60]
+	}
+
+	if deliveryID == "" {
+		random := make([]byte, 16)
+		rand.Read(random)
+		deliveryID = hex.EncodeToString(random)
+	}
+	sum := sha256.Sum256([]byte(deliveryID))
+	return strings.TrimPrefix(prefix+"-"+hex.EncodeToString(sum[:])[:16], "-")
+}
+
+// startExecution starts an execution for the alert, unless one is already running or has succeeded. Names can't be
+// reused, so if an earlier execution failed, timed out or was aborted, the alert is sent again under a new name.
+func startExecution(stepFunction StateMachine, sfnArn string, name string, input string) (string, error) {
+	for retry := 0; retry <= maxExecutionRetries; retry++ {
+		attemptName := name
+		if retry > 0 {
+			attemptName = fmt.Sprintf("%s-r%d", name, retry)
+		}
+
+		result, err := stepFunction.Execute(attemptName, input)
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != sfn.ErrCodeExecutionAlreadyExists {
+			if err != nil {
+				return "", err
+			}
+			return aws.StringValue(result.ExecutionArn), nil
+		}
+
+		// We've already sent this exact alert, likely on an earlier attempt at this batch
+		execArn := strings.Replace(sfnArn, ":stateMachine:", ":execution:", 1) + ":" + attemptName
+		status, err := stepFunction.Status(execArn)
+		if err != nil {
+			return "", err
+		}
+		if status != "FAILED" && status != "TIMED_OUT" && status != "ABORTED" {
+			log.Infof("Alert already sent with execution %s, which is %s", execArn, status)
+			return execArn, nil
+		}
+		log.Infof("Earlier execution %s is %s, sending the alert again", execArn, status)
+	}
+	return "", fmt.Errorf("Enrichment has already failed %d times for this alert", maxExecutionRetries+1)
+}
+
+func sendAlertToSfn(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
 	// Convert alert to a Json string ready to pass to our AWS Step Function
 	alertJSON, _ := json.Marshal(alert)
 
 	// Find the Arn of the required step function
 	sfnArn, err := Stack.getStackResourceArn(sfnName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	stepFunction := BuildDestination(sfnArn)
-	result, err := stepFunction.Execute(string(alertJSON))
-
+	execArn, err := startExecution(stepFunction, sfnArn, executionName(alert.ID, deliveryID), string(alertJSON))
 	if err != nil {
-		return err
+		return "", err
+	}
+	log.Infof("Sent alert to %s with execution %s\n", sfnName, execArn)
+
+	// Failures will be reported to the output by the execution status callback instead
+	if strings.ToLower(AsyncMode) == "true" {
+		return execArn, nil
 	}
-	log.Infof("Started %s with execution %s\n", sfnName, aws.StringValue(result.ExecutionArn))
-	err = stepFunction.WaitForExecCompletion(result.ExecutionArn)
+	err = stepFunction.WaitForExecCompletion(aws.String(execArn))
 
-	return err
+	return execArn, err
 }
 
-func handleRequest(ctx context.Context, event map[string]interface{}) (string, error) {
+func handleRequest(ctx context.Context, event map[string]interface{}) (interface{}, error) {
 	eventStr, _ := json.Marshal(event)
 
 	var snsEvent events.SNSEvent
 	var apiEvent events.APIGatewayProxyRequest
-	var messages []string
-	if strings.Contains(string(eventStr), "\"EventSource\":\"aws:sns\"") {
+	var messages []inboundAlert
+	if strings.Contains(string(eventStr), "\"detail-type\":\""+executionStatusDetailType+"\"") {
+		log.Info("Detected execution status callback.")
+		var statusEvent events.CloudWatchEvent
+		json.Unmarshal(eventStr, &statusEvent)
+		return handleExecutionStatus(statusEvent)
+	} else if strings.Contains(string(eventStr), "\"EventSource\":\"aws:sns\"") {
 		log.Info("Detected SNS source.")
 		json.Unmarshal(eventStr, &snsEvent)
 		if len(snsEvent.Records) == 0 {
@@ -374,120 +679,194 @@ func handleRequest(ctx context.Context, event map[string]interface{}) (string, e
 		}
 		for _, record := range snsEvent.Records {
 			snsRecord := record.SNS
-			log.Infof("Processing message %s\n", snsRecord.MessageID)
-			messages = append(messages, snsRecord.Message)
+			messages = append(messages, inboundAlert{
+				MessageID: snsRecord.MessageID,
+				Body:      snsRecord.Message,
+				Source:    snsSource(snsRecord),
+			})
 		}
+	} else if strings.Contains(string(eventStr), "\"eventSource\":\"aws:sqs\"") {
+		log.Info("Detected SQS source.")
+		var sqsEvent events.SQSEvent
+		json.Unmarshal(eventStr, &sqsEvent)
+		for _, record := range sqsEvent.Records {
+			messages = append(messages, sqsAlert(record))
+		}
+		return sqsResponse(processAlerts(messages)), nil
+	} else if strings.Contains(string(eventStr), "\"detail-type\"") {
+		log.Info("Detected EventBridge source.")
+		var bridgeEvent events.CloudWatchEvent
+		json.Unmarshal(eventStr, &bridgeEvent)
+		messages = append(messages, eventBridgeAlert(bridgeEvent, string(eventStr)))
 	} else if strings.Contains(string(eventStr), "apiId") {
 		log.Info("Detected API GW source.")
 		json.Unmarshal(eventStr, &apiEvent)
-		messages = append(messages, apiEvent.Body)
+
+		body := apiEvent.Body
+		if apiEvent.IsBase64Encoded {
+			decoded, err := base64.StdEncoding.DecodeString(body)
+			if err == nil {
+				body = string(decoded)
+			}
+		}
+		inbound := inboundAlert{
+			MessageID: apiEvent.RequestContext.RequestID,
+			Body:      body,
+			Source:    apiSource(apiEvent),
+		}
+
+		err := verifySignature(apiEvent, inbound)
+		if err != nil {
+			log.Errorf("Rejected alert: %s", err)
+			return apiResponse(recordResult{
+				MessageID: inbound.MessageID,
+				Status:    "rejected",
+				Error:     err.Error(),
+				err:       err,
+			}), nil
+		}
+
+		report := processAlerts([]inboundAlert{inbound})
+		return apiResponse(report.Records[0]), nil
 	} else {
-		return "Aborted", errors.New("Invocation service not supported. Can only use SNS or API GW!")
+		return "Aborted", errors.New("Invocation service not supported. Can only use SNS, SQS, EventBridge or API GW!")
 	}
 
-	var scope []string
-	for _, message := range messages {
-		var alert squyre.Alert
-
-		if strings.Contains(message, "search_name") {
-			log.Info("Auto detected Splunk alert")
-			alert = convertSplunkAlert(message)
-		} else if strings.Contains(message, "integrationName") {
-			log.Info("Auto detected OpsGenie alert")
-			alert = convertOpsGenieAlert(message)
-		} else if strings.Contains(message, "Sumo Logic") {
-			log.Info("Auto detected Sumo Logic alert")
-			alert = convertSumoAlert(message)
-		} else {
-			return "", errors.New("Could not determine alert type")
+	report := processAlerts(messages)
+	if report.Failed > 0 {
+		// Have the whole event retried, alerts already sent will not be enriched again
+		return report, &BatchError{Report: report}
+	}
+	return report, nil
+}
+
+// processAlerts processes each alert independently, reporting the outcome for each
+func processAlerts(messages []inboundAlert) BatchReport {
+	var report BatchReport
+
+	for _, inbound := range messages {
+		log.Infof("Processing message %s\n", inbound.MessageID)
+
+		alert, execArn, err := processAlert(inbound)
+		record := recordResult{
+			MessageID: inbound.MessageID,
+			AlertID:   alert.ID,
+			Execution: execArn,
+			err:       err,
 		}
 
-		// IPV4
-		ipSubjects := extractIPs(alert.RawMessage)
-		if len(ipSubjects) == 0 {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Info("No public IP addresses found to process")
+		if rejection, ok := err.(*RejectionError); ok {
+			record.Status = "rejected"
+			record.Error = rejection.Message
+			report.Rejected++
+		} else if err != nil {
+			record.Status = "failed"
+			record.Error = err.Error()
+			record.Retryable = true
+			report.Failed++
 		} else {
-			for _, sub := range ipSubjects {
-				alert.Subjects = append(alert.Subjects, sub)
-			}
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Infof("Extracted %d public IP addresses from the alert message", len(ipSubjects))
-			scope = append(scope, "ipv4")
-		}
-
-		// Domains
-		domainSubjects := extractDomains(alert.RawMessage)
-		if len(domainSubjects) == 0 {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Info("No domains found to process")
-		} else {
-			for _, sub := range domainSubjects {
-				alert.Subjects = append(alert.Subjects, sub)
-			}
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Infof("Extracted %d domains from the alert message", len(domainSubjects))
-			scope = append(scope, "domain")
-		}
-
-		// Hosts
-		hostSubjects := extractHosts(alert.RawMessage)
-		if len(hostSubjects) == 0 {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Info("No hosts found to process")
-		} else {
-			for _, sub := range hostSubjects {
-				alert.Subjects = append(alert.Subjects, sub)
+			record.Status = "succeeded"
+			report.Succeeded++
+		}
+		report.Records = append(report.Records, record)
+	}
+
+	report.Summary = fmt.Sprintf("Processed %d messages: %d succeeded, %d rejected, %d failed.", len(messages), report.Succeeded, report.Rejected, report.Failed)
+	log.Info(report.Summary)
+
+	return report
+}
+
+// processAlert extracts subjects from an alert, then sends it to the state machine for enrichment
+func processAlert(inbound inboundAlert) (squyre.Alert, string, error) {
+	message := inbound.Body
+
+	alert, err := convertAlert(inbound)
+	if err != nil {
+		log.Errorf("Rejected alert: %s", err)
+		return alert, "", err
+	}
+
+	// Refang any defanged indicators e.g. 1.2.3[.]4 so they can be extracted
+	details, refanged := refang(alert.RawMessage)
+	if len(refanged) > 0 {
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Infof("Refanged %d defanged values in the alert message", len(refanged))
+	}
+
+	var scope []string
+	mode := extractionMode()
+	if mode != "fields" {
+		if Extractors == nil {
+			setupExtractors()
+		}
+
+		alert.Subjects, scope = Extractors.Extract(details)
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Infof("Extracted %d subjects from the alert message", len(alert.Subjects))
+	}
+
+	// Structured alert fields
+	if mode != "regex" {
+		fieldSubjects := extractFields(message, fieldMappings)
+		added := 0
+		for _, sub := range fieldSubjects {
+			// Already found by scanning the message, just record where it came from
+			if idx := subjectIndex(alert.Subjects, sub); idx >= 0 {
+				if alert.Subjects[idx].Field == "" {
+					alert.Subjects[idx].Field = sub.Field
+				}
+				continue
 			}
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Infof("Extracted %d hosts from the alert message", len(hostSubjects))
-			scope = append(scope, "hostname")
-		}
-
-		// Urls
-		urlSubjects := extractUrls(alert.RawMessage)
-		if len(urlSubjects) == 0 {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Info("No urls found to process")
-		} else {
-			for _, sub := range urlSubjects {
-				alert.Subjects = append(alert.Subjects, sub)
+			alert.Subjects = append(alert.Subjects, sub)
+			added++
+			if !containsStr(scope, sub.Type) {
+				scope = append(scope, sub.Type)
 			}
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Infof("Extracted %d urls from the alert message", len(urlSubjects))
-			scope = append(scope, "url")
 		}
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Infof("Extracted %d subjects from %d mapped alert fields, %d of them new", len(fieldSubjects), len(fieldMappings), added)
+	}
 
-		// Have finished adding the extracted subjects to our alert
-		if len(scope) == 0 {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Info("No subjects founds to process")
-			return "", errors.New("No subjects found to process")
-		}
-		alert.Scope = strings.Join(scope, ",")
+	// Remember which subjects were defanged, so outputs can defang them again
+	markDefanged(alert.Subjects, refanged)
 
-		err := SendAlert(alert, "EnrichStateMachine")
-		if err != nil {
-			log.WithFields(log.Fields{
-				"alert": alert.ID,
-			}).Error("Enrichment function failed")
-			return string(err.Error()), err
+	// Keep noisy alerts within our limits
+	alert.Subjects, alert.Truncated = limitSubjects(alert.Subjects, details)
+	if alert.Truncated > 0 {
+		scope = scopeOf(alert.Subjects, scope)
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Warnf("Left out %d subjects to keep within limits, enriching %d", alert.Truncated, len(alert.Subjects))
+	}
+
+	// Have finished adding the extracted subjects to our alert
+	if len(scope) == 0 {
+		log.WithFields(log.Fields{
+			"alert": alert.ID,
+		}).Info("No subjects founds to process")
+		return alert, "", &RejectionError{
+			Reason:  "no_subjects",
+			Message: "No subjects found to process",
 		}
+	}
+	alert.Scope = strings.Join(scope, ",")
+
+	execArn, err := SendAlert(alert, "EnrichStateMachine", inbound.MessageID)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"alert": alert.ID,
-		}).Infof("Successfully processed %d entries for alert %s!\n\n", len(alert.Subjects), alert.ID)
+		}).Error("Enrichment function failed")
+		return alert, execArn, err
 	}
+	log.WithFields(log.Fields{
+		"alert": alert.ID,
+	}).Infof("Successfully processed %d entries for alert %s!\n\n", len(alert.Subjects), alert.ID)
 
-	return fmt.Sprintf("Processed %d SNS messages.", len(snsEvent.Records)), nil
+	return alert, execArn, nil
 }
 
 func main() {
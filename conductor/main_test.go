@@ -12,6 +12,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
 	"github.com/fatih/structs"
 	"github.com/gyrospectre/squyre/pkg/squyre"
+	"strings"
 	"testing"
 )
 
@@ -60,8 +61,8 @@ func (m mockedSfnValue) StartExecution(*sfn.StartExecutionInput) (*sfn.StartExec
 	return &sfnresp, nil
 }
 
-func mockSendAlert(alert squyre.Alert, sfnName string) error {
-	return nil
+func mockSendAlert(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+	return "testExecArn", nil
 }
 
 func mockBuildDestination(arn string) StateMachine {
@@ -92,9 +93,10 @@ func TestHandlerSuccess(t *testing.T) {
 			EventSource: "aws:sns",
 		},
 	}
-	have, _ := handleRequest(Ctx, structs.Map(event))
+	report, _ := handleRequest(Ctx, structs.Map(event))
+	have := report.(BatchReport).Summary
 
-	want := "Processed 1 SNS messages."
+	want := "Processed 1 messages: 1 succeeded, 0 rejected, 0 failed."
 
 	if have != want {
 		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
@@ -125,7 +127,7 @@ func TestSendAlertSuccess(t *testing.T) {
 		RawMessage: "Testing",
 	}
 	FunctionResult = "SUCCEEDED"
-	err := sendAlertToSfn(alert, "testStepFunction")
+	_, err := sendAlertToSfn(alert, "testStepFunction", "test-message-id")
 
 	if err != nil {
 		fmt.Printf("Unexpected error %s", err)
@@ -155,7 +157,7 @@ func TestSendAlertFailed(t *testing.T) {
 		RawMessage: "Testing",
 	}
 	FunctionResult = "FAILED"
-	err := sendAlertToSfn(alert, "testStepFunction")
+	_, err := sendAlertToSfn(alert, "testStepFunction", "test-message-id")
 	if err == nil {
 		fmt.Print("Unexpected non error")
 	}
@@ -168,6 +170,43 @@ func TestSendAlertFailed(t *testing.T) {
 	}
 }
 
+func TestSendAlertAsync(t *testing.T) {
+	setup()
+	defer func() { AsyncMode = "" }()
+	BuildDestination = mockBuildDestination
+	AsyncMode = "true"
+
+	resp := cloudformation.ListStackResourcesOutput{
+		NextToken: aws.String(""),
+		StackResourceSummaries: []*cloudformation.StackResourceSummary{
+			{
+				LogicalResourceId:  aws.String("testStepFunction"),
+				PhysicalResourceId: aws.String("testStepFunctionArn"),
+			},
+		},
+	}
+
+	Stack = CloudformationStack{
+		Client:    mockedStackValue{Resp: resp},
+		StackName: "teststack",
+	}
+
+	alert := squyre.Alert{
+		RawMessage: "Testing",
+	}
+	// Would fail if we waited for the execution
+	FunctionResult = "FAILED"
+	have, err := sendAlertToSfn(alert, "testStepFunction", "test-message-id")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := "testExecArn"
+	if have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
+
 func TestSendAlertTimedOut(t *testing.T) {
 	setup()
 	BuildDestination = mockBuildDestination
@@ -191,7 +230,7 @@ func TestSendAlertTimedOut(t *testing.T) {
 		RawMessage: "Testing",
 	}
 	FunctionResult = "TIMED_OUT"
-	err := sendAlertToSfn(alert, "testStepFunction")
+	_, err := sendAlertToSfn(alert, "testStepFunction", "test-message-id")
 	if err == nil {
 		fmt.Print("Unexpected non error")
 	}
@@ -241,6 +280,36 @@ func TestIPExtraction(t *testing.T) {
 	}
 }
 
+func TestIPv6Extraction(t *testing.T) {
+	setup()
+	ip1 := "2001:4860:4860::8888"
+	ip2 := "2606:4700:4700:0:0:0:0:1111"
+	loopback := "::1"
+	linkLocal := "fe80::1ff:fe23:4567:890a"
+	ula := "fd12:3456:789a:1::1"
+	mapped := "::ffff:8.8.8.8"
+	notIP := "12:30:45"
+
+	message := ip1 + " src=" + ip2 + " [" + loopback + ", " + linkLocal + "] " + ula + " " + mapped + " at " + notIP + " {" + ip1 + "}"
+	subjects := extractIPv6s(message)
+
+	have := len(subjects)
+	want := 2
+	if have != want {
+		t.Fatalf("Unexpected number of IPv6s. \nHave: %d\nWant: %d\nGot: %v", have, want, subjects)
+	}
+
+	if subjects[0].Value != ip1 || subjects[0].Type != "ipv6" {
+		t.Fatalf("Unxpected first IP. \nHave: %s\nWant: %s", subjects[0].Value, ip1)
+	}
+
+	// Addresses are normalised to their compressed form
+	wantIP2 := "2606:4700:4700::1111"
+	if subjects[1].Value != wantIP2 {
+		t.Fatalf("Unxpected second IP. \nHave: %s\nWant: %s", subjects[1].Value, wantIP2)
+	}
+}
+
 func TestHostExtraction(t *testing.T) {
 	setup()
 	host1 := "ABC-12345"
@@ -276,7 +345,7 @@ func TestNoHostRegex(t *testing.T) {
 	want := 0
 
 	if have != want {
-		t.Fatalf("Unexpected behaviour when host regex missing.\n Got: %s", subjects)
+		t.Fatalf("Unexpected behaviour when host regex missing.\n Got: %v", subjects)
 	}
 }
 
@@ -289,7 +358,7 @@ func TestNoIgnoreDomain(t *testing.T) {
 	want := 1
 
 	if have != want {
-		t.Fatalf("Unexpected behaviour when ignore domain missing.\n Got: %s", subjects)
+		t.Fatalf("Unexpected behaviour when ignore domain missing.\n Got: %v", subjects)
 	}
 }
 
@@ -358,3 +427,225 @@ func TestMalformedATPUrl(t *testing.T) {
 		t.Fatalf("Unxpected third Url. \nHave: %s\nWant: %s", subjects[2].Value, wantUrl)
 	}
 }
+
+func TestHashExtraction(t *testing.T) {
+	setup()
+	md5 := "44d88612fea8a8f36de82e1278abb02f"
+	sha1 := "3395856CE81F2B7382DEE72602F798B642F14140"
+	sha256 := "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f"
+	tooLong := sha256 + "ab"
+
+	message := "md5=" + md5 + " {sha1: " + sha1 + "} " + sha256 + ", " + tooLong + " " + md5
+	subjects := extractHashes(message)
+
+	have := len(subjects)
+	want := 3
+	if have != want {
+		t.Fatalf("Unexpected number of hashes. \nHave: %d\nWant: %d\nGot: %v", have, want, subjects)
+	}
+
+	if subjects[0].Type != "md5" || subjects[0].Value != md5 {
+		t.Fatalf("Unxpected first hash. \nHave: %v\nWant: %s", subjects[0], md5)
+	}
+
+	// Hashes are normalised to lower case
+	if subjects[1].Type != "sha1" || subjects[1].Value != strings.ToLower(sha1) {
+		t.Fatalf("Unxpected second hash. \nHave: %v\nWant: %s", subjects[1], sha1)
+	}
+
+	if subjects[2].Type != "sha256" || subjects[2].Value != sha256 {
+		t.Fatalf("Unxpected third hash. \nHave: %v\nWant: %s", subjects[2], sha256)
+	}
+}
+
+func TestEmailExtraction(t *testing.T) {
+	setup()
+	IgnoreDomain = "corp.example"
+	setupIgnoredDomains()
+	defer resetIgnoredDomains()
+
+	sender := "Attacker@Evil-Domain.com"
+	recipient := "victim@corp.example"
+	subRecipient := "someone@mail.corp.example"
+	internal := "admin@host.local"
+
+	message := "from=" + sender + " to={" + recipient + ", " + subRecipient + "} cc " + internal + " " + sender
+	subjects := extractEmails(message)
+
+	have := len(subjects)
+	want := 1
+	if have != want {
+		t.Fatalf("Unexpected number of emails. \nHave: %d\nWant: %d\nGot: %v", have, want, subjects)
+	}
+
+	if subjects[0].Type != "email" || subjects[0].Value != strings.ToLower(sender) {
+		t.Fatalf("Unxpected email. \nHave: %v\nWant: %s", subjects[0], sender)
+	}
+}
+
+func TestRefang(t *testing.T) {
+	setup()
+
+	message := "Clicked hxxps://evil[.]com/payload from 1.2.3[.]4, sender bad[@]evil(.)com via hXXp[:]//203.0.113(dot)7 and 8.8.8.8"
+	have, refanged := refang(message)
+	want := "Clicked https://evil.com/payload from 1.2.3.4, sender bad@evil.com via http://203.0.113.7 and 8.8.8.8"
+
+	if have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if len(refanged) != 4 {
+		t.Fatalf("Unexpected number of refanged values. \nHave: %d\nWant: %d", len(refanged), 4)
+	}
+
+	subjects := extractIPs(have)
+	markDefanged(subjects, refanged)
+
+	if subjects[0].Value != "1.2.3.4" || !subjects[0].Defanged {
+		t.Fatalf("Expected 1.2.3.4 to be marked as defanged, got %v", subjects[0])
+	}
+
+	if subjects[1].Value != "8.8.8.8" || subjects[1].Defanged {
+		t.Fatalf("Expected 8.8.8.8 to not be marked as defanged, got %v", subjects[1])
+	}
+}
+
+func TestMarkDefanged(t *testing.T) {
+	_, refanged := refang("From 11.2.3[.]45 and hxxps://notevil[.]com.au/x via hxxp://203.0.113[.]7:8080/a, bad[@]phish[.]com.")
+
+	tests := map[string]bool{
+		"11.2.3.45":                 true,
+		"https://notevil.com.au/x":  true,
+		"notevil.com.au":            true,
+		"203.0.113.7":               true,
+		"bad@phish.com":             true,
+		"phish.com":                 true,
+		"1.2.3.4":                   false,
+		"evil.com":                  false,
+		"notevil.com":               false,
+		"3.0.113.7":                 false,
+		"http://203.0.113.7:8080/a": true,
+	}
+	for value, want := range tests {
+		subjects := []squyre.Subject{{Type: "test", Value: value}}
+		markDefanged(subjects, refanged)
+		if subjects[0].Defanged != want {
+			t.Errorf("Unexpected defanged flag for %s. \nHave: %t\nWant: %t", value, subjects[0].Defanged, want)
+		}
+	}
+}
+
+func TestHandlerFieldExtraction(t *testing.T) {
+	setup()
+	defer resetFieldMappings()
+
+	FieldMap = `[{"path": "result.src_ip", "type": "ipv4", "label": "source IP"}]`
+	ExtractionMode = "fields"
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"search_name\": \"Test Alert\", \"message\": \"user agent 1.2.3.4\", \"result\": {\"src_ip\": \"8.8.8.8\"}, \"correlation_id\": \"1234\"}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(sent.Subjects) != 1 || sent.Subjects[0].Value != "8.8.8.8" || sent.Subjects[0].Field != "source IP" {
+		t.Fatalf("Unexpected subjects: %v", sent.Subjects)
+	}
+
+	if sent.Scope != "ipv4" {
+		t.Fatalf("Unexpected scope. \nHave: %s\nWant: %s", sent.Scope, "ipv4")
+	}
+}
+
+func TestHandlerElasticAlert(t *testing.T) {
+	setup()
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"kibanaBaseUrl\": \"https://kibana.local\", \"rule\": {\"id\": \"rule-1\", \"name\": \"Test Rule\"}, \"alert\": {\"id\": \"1234\"}, \"context\": {\"alerts\": [{\"source\": {\"ip\": \"8.8.8.8\", \"port\": 51234}, \"destination\": {\"ip\": \"10.0.0.5\", \"port\": 443}, \"client\": {\"ip\": \"2001:4860:4860::8888\"}}]}}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if sent.Name != "Test Rule" || sent.ID != "1234" {
+		t.Fatalf("Unexpected alert: %v", sent)
+	}
+
+	// Addresses are found in the JSON documents, leaving out the private destination
+	var values []string
+	for _, subject := range sent.Subjects {
+		values = append(values, subject.Value)
+	}
+	want := "8.8.8.8,2001:4860:4860::8888"
+	if strings.Join(values, ",") != want {
+		t.Fatalf("Unexpected subjects. \nHave: %v\nWant: %v", values, want)
+	}
+}
+
+func TestHandlerGenericAlert(t *testing.T) {
+	setup()
+	defer func() {
+		GenericAlertMap = ""
+		genericMapping = nil
+	}()
+
+	GenericAlertMap = `{"id": "event.id", "name": "rule.title", "message": "event.summary"}`
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   "{\"rule\": {\"title\": \"Test Rule\"}, \"event\": {\"id\": \"1234\", \"summary\": \"Connection from 8.8.8.8 blocked\"}}",
+				MessageID: "test-message-id",
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	_, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if sent.Name != "Test Rule" || sent.ID != "1234" {
+		t.Fatalf("Unexpected alert: %v", sent)
+	}
+
+	if len(sent.Subjects) != 1 || sent.Subjects[0].Value != "8.8.8.8" {
+		t.Fatalf("Unexpected subjects: %v", sent.Subjects)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// recordResult reports the outcome of processing a single alert
+type recordResult struct {
+	MessageID string `json:"messageId,omitempty"`
+	AlertID   string `json:"alertId,omitempty"`
+	Status    string `json:"status"` // One of succeeded, rejected or failed
+	Execution string `json:"execution,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Retryable bool   `json:"retryable"` // Whether trying again might succeed
+
+	err error
+}
+
+// BatchReport summarises the outcome of processing each alert in an invocation
+type BatchReport struct {
+	Summary   string         `json:"summary"`
+	Succeeded int            `json:"succeeded"`
+	Rejected  int            `json:"rejected"`
+	Failed    int            `json:"failed"`
+	Records   []recordResult `json:"records"`
+}
+
+// BatchError is returned when some alerts failed for reasons worth retrying, so that the invocation is retried
+type BatchError struct {
+	Report BatchReport
+}
+
+func (e *BatchError) Error() string {
+	encoded, _ := json.Marshal(e.Report)
+	return string(encoded)
+}
+
+// sqsResponse tells SQS which messages to return to the queue, so they can be retried or sent to a dead letter queue.
+// Rejected alerts are included too, so they can be replayed from the dead letter queue once the cause is fixed.
+func sqsResponse(report BatchReport) events.SQSEventResponse {
+	response := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{},
+	}
+	for _, record := range report.Records {
+		if record.Status != "succeeded" {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: record.MessageID,
+			})
+		}
+	}
+	return response
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/fatih/structs"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+func snsBatch(messages ...string) map[string]interface{} {
+	event := events.SNSEvent{}
+	for i, message := range messages {
+		event.Records = append(event.Records, events.SNSEventRecord{
+			SNS: events.SNSEntity{
+				Message:   message,
+				MessageID: string(rune('a' + i)),
+			},
+			EventSource: "aws:sns",
+		})
+	}
+	return structs.Map(event)
+}
+
+func TestHandlerPartialBatch(t *testing.T) {
+	setup()
+
+	var sent []squyre.Alert
+	var deliveries []string
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = append(sent, alert)
+		deliveries = append(deliveries, deliveryID)
+		return "testExecArn", nil
+	}
+
+	have, err := handleRequest(Ctx, snsBatch(
+		"{\"search_name\": \"Test Alert\", \"message\": \"hi 8.8.8.8\", \"correlation_id\": \"1\"}",
+		"{\"what\": \"is this\"}",
+		"{\"search_name\": \"Test Alert\", \"message\": \"nothing to see\", \"correlation_id\": \"3\"}",
+		"{\"search_name\": \"Test Alert\", \"message\": \"see https://example.com/x\", \"correlation_id\": \"4\"}",
+	))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	report := have.(BatchReport)
+	if report.Succeeded != 2 || report.Rejected != 2 || report.Failed != 0 {
+		t.Fatalf("Unexpected report: %v", report)
+	}
+
+	statuses := []string{"succeeded", "rejected", "rejected", "succeeded"}
+	for i, status := range statuses {
+		if report.Records[i].Status != status || report.Records[i].MessageID != string(rune('a'+i)) {
+			t.Fatalf("Unexpected record %d. \nHave: %v\nWant: %s", i, report.Records[i], status)
+		}
+	}
+
+	// Scope should not leak from one alert to the next
+	if len(sent) != 2 || sent[0].Scope != "ipv4" || sent[1].Scope != "domain,url" {
+		t.Fatalf("Unexpected alerts sent: %v", sent)
+	}
+
+	// Executions are named after the message each alert arrived in
+	if len(deliveries) != 2 || deliveries[0] != "a" || deliveries[1] != "d" {
+		t.Fatalf("Unexpected delivery IDs: %v", deliveries)
+	}
+}
+
+func TestHandlerRetryableFailure(t *testing.T) {
+	setup()
+
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		if alert.ID == "2" {
+			return "", errors.New("Throttled")
+		}
+		return "testExecArn", nil
+	}
+
+	have, err := handleRequest(Ctx, snsBatch(
+		"{\"search_name\": \"Test Alert\", \"message\": \"hi 8.8.8.8\", \"correlation_id\": \"1\"}",
+		"{\"search_name\": \"Test Alert\", \"message\": \"hi 9.9.9.9\", \"correlation_id\": \"2\"}",
+	))
+
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("Expected a batch error, got %v", err)
+	}
+
+	report := have.(BatchReport)
+	if batchErr.Report.Failed != 1 || report.Succeeded != 1 {
+		t.Fatalf("Unexpected report: %v", report)
+	}
+
+	if !report.Records[1].Retryable || report.Records[1].Error != "Throttled" || report.Records[0].Retryable {
+		t.Fatalf("Unexpected records: %v", report.Records)
+	}
+}
+
+func TestExecutionName(t *testing.T) {
+	first := executionName("abc 123/x", "message-1")
+	redelivered := executionName("abc 123/x", "message-1")
+	resent := executionName("abc 123/x", "message-2")
+
+	if first != redelivered || first == resent {
+		t.Fatalf("Expected stable names per delivery, got %s, %s and %s", first, redelivered, resent)
+	}
+
+	// Without a delivery to go by, every name is different
+	if executionName("abc 123/x", "") == executionName("abc 123/x", "") {
+		t.Fatal("Expected unique names without a delivery ID")
+	}
+
+	want := "abc-123-x-"
+	if first[:len(want)] != want || len(first) != len(want)+16 {
+		t.Fatalf("Unexpected name. \nHave: %s\nWant: %s<hash>", first, want)
+	}
+}
+
+type mockedDuplicateSfn struct {
+	mockedSfnValue
+}
+
+func (m mockedDuplicateSfn) StartExecution(*sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	return nil, awserr.New(sfn.ErrCodeExecutionAlreadyExists, "Execution Already Exists", nil)
+}
+
+func TestSendAlertDuplicate(t *testing.T) {
+	setup()
+	defer func() { AsyncMode = "" }()
+	AsyncMode = "true"
+
+	BuildDestination = func(arn string) StateMachine {
+		return StateMachine{
+			Client:      mockedDuplicateSfn{},
+			FunctionArn: arn,
+		}
+	}
+
+	resp := cloudformation.ListStackResourcesOutput{
+		NextToken: aws.String(""),
+		StackResourceSummaries: []*cloudformation.StackResourceSummary{
+			{
+				LogicalResourceId:  aws.String("testStepFunction"),
+				PhysicalResourceId: aws.String("arn:aws:states:us-east-1:123:stateMachine:test"),
+			},
+		},
+	}
+	Stack = CloudformationStack{
+		Client:    mockedStackValue{Resp: resp},
+		StackName: "teststack",
+	}
+
+	have, err := sendAlertToSfn(squyre.Alert{ID: "1234"}, "testStepFunction", "test-message-id")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := "arn:aws:states:us-east-1:123:execution:test:1234-"
+	if have[:len(want)] != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s<hash>", have, want)
+	}
+}
+
+// mockedExistingSfn has executions with the given statuses, by name
+type mockedExistingSfn struct {
+	mockedSfnValue
+	Statuses map[string]string
+	Started  *[]string
+}
+
+func (m mockedExistingSfn) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	if _, ok := m.Statuses[*input.Name]; ok {
+		return nil, awserr.New(sfn.ErrCodeExecutionAlreadyExists, "Execution Already Exists", nil)
+	}
+	*m.Started = append(*m.Started, *input.Name)
+	return &sfn.StartExecutionOutput{ExecutionArn: aws.String("new:" + *input.Name)}, nil
+}
+
+func (m mockedExistingSfn) DescribeExecution(input *sfn.DescribeExecutionInput) (*sfn.DescribeExecutionOutput, error) {
+	name := (*input.ExecutionArn)[strings.LastIndex(*input.ExecutionArn, ":")+1:]
+	return &sfn.DescribeExecutionOutput{Status: aws.String(m.Statuses[name])}, nil
+}
+
+func TestStartExecutionRetriesFailed(t *testing.T) {
+	sfnArn := "arn:aws:states:us-east-1:123:stateMachine:test"
+
+	tests := []struct {
+		statuses map[string]string
+		want     string
+		started  string
+	}{
+		// Running or finished executions aren't repeated
+		{map[string]string{"a": "RUNNING"}, "arn:aws:states:us-east-1:123:execution:test:a", ""},
+		{map[string]string{"a": "SUCCEEDED"}, "arn:aws:states:us-east-1:123:execution:test:a", ""},
+		// Failed ones are, under a new name
+		{map[string]string{"a": "FAILED"}, "new:a-r1", "a-r1"},
+		{map[string]string{"a": "TIMED_OUT", "a-r1": "ABORTED"}, "new:a-r2", "a-r2"},
+		{map[string]string{"a": "FAILED", "a-r1": "RUNNING"}, "arn:aws:states:us-east-1:123:execution:test:a-r1", ""},
+	}
+	for _, test := range tests {
+		var started []string
+		stepFunction := StateMachine{Client: mockedExistingSfn{Statuses: test.statuses, Started: &started}, FunctionArn: sfnArn}
+
+		have, err := startExecution(stepFunction, sfnArn, "a", "{}")
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if have != test.want || strings.Join(started, ",") != test.started {
+			t.Errorf("Unexpected output for %v. \nHave: %s (started %v)\nWant: %s (started %s)", test.statuses, have, started, test.want, test.started)
+		}
+	}
+
+	// Eventually we give up
+	statuses := map[string]string{"a": "FAILED"}
+	for retry := 1; retry <= maxExecutionRetries; retry++ {
+		statuses[fmt.Sprintf("a-r%d", retry)] = "FAILED"
+	}
+	var started []string
+	stepFunction := StateMachine{Client: mockedExistingSfn{Statuses: statuses, Started: &started}, FunctionArn: sfnArn}
+	if _, err := startExecution(stepFunction, sfnArn, "a", "{}"); err == nil || len(started) != 0 {
+		t.Errorf("Expected an error after %d retries, got %v", maxExecutionRetries, err)
+	}
+}
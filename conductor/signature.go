@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	signatureHeader       = "X-Squyre-Signature"
+	timestampHeader       = "X-Squyre-Timestamp"
+	webhookSecretLocation = "SquyreWebhook-"
+	defaultTolerance      = 300
+)
+
+var (
+	// FetchSecret abstracts the squyre.FetchSecret function to allow for testing. Secrets are cached by the provider.
+	FetchSecret = squyre.FetchSecret
+	// now abstracts time.Now to allow for testing
+	now = time.Now
+)
+
+// requiresSignature decides whether alerts from a source must be signed, based on the SIGNED_SOURCES env var
+func requiresSignature(source string) bool {
+	for _, signed := range strings.Split(SignedSources, ",") {
+		signed = normaliseSourceName(strings.TrimSpace(signed))
+		if signed == "*" || signed == source {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValue finds a header regardless of case, as API GW passes them on as sent
+func headerValue(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	for key, values := range request.MultiValueHeaders {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// webhookSecret fetches the shared secret for a source from the secret provider. The secret can be a plain
+// string, or JSON with the value in a 'secret' key.
+func webhookSecret(source string) ([]byte, error) {
+	value, err := FetchSecret(webhookSecretLocation + source)
+	if err != nil {
+		log.Errorf("Failed to fetch webhook secret for %s: %s", source, err)
+		return nil, err
+	}
+
+	var wrapped struct {
+		Secret string `json:"secret"`
+	}
+	if json.Unmarshal([]byte(value), &wrapped) == nil && wrapped.Secret != "" {
+		value = wrapped.Secret
+	}
+	if value == "" {
+		return nil, fmt.Errorf("Webhook secret for %s is empty", source)
+	}
+
+	return []byte(value), nil
+}
+
+// signBody calculates the signature for an alert body sent at the given unix time
+func signBody(secret []byte, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func signatureRejection(reason string, message string, source string) *RejectionError {
+	return &RejectionError{
+		Reason:  reason,
+		Message: message,
+		Source:  source,
+		status:  401,
+	}
+}
+
+// verifySignature checks that an alert from a source requiring signatures was signed with its shared secret,
+// recently enough that it isn't being replayed
+func verifySignature(request events.APIGatewayProxyRequest, inbound inboundAlert) error {
+	if SignedSources == "" {
+		return nil
+	}
+
+	// Alerts we can't identify will be rejected anyway
+	source, err := resolveSource(inbound)
+	if err != nil || !requiresSignature(source.Name) {
+		return nil
+	}
+
+	signature := headerValue(request, signatureHeader)
+	timestamp := headerValue(request, timestampHeader)
+	if signature == "" || timestamp == "" {
+		return signatureRejection("missing_signature", fmt.Sprintf("Alerts from %s must be signed", source.Name), source.Name)
+	}
+
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return signatureRejection("invalid_timestamp", "Timestamp must be in seconds since the epoch", source.Name)
+	}
+
+	tolerance := int64(defaultTolerance)
+	if SignatureTolerance != "" {
+		if configured, err := strconv.ParseInt(SignatureTolerance, 10, 64); err == nil {
+			tolerance = configured
+		}
+	}
+	age := now().Unix() - sent
+	if age > tolerance || age < -tolerance {
+		return signatureRejection("stale_timestamp", fmt.Sprintf("Timestamp is more than %d seconds from now", tolerance), source.Name)
+	}
+
+	secret, err := webhookSecret(source.Name)
+	if err != nil {
+		return err
+	}
+
+	expected := signBody(secret, timestamp, inbound.Body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return signatureRejection("invalid_signature", "Signature does not match", source.Name)
+	}
+
+	log.Infof("Verified signature for %s alert", source.Name)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+const testAlertBody = `{"search_name": "Test Alert", "message": "hi 8.8.8.8", "correlation_id": "1234"}`
+
+func setupSignatures(secret string) {
+	SignedSources = "splunk"
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	FetchSecret = func(location string) (string, error) {
+		return secret, nil
+	}
+}
+
+func resetSignatures() {
+	SignedSources = ""
+	SignatureTolerance = ""
+	now = time.Now
+	FetchSecret = squyre.FetchSecret
+}
+
+func signedRequest(path string, headers map[string]string) map[string]interface{} {
+	request := map[string]interface{}{
+		"path":           path,
+		"httpMethod":     "POST",
+		"body":           testAlertBody,
+		"headers":        headers,
+		"requestContext": map[string]interface{}{"apiId": "abc123", "requestId": "req-1"},
+	}
+	encoded, _ := json.Marshal(request)
+
+	var event map[string]interface{}
+	json.Unmarshal(encoded, &event)
+	return event
+}
+
+func TestHandlerSignatures(t *testing.T) {
+	setup()
+	defer resetSignatures()
+	setupSignatures(`{"secret": "s3cret"}`)
+	SendAlert = mockSendAlert
+
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	stale := strconv.FormatInt(now().Add(-10*time.Minute).Unix(), 10)
+	valid := signBody([]byte("s3cret"), timestamp, testAlertBody)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		reason  string
+	}{
+		{"valid", "/alert/splunk", map[string]string{"x-squyre-signature": valid, "X-Squyre-Timestamp": timestamp}, 200, ""},
+		{"sniffed", "/alert", map[string]string{"X-Squyre-Signature": valid, "X-Squyre-Timestamp": timestamp}, 200, ""},
+		{"missing", "/alert/splunk", map[string]string{}, 401, "missing_signature"},
+		{"wrong", "/alert/splunk", map[string]string{"X-Squyre-Signature": signBody([]byte("guess"), timestamp, testAlertBody), "X-Squyre-Timestamp": timestamp}, 401, "invalid_signature"},
+		{"stale", "/alert/splunk", map[string]string{"X-Squyre-Signature": signBody([]byte("s3cret"), stale, testAlertBody), "X-Squyre-Timestamp": stale}, 401, "stale_timestamp"},
+		{"garbled", "/alert/splunk", map[string]string{"X-Squyre-Signature": valid, "X-Squyre-Timestamp": "yesterday"}, 401, "invalid_timestamp"},
+	}
+
+	for _, test := range tests {
+		have, err := handleRequest(Ctx, signedRequest(test.path, test.headers))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.name, err)
+		}
+
+		response := have.(events.APIGatewayProxyResponse)
+		if response.StatusCode != test.status {
+			t.Fatalf("%s: unexpected status. \nHave: %d\nWant: %d\nBody: %s", test.name, response.StatusCode, test.status, response.Body)
+		}
+
+		var rejection RejectionError
+		json.Unmarshal([]byte(response.Body), &rejection)
+		if rejection.Reason != test.reason {
+			t.Fatalf("%s: unexpected reason. \nHave: %s\nWant: %s", test.name, rejection.Reason, test.reason)
+		}
+	}
+}
+
+func TestHandlerUnsignedSource(t *testing.T) {
+	setup()
+	defer resetSignatures()
+	setupSignatures("s3cret")
+	SignedSources = "opsgenie, Sumo Logic"
+	SendAlert = mockSendAlert
+
+	have, err := handleRequest(Ctx, signedRequest("/alert/splunk", map[string]string{}))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	response := have.(events.APIGatewayProxyResponse)
+	if response.StatusCode != 200 {
+		t.Fatalf("Unexpected status. \nHave: %d\nWant: %d", response.StatusCode, 200)
+	}
+}
+
+func TestRequiresSignature(t *testing.T) {
+	defer resetSignatures()
+
+	SignedSources = "*"
+	if !requiresSignature("elastic") {
+		t.Fatal("Expected all sources to require signatures")
+	}
+
+	SignedSources = "Sumo Logic,splunk"
+	if !requiresSignature("sumologic") || requiresSignature("elastic") {
+		t.Fatal("Unexpected sources requiring signatures")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+	log "github.com/sirupsen/logrus"
+)
+
+// alertSource describes an alert format we know how to convert to our standard form
+type alertSource struct {
+	Name        string                    // Used to select the source explicitly e.g. /alert/splunk
+	Marker      string                    // Top level field identifying the source, when it isn't selected explicitly
+	MarkerValue string                    // The value the marker field must have, if any
+	Convert     func(string) squyre.Alert // Converts the alert body to our standard form
+}
+
+// alertSources lists the supported alert formats, in the order they are sniffed
+var alertSources = []alertSource{
+	{Name: "splunk", Marker: "search_name", Convert: convertSplunkAlert},
+	{Name: "opsgenie", Marker: "integrationName", Convert: convertOpsGenieAlert},
+	{Name: "sumologic", Marker: "client", MarkerValue: "Sumo Logic", Convert: convertSumoAlert},
+	{Name: "elastic", Marker: "kibanaBaseUrl", Convert: convertElasticAlert},
+	{Name: "eventbridge", Convert: convertEventBridgeAlert},
+	{Name: "generic", Convert: convertGenericAlert},
+}
+
+// inboundAlert is an alert body received by the conductor, along with any source named by the sender
+type inboundAlert struct {
+	MessageID string
+	Body      string
+	Source    string
+}
+
+// RejectionError explains why an alert could not be accepted
+type RejectionError struct {
+	Reason    string   `json:"reason"` // Machine readable reason e.g. 'unknown_source'
+	Message   string   `json:"message"`
+	Source    string   `json:"source,omitempty"`
+	Supported []string `json:"supported,omitempty"`
+
+	status int // The HTTP status to return to API GW callers, if not 400
+}
+
+func (e *RejectionError) Error() string {
+	encoded, _ := json.Marshal(e)
+	return string(encoded)
+}
+
+func supportedSources() []string {
+	var names []string
+	for _, source := range alertSources {
+		names = append(names, source.Name)
+	}
+	return names
+}
+
+// normaliseSourceName allows sources to be named loosely e.g. 'Sumo Logic', 'sumo-logic' or 'sumologic'
+func normaliseSourceName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.ReplaceAll(name, " ", "")
+	name = strings.ReplaceAll(name, "-", "")
+	return strings.ReplaceAll(name, "_", "")
+}
+
+// resolveSource finds the source of an inbound alert, using the source named by the sender, otherwise sniffing its content
+func resolveSource(inbound inboundAlert) (alertSource, error) {
+	if inbound.Source != "" {
+		name := normaliseSourceName(inbound.Source)
+		for _, source := range alertSources {
+			if source.Name == name {
+				log.Infof("Using %s alert source, as requested", source.Name)
+				return source, nil
+			}
+		}
+		return alertSource{}, &RejectionError{
+			Reason:    "unknown_source",
+			Message:   fmt.Sprintf("Alert source '%s' is not supported", inbound.Source),
+			Source:    inbound.Source,
+			Supported: supportedSources(),
+		}
+	}
+
+	// Only look at top level fields, so a marker mentioned in the alert's content isn't mistaken for its source
+	var fields map[string]json.RawMessage
+	json.Unmarshal([]byte(inbound.Body), &fields)
+	for _, source := range alertSources {
+		if source.matches(fields) {
+			log.Infof("Auto detected %s alert", source.Name)
+			return source, nil
+		}
+	}
+
+	if GenericAlertMap != "" {
+		log.Info("Using generic webhook alert mapping")
+		return alertSource{Name: "generic", Convert: convertGenericAlert}, nil
+	}
+
+	return alertSource{}, &RejectionError{
+		Reason:    "unknown_format",
+		Message:   "Could not determine alert type. Name the source in the request path, 'source' query parameter or 'source' SNS message attribute",
+		Supported: supportedSources(),
+	}
+}
+
+// matches checks if an alert's top level fields have the source's marker
+func (source alertSource) matches(fields map[string]json.RawMessage) bool {
+	if source.Marker == "" {
+		return false
+	}
+	raw, ok := fields[source.Marker]
+	if !ok {
+		return false
+	}
+	if source.MarkerValue == "" {
+		return true
+	}
+	var value string
+	return json.Unmarshal(raw, &value) == nil && value == source.MarkerValue
+}
+
+// convertAlert converts an inbound alert to our standard form
+func convertAlert(inbound inboundAlert) (squyre.Alert, error) {
+	source, err := resolveSource(inbound)
+	if err != nil {
+		return squyre.Alert{}, err
+	}
+	return source.Convert(inbound.Body), nil
+}
+
+// apiSource finds the source named in an API GW request, either by path e.g. /alert/splunk or query parameter
+func apiSource(request events.APIGatewayProxyRequest) string {
+	if source := request.PathParameters["source"]; source != "" {
+		return source
+	}
+	if idx := strings.Index(request.Path, "/alert/"); idx >= 0 {
+		if source := strings.Trim(request.Path[idx+len("/alert/"):], "/"); source != "" {
+			return source
+		}
+	}
+	return request.QueryStringParameters["source"]
+}
+
+// snsSource finds the source named in the 'source' attribute of an SNS message
+func snsSource(entity events.SNSEntity) string {
+	attribute, ok := entity.MessageAttributes["source"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	value, _ := attribute["Value"].(string)
+	return value
+}
+
+// snsNotification is the envelope SNS wraps messages in, when delivering to SQS without raw message delivery
+type snsNotification struct {
+	Type              string `json:"Type"`
+	Message           string `json:"Message"`
+	MessageAttributes map[string]struct {
+		Type  string `json:"Type"`
+		Value string `json:"Value"`
+	} `json:"MessageAttributes"`
+}
+
+// sqsAlert finds the alert in an SQS message, unwrapping it if it was forwarded from SNS. The source can be named
+// in a 'source' attribute on either message.
+func sqsAlert(message events.SQSMessage) inboundAlert {
+	inbound := inboundAlert{
+		MessageID: message.MessageId,
+		Body:      message.Body,
+	}
+	if attribute, ok := message.MessageAttributes["source"]; ok && attribute.StringValue != nil {
+		inbound.Source = *attribute.StringValue
+	}
+
+	var notification snsNotification
+	if json.Unmarshal([]byte(message.Body), &notification) == nil && notification.Type == "Notification" {
+		inbound.Body = notification.Message
+		if attribute, ok := notification.MessageAttributes["source"]; ok && inbound.Source == "" {
+			inbound.Source = attribute.Value
+		}
+	}
+	return inbound
+}
+
+// eventBridgeAlert finds the alert in an EventBridge event. Events from sources named 'squyre.<alert source>'
+// carry an alert from that source as their detail, anything else is handled as an event in its own right.
+func eventBridgeAlert(event events.CloudWatchEvent, body string) inboundAlert {
+	if strings.HasPrefix(event.Source, "squyre.") {
+		return inboundAlert{
+			MessageID: event.ID,
+			Body:      string(event.Detail),
+			Source:    strings.TrimPrefix(event.Source, "squyre."),
+		}
+	}
+	return inboundAlert{
+		MessageID: event.ID,
+		Body:      body,
+		Source:    "eventbridge",
+	}
+}
+
+// apiResult is returned to API GW callers when their alert is accepted
+type apiResult struct {
+	Message    string   `json:"message"`
+	Executions []string `json:"executions,omitempty"` // The step function executions enriching the alert
+}
+
+// apiResponse converts the outcome of processing an API GW request into a response for the caller
+func apiResponse(record recordResult) events.APIGatewayProxyResponse {
+	status := 200
+	body, _ := json.Marshal(apiResult{
+		Message:    "Alert accepted for enrichment.",
+		Executions: []string{record.Execution},
+	})
+
+	if rejection, ok := record.err.(*RejectionError); ok {
+		status = 400
+		if rejection.status != 0 {
+			status = rejection.status
+		}
+		body, _ = json.Marshal(rejection)
+	} else if record.err != nil {
+		status = 500
+		body, _ = json.Marshal(map[string]string{"message": record.Error})
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fatih/structs"
+	"github.com/gyrospectre/squyre/pkg/squyre"
+)
+
+func TestConvertAlertExplicitSource(t *testing.T) {
+	body := `{"client": "Sumo Logic", "name": "Test Alert", "id": "1234", "results": "search_name was 8.8.8.8"}`
+
+	alert, err := convertAlert(inboundAlert{Body: body, Source: "Sumo Logic"})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if alert.ID != "1234" || alert.Name != "Test Alert" {
+		t.Fatalf("Unexpected alert: %v", alert)
+	}
+}
+
+// tests sources are sniffed from top level fields, not markers mentioned in the alert's content
+func TestConvertAlertSniffedSource(t *testing.T) {
+	tests := map[string]string{
+		// A Sumo alert that mentions a Splunk field
+		"sumologic": `{"client": "Sumo Logic", "name": "Test Alert", "id": "1234", "results": "search_name was 8.8.8.8"}`,
+		// A Splunk alert that mentions Sumo Logic and an Elastic field
+		"splunk": `{"search_name": "Test Alert", "result": {"note": "Sumo Logic kibanaBaseUrl"}}`,
+	}
+	for want, body := range tests {
+		source, err := resolveSource(inboundAlert{Body: body})
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if source.Name != want {
+			t.Errorf("Unexpected source. \nHave: %s\nWant: %s", source.Name, want)
+		}
+	}
+
+	// Markers in values alone aren't enough
+	_, err := resolveSource(inboundAlert{Body: `{"message": "search_name integrationName Sumo Logic"}`})
+	if rejection, ok := err.(*RejectionError); !ok || rejection.Reason != "unknown_format" {
+		t.Fatalf("Expected an unknown format rejection, got %v", err)
+	}
+}
+
+func TestConvertAlertRejections(t *testing.T) {
+	tests := map[string]inboundAlert{
+		"unknown_source": {Body: `{"search_name": "Test"}`, Source: "nagios"},
+		"unknown_format": {Body: `{"what": "is this"}`},
+	}
+
+	for reason, inbound := range tests {
+		_, err := convertAlert(inbound)
+		rejection, ok := err.(*RejectionError)
+		if !ok {
+			t.Fatalf("Expected a rejection, got %v", err)
+		}
+		if rejection.Reason != reason || len(rejection.Supported) != len(alertSources) {
+			t.Fatalf("Unexpected rejection. \nHave: %s\nWant: %s", rejection, reason)
+		}
+	}
+}
+
+func TestApiSource(t *testing.T) {
+	tests := map[string]events.APIGatewayProxyRequest{
+		"splunk":   {Path: "/alert/splunk"},
+		"elastic":  {Path: "/squyre/alert/elastic/", PathParameters: map[string]string{}},
+		"opsgenie": {Path: "/alert", PathParameters: map[string]string{"source": "opsgenie"}},
+		"sumo":     {Path: "/alert", QueryStringParameters: map[string]string{"source": "sumo"}},
+		"":         {Path: "/alert"},
+	}
+
+	for want, request := range tests {
+		have := apiSource(request)
+		if have != want {
+			t.Fatalf("Unexpected source. \nHave: %s\nWant: %s", have, want)
+		}
+	}
+}
+
+func TestSnsSource(t *testing.T) {
+	event := events.SNSEvent{}
+	event.Records = []events.SNSEventRecord{
+		{
+			SNS: events.SNSEntity{
+				Message:   `{"search_name": "Test Alert", "message": "hi 8.8.8.8", "correlation_id": "1234"}`,
+				MessageID: "test-message-id",
+				MessageAttributes: map[string]interface{}{
+					"source": map[string]interface{}{"Type": "String", "Value": "nagios"},
+				},
+			},
+			EventSource: "aws:sns",
+		},
+	}
+	have, err := handleRequest(Ctx, structs.Map(event))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	record := have.(BatchReport).Records[0]
+	rejection, ok := record.err.(*RejectionError)
+	if record.Status != "rejected" || record.Retryable || !ok || rejection.Source != "nagios" {
+		t.Fatalf("Expected a rejection for source nagios, got %v", record)
+	}
+}
+
+func TestHandlerApiRejection(t *testing.T) {
+	setup()
+
+	var event map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"path": "/alert/nagios",
+		"httpMethod": "POST",
+		"body": "{\"search_name\": \"Test\"}",
+		"requestContext": {"apiId": "abc123"}
+	}`), &event)
+
+	have, err := handleRequest(Ctx, event)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	response, ok := have.(events.APIGatewayProxyResponse)
+	if !ok {
+		t.Fatalf("Expected an API GW response, got %v", have)
+	}
+	if response.StatusCode != 400 {
+		t.Fatalf("Unexpected status. \nHave: %d\nWant: %d", response.StatusCode, 400)
+	}
+
+	var rejection RejectionError
+	json.Unmarshal([]byte(response.Body), &rejection)
+	if rejection.Reason != "unknown_source" || rejection.Source != "nagios" {
+		t.Fatalf("Unexpected rejection body: %s", response.Body)
+	}
+}
+
+func TestHandlerSQSBatch(t *testing.T) {
+	setup()
+
+	var sent []squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = append(sent, alert)
+		return "testExecArn", nil
+	}
+
+	var event map[string]interface{}
+	json.Unmarshal([]byte(`{"Records": [
+		{"messageId": "1", "eventSource": "aws:sqs", "body": "{\"search_name\": \"Test\", \"message\": \"hi 8.8.8.8\", \"correlation_id\": \"1\"}"},
+		{"messageId": "2", "eventSource": "aws:sqs", "body": "{\"what\": \"is this\"}"},
+		{"messageId": "3", "eventSource": "aws:sqs", "body": "{\"Type\": \"Notification\", \"Message\": \"{\\\"name\\\": \\\"Test\\\", \\\"id\\\": \\\"3\\\", \\\"results\\\": \\\"hi 9.9.9.9\\\"}\", \"MessageAttributes\": {\"source\": {\"Type\": \"String\", \"Value\": \"sumologic\"}}}"}
+	]}`), &event)
+
+	have, err := handleRequest(Ctx, event)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	response, ok := have.(events.SQSEventResponse)
+	if !ok {
+		t.Fatalf("Expected an SQS response, got %v", have)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "2" {
+		t.Fatalf("Unexpected batch item failures: %v", response.BatchItemFailures)
+	}
+
+	if len(sent) != 2 || sent[1].ID != "3" || sent[1].Subjects[0].Value != "9.9.9.9" {
+		t.Fatalf("Unexpected alerts sent: %v", sent)
+	}
+}
+
+func TestHandlerEventBridge(t *testing.T) {
+	setup()
+
+	var sent []squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = append(sent, alert)
+		return "testExecArn", nil
+	}
+
+	payloads := []string{
+		`{"id": "1", "detail-type": "GuardDuty Finding", "source": "aws.guardduty", "detail": {"title": "Bad traffic", "description": "Connection from 8.8.8.8 seen"}}`,
+		`{"id": "2", "detail-type": "Alert", "source": "squyre.splunk", "detail": {"search_name": "Test", "message": "hi 9.9.9.9", "correlation_id": "1234"}}`,
+	}
+	for _, payload := range payloads {
+		var event map[string]interface{}
+		json.Unmarshal([]byte(payload), &event)
+
+		_, err := handleRequest(Ctx, event)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("Unexpected alerts sent: %v", sent)
+	}
+	if sent[0].Name != "GuardDuty Finding: Bad traffic" || sent[0].Subjects[0].Value != "8.8.8.8" {
+		t.Fatalf("Unexpected GuardDuty alert: %v", sent[0])
+	}
+	if sent[1].ID != "1234" || sent[1].Subjects[0].Value != "9.9.9.9" {
+		t.Fatalf("Unexpected Splunk alert: %v", sent[1])
+	}
+}
+
+func TestHandlerEventBridgeJSONDetail(t *testing.T) {
+	setup()
+
+	var sent squyre.Alert
+	SendAlert = func(alert squyre.Alert, sfnName string, deliveryID string) (string, error) {
+		sent = alert
+		return "testExecArn", nil
+	}
+
+	// A GuardDuty finding, where addresses are JSON values rather than free text
+	payload := `{"id": "1", "detail-type": "GuardDuty Finding", "source": "aws.guardduty", "detail": {"title": "Unusual traffic", "service": {"action": {"networkConnectionAction": {"remoteIpDetails": {"ipAddressV4": "198.51.77.10", "organization": {"asn": "64496"}}, "localIpDetails": {"ipAddressV4": "172.31.5.9"}, "remotePortDetails": {"port": 22}}}}}}`
+	var event map[string]interface{}
+	json.Unmarshal([]byte(payload), &event)
+
+	_, err := handleRequest(Ctx, event)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(sent.Subjects) != 1 || sent.Subjects[0] != (squyre.Subject{Type: "ipv4", Value: "198.51.77.10"}) {
+		t.Fatalf("Unexpected subjects: %v", sent.Subjects)
+	}
+}
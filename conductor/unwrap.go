@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Links can be wrapped more than once, e.g. by the sender's and the recipient's email gateways
+	maxUnwrapDepth = 5
+)
+
+// urlUnwrapper decodes links rewritten by an email security product back to their real destination
+type urlUnwrapper struct {
+	Name       string
+	Hosts      []string // Hosts, or parent domains, the product rewrites links to
+	Path       string   // The path rewritten links start with, if the hosts serve other pages too
+	DomainOnly bool     // Whether only the destination domain can be recovered, in which case Unwrap returns that
+	Unwrap     func(*url.URL) (string, error)
+}
+
+// urlUnwrappers lists the link rewriting products we can decode
+var urlUnwrappers = []urlUnwrapper{
+	{Name: "Microsoft ATP Safe Links", Hosts: []string{"safelinks.protection.outlook.com"}, Unwrap: unwrapAtpSafeLink},
+	{Name: "Proofpoint URL Defense", Hosts: []string{"urldefense.proofpoint.com", "urldefense.com"}, Unwrap: unwrapProofpoint},
+	{Name: "Mimecast URL Protect", Hosts: []string{"mimecast.com", "mimecastprotect.com"}, DomainOnly: true, Unwrap: unwrapMimecast},
+	{Name: "Barracuda Link Protection", Hosts: []string{"linkprotect.cudasvc.com"}, Unwrap: unwrapQueryParam("a")},
+	{Name: "Trend Micro Click Time", Hosts: []string{"trendmicro.com"}, Path: "/wis/clicktime/", Unwrap: unwrapQueryParam("url")},
+}
+
+// unwrapURL returns the real destination of a link, which is unchanged if it wasn't rewritten or can't be decoded.
+// Some products only give away the destination domain, which is returned instead of a link.
+func unwrapURL(link string) (string, string) {
+	for depth := 0; depth < maxUnwrapDepth; depth++ {
+		parsed, err := url.Parse(link)
+		if err != nil {
+			return link, ""
+		}
+
+		unwrapper, ok := findUnwrapper(parsed)
+		if !ok {
+			return link, ""
+		}
+
+		unwrapped, err := unwrapper.Unwrap(parsed)
+		if err != nil {
+			log.Debugf("Could not unwrap %s link %s: %s", unwrapper.Name, link, err)
+			return link, ""
+		}
+		if unwrapper.DomainOnly {
+			log.Infof("Unwrapped %s link to domain %s", unwrapper.Name, unwrapped)
+			return "", unwrapped
+		}
+		log.Infof("Unwrapped %s link to %s", unwrapper.Name, unwrapped)
+		link = unwrapped
+	}
+	return link, ""
+}
+
+func findUnwrapper(link *url.URL) (urlUnwrapper, bool) {
+	host := strings.ToLower(link.Hostname())
+	for _, unwrapper := range urlUnwrappers {
+		if !strings.HasPrefix(link.Path, unwrapper.Path) {
+			continue
+		}
+		for _, wrapperHost := range unwrapper.Hosts {
+			if host == wrapperHost || strings.HasSuffix(host, "."+wrapperHost) {
+				return unwrapper, true
+			}
+		}
+	}
+	return urlUnwrapper{}, false
+}
+
+// unwrapQueryParam decodes products that pass the original link as a query parameter
+func unwrapQueryParam(param string) func(*url.URL) (string, error) {
+	return func(link *url.URL) (string, error) {
+		original := link.Query().Get(param)
+		if original == "" {
+			return "", fmt.Errorf("'%s' parameter missing", param)
+		}
+		return original, nil
+	}
+}
+
+// unwrapAtpSafeLink decodes Microsoft ATP Safe Links, which must carry the tracking data too
+func unwrapAtpSafeLink(link *url.URL) (string, error) {
+	query := link.Query()
+	original := query.Get("url")
+	if original == "" {
+		return "", errors.New("URL missing")
+	}
+	if len(query) < 2 {
+		return "", errors.New("Data missing")
+	}
+	return original, nil
+}
+
+// unwrapMimecast decodes Mimecast links. These are opaque tokens, so only the destination domain can be recovered.
+func unwrapMimecast(link *url.URL) (string, error) {
+	domain := link.Query().Get("domain")
+	if domain == "" {
+		return "", errors.New("'domain' parameter missing")
+	}
+	return strings.ToLower(domain), nil
+}
+
+var (
+	proofpointV3Pattern      = regexp.MustCompile(`^/v3/__(.+?)__;(.*?)!`)
+	proofpointV3TokenPattern = regexp.MustCompile(`\*(\*.)?`)
+	// Runs of encoded characters are marked with one of these, in order of length starting at 2
+	proofpointV3RunValues = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+// unwrapProofpoint decodes Proofpoint URL Defense links
+// See https://help.proofpoint.com/Threat_Insight_Dashboard/Concepts/How_do_I_decode_a_rewritten_URL%3F
+func unwrapProofpoint(link *url.URL) (string, error) {
+	switch {
+	case strings.HasPrefix(link.Path, "/v1/"):
+		return unwrapQueryParam("u")(link)
+	case strings.HasPrefix(link.Path, "/v2/"):
+		encoded := link.Query().Get("u")
+		if encoded == "" {
+			return "", errors.New("'u' parameter missing")
+		}
+		encoded = strings.NewReplacer("-", "%", "_", "/").Replace(encoded)
+		return url.PathUnescape(encoded)
+	case strings.HasPrefix(link.Path, "/v3/"):
+		// The original link is embedded in the path, but may have been split up as a query and fragment
+		path := link.EscapedPath()
+		if link.RawQuery != "" || link.ForceQuery {
+			path += "?" + link.RawQuery
+		}
+		if link.Fragment != "" {
+			path += "#" + link.EscapedFragment()
+		}
+		return unwrapProofpointV3(path)
+	}
+	return "", errors.New("Unknown version")
+}
+
+// unwrapProofpointV3 decodes v3 links, where characters that aren't allowed in the path are replaced by '*' markers
+// and appended base64 encoded after the link
+func unwrapProofpointV3(path string) (string, error) {
+	match := proofpointV3Pattern.FindStringSubmatch(path)
+	if match == nil {
+		return "", errors.New("Unexpected v3 format")
+	}
+
+	original, err := url.PathUnescape(match[1])
+	if err != nil {
+		return "", err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(match[2], "="))
+	if err != nil {
+		return "", err
+	}
+	replacements := []rune(string(decoded))
+
+	position := 0
+	var tokenErr error
+	unwrapped := proofpointV3TokenPattern.ReplaceAllStringFunc(original, func(token string) string {
+		length := 1
+		if len(token) == 3 {
+			length = strings.IndexByte(proofpointV3RunValues, token[2]) + 2
+			if length < 2 {
+				tokenErr = fmt.Errorf("Invalid run marker %s", token)
+				return token
+			}
+		}
+		if position+length > len(replacements) {
+			tokenErr = errors.New("Not enough encoded characters")
+			return token
+		}
+		replacement := string(replacements[position : position+length])
+		position += length
+		return replacement
+	})
+	if tokenErr != nil {
+		return "", tokenErr
+	}
+	return unwrapped, nil
+}
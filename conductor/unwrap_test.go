@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnwrapURL(t *testing.T) {
+	tests := map[string]string{
+		// Not rewritten
+		"https://github.com/gyrospectre/squyre": "https://github.com/gyrospectre/squyre",
+		// Microsoft ATP Safe Links
+		"https://apc04.safelinks.protection.outlook.com/?url=https%3A%2F%2Fdocs.testsite.int%2Ffile%2Fim0w22da&data=02%7C01&reserved=0": "https://docs.testsite.int/file/im0w22da",
+		// Proofpoint v1, v2 and v3
+		"https://urldefense.proofpoint.com/v1/url?u=http://www.example.com/a%3Fb%3Dc&k=abc%3D%0A":                                                          "http://www.example.com/a?b=c",
+		"https://urldefense.proofpoint.com/v2/url?u=http-3A__www.example.com_path-3Fa-3D1&d=DwMFAg&c=abc&r=def&m=ghi&s=jkl&e=":                             "http://www.example.com/path?a=1",
+		"https://urldefense.com/v3/__https://google.com:443/search?q=a*test&gs=ps__;Kw!-612Flbf0JvQ3kNJkRi5Jg!Ue6tQudNKaShHg93trcdjqDP8se2ySE65jyCIe2K1D$": "https://google.com:443/search?q=a+test&gs=ps",
+		"https://urldefense.com/v3/__http://example.com/?q=**G*__;PHNjcmlwdD7DqQ!!abc$":                                                                    "http://example.com/?q=<script>é",
+		"https://urldefense.com/v3/__http://example.com/page*section__;Iw!!abc$":                                                                           "http://example.com/page#section",
+		// Barracuda and Trend Micro
+		"https://linkprotect.cudasvc.com/url?a=https%3a%2f%2fevil.example%2fx&c=E,1,abc&typo=1":                              "https://evil.example/x",
+		"https://imsva91-ctp.trendmicro.com:443/wis/clicktime/v1/query?url=https%3a%2f%2fevil.example%2fx&umid=abc&auth=def": "https://evil.example/x",
+		// Wrapped twice
+		"https://urldefense.proofpoint.com/v2/url?u=https-3A__linkprotect.cudasvc.com_url-3Fa-3Dhttps-253a-252f-252fevil.example-252fx&d=DwMFAg": "https://evil.example/x",
+	}
+
+	for link, want := range tests {
+		have, domain := unwrapURL(link)
+		if have != want || domain != "" {
+			t.Fatalf("Unexpected output for %s. \nHave: %s %s\nWant: %s", link, have, domain, want)
+		}
+	}
+}
+
+func TestUnwrapMimecast(t *testing.T) {
+	// Mimecast only gives away the domain
+	link, domain := unwrapURL("https://protect-au.mimecast.com/s/AbCdEfGhIj?domain=Evil.Example")
+	if link != "" || domain != "evil.example" {
+		t.Fatalf("Unexpected output. \nHave: '%s' '%s'\nWant: '%s' '%s'", link, domain, "", "evil.example")
+	}
+}
+
+func TestUnwrapMalformedURL(t *testing.T) {
+	tests := []string{
+		"https://urldefense.proofpoint.com/v2/url?d=DwMFAg",
+		"https://urldefense.proofpoint.com/v9/url?u=abc",
+		"https://urldefense.com/v3/__http://example.com/?q=**G*__;PHN!!abc$",
+		"https://urldefense.com/v3/__http://example.com/?q=**#*__;PHNjcmlwdD7DqQ!!abc$",
+		"https://protect-au.mimecast.com/s/AbCdEfGhIj",
+		// Other Trend Micro pages aren't rewritten links
+		"https://www.trendmicro.com/en_au/business.html",
+		"https://imsva91-ctp.trendmicro.com/wis/clicktime/v1/query?umid=abc",
+	}
+
+	for _, link := range tests {
+		have, domain := unwrapURL(link)
+		if have != link || domain != "" {
+			t.Fatalf("Expected malformed link to be unchanged. \nHave: %s\nWant: %s", have, link)
+		}
+	}
+}
+
+func TestExtractWrappedUrls(t *testing.T) {
+	message := "Clicked https://urldefense.com/v3/__https://google.com:443/search?q=a*test&gs=ps__;Kw!-612Flbf0JvQ3kNJkRi5Jg!Ue6tQudNKaShHg93trcdjqDP8se2ySE65jyCIe2K1D$ and https://protect-au.mimecast.com/s/AbCdEfGhIj?domain=evil.com today"
+
+	subjects := extractUrls(message)
+	if len(subjects) != 2 {
+		t.Fatalf("Unexpected number of Urls. \nHave: %d\nWant: %d\nGot: %v", len(subjects), 2, subjects)
+	}
+
+	if subjects[0].Value != "https://google.com:443/search?q=a+test&gs=ps" {
+		t.Fatalf("Unexpected Urls: %v", subjects)
+	}
+	// The Mimecast link only gives away its domain, which is enriched linked to the link
+	if subjects[1].Type != "domain" || subjects[1].Value != "evil.com" || subjects[1].Parent != "https://protect-au.mimecast.com/s/AbCdEfGhIj?domain=evil.com" {
+		t.Fatalf("Unexpected domain: %v", subjects[1])
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -19,31 +18,34 @@ import (
 )
 
 const (
-	provider    = "Alienvault OTX"
-	baseURL     = "https://otx.alienvault.com/api/v1/"
-	supports    = "ipv4,domain,url"
-	retries     = 3
-	timeoutSecs = 10
+	provider = "Alienvault OTX"
+	baseURL  = "https://otx.alienvault.com/api/v1/"
+	// Each pulse an indicator is in adds to its score, so one pulse is suspicious and five malicious
+	baseScore  = 20
+	pulseScore = 10
+	maxTags    = 20
 )
 
 var (
 	// GetIPInfo abstracts this function to allow for tests
 	GetIndictatorInfo = getOTXIndictatorInfo
-	responseObject    otxResponse
 	InitClient        = initOTXClient
 	OnlyLogMatches, _ = strconv.ParseBool(os.Getenv("ONLY_LOG_MATCHES"))
+	supports          = squyre.SubjectTypes{"ipv4", "ipv6", "domain", "url", "md5", "sha1", "sha256"}
+	// Cache holds results between runs, set up from env vars when the function starts
+	Cache *squyre.ResultCache
 )
 
 var template = `
 Alienvault OTX has %x matches for '%s', in the following pulses:
 %s
 
-More information at: https://otx.alienvault.com/browse/global/pulses?q=%s
+More information at: %s
 
 `
 
 type apiClient struct {
-	httpClient *http.Client
+	httpClient *squyre.HTTPClient
 	baseURL    string
 }
 
@@ -63,38 +65,41 @@ type otxPulse struct {
 	Modified          string   `json:"modified"`
 	Created           string   `json:"created"`
 	Tags              []string `json:"tags"`
-	TargetedCountries string   `json:"targeted_countries`
-	MalwareFamilies   string   `json:"malware_families`
-	Industries        []string `json:"industries`
+	TargetedCountries []string `json:"targeted_countries"`
+	MalwareFamilies   []string `json:"malware_families"`
+	Industries        []string `json:"industries"`
 	TLP               string   `json:"tlp"`
 	ModifiedText      string   `json:"modified_text"`
 }
 
 func initOTXClient() (*apiClient, error) {
 	client := &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * timeoutSecs,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(squyre.DefaultRequestTimeout, squyre.DefaultRetryPolicy),
 	}
 
 	return client, nil
 }
 
-func getOTXIndictatorInfo(c *apiClient, indicator string, indicatorType string) (*http.Response, error) {
+func getOTXIndictatorInfo(ctx context.Context, c *apiClient, indicator string, indicatorType string) (*http.Response, error) {
 	if indicatorType == "ipv4" {
-		return getOTXIPInfo(c, indicator)
+		return getOTXIPInfo(ctx, c, indicator)
+	} else if indicatorType == "ipv6" {
+		return getOTXIPv6Info(ctx, c, indicator)
 	} else if indicatorType == "domain" {
-		return getOTXDomainInfo(c, indicator)
+		return getOTXDomainInfo(ctx, c, indicator)
 	} else if indicatorType == "url" {
-		return getOTXUrlInfo(c, indicator)
+		return getOTXUrlInfo(ctx, c, indicator)
+	} else if indicatorType == "md5" || indicatorType == "sha1" || indicatorType == "sha256" {
+		return getOTXFileInfo(ctx, c, indicator)
 	}
 
 	return nil, errors.New("Unknown indicator type")
 }
 
-func getOTXIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getOTXIPInfo(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf("%s/indicators/IPv4/%s", c.baseURL, ipv4),
 		nil,
@@ -105,8 +110,22 @@ func getOTXIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
 	return c.httpClient.Do(request)
 }
 
-func getOTXDomainInfo(c *apiClient, domain string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getOTXIPv6Info(ctx context.Context, c *apiClient, ipv6 string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
+		"GET",
+		fmt.Sprintf("%s/indicators/IPv6/%s", c.baseURL, ipv6),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(request)
+}
+
+func getOTXDomainInfo(ctx context.Context, c *apiClient, domain string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf("%s/indicators/domain/%s", c.baseURL, domain),
 		nil,
@@ -117,8 +136,9 @@ func getOTXDomainInfo(c *apiClient, domain string) (*http.Response, error) {
 	return c.httpClient.Do(request)
 }
 
-func getOTXUrlInfo(c *apiClient, url string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getOTXUrlInfo(ctx context.Context, c *apiClient, url string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf("%s/indicators/url/%s/general", c.baseURL, url),
 		nil,
@@ -130,93 +150,74 @@ func getOTXUrlInfo(c *apiClient, url string) (*http.Response, error) {
 	return c.httpClient.Do(request)
 }
 
-func processSubject(client *apiClient, subject squyre.Subject) (*squyre.Result, error) {
-	var (
-		response *http.Response
-		err      error
-		attempt  int
+func getOTXFileInfo(ctx context.Context, c *apiClient, hash string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
+		"GET",
+		fmt.Sprintf("%s/indicators/file/%s/general", c.baseURL, hash),
+		nil,
 	)
-	result := &squyre.Result{
-		Source:         provider,
-		AttributeValue: subject.Value,
+	if err != nil {
+		return nil, err
 	}
-	for attempt = 1; attempt <= retries; attempt++ {
-		log.Infof("Get indicator attempt number %d", attempt)
-		response, err = GetIndictatorInfo(client, subject.Value, subject.Type)
 
-		if err == nil {
-			break
-		}
+	return c.httpClient.Do(request)
+}
+
+type enricher struct {
+	squyre.SubjectTypes
+	client *apiClient
+}
+
+func newEnricher() (squyre.Enricher, error) {
+	client, err := InitClient()
+	if err != nil {
+		return nil, err
 	}
+	return &enricher{SubjectTypes: supports, client: client}, nil
+}
+
+// Enrich looks up an indicator in Alienvault OTX pulses
+func (e *enricher) Enrich(ctx context.Context, subject squyre.Subject) (squyre.Result, error) {
+	var result squyre.Result
+
+	response, err := GetIndictatorInfo(ctx, e.client, subject.Value, subject.Type)
 	if err != nil {
-		log.Errorf("Failed to fetch data from %s after %d attempts", provider, attempt-1)
-		result.Message = err.Error()
-		return result, nil
+		return result, err
 	}
-	log.Infof("Successfully fetched data from %s after %d attempts.", provider, attempt)
-	result.Success = true
+	defer response.Body.Close()
 
 	responseData, err := ioutil.ReadAll(response.Body)
-
 	if err != nil {
-		log.Errorf("Unexpected response from %s for %s", provider, subject.Value)
-		return nil, err
+		return result, fmt.Errorf("error decoding response from API: %w", err)
 	}
 	log.Infof("Received %s response for %s", provider, subject.Value)
 
+	var responseObject otxResponse
 	json.Unmarshal(responseData, &responseObject)
 
-	if responseObject.PulseInfo.Count == 0 {
-		// Nothing was found
-		result.MatchFound = false
-	} else {
-		result.MatchFound = true
+	// A pulse count of zero means nothing was found
+	result.MatchFound = responseObject.PulseInfo.Count > 0
+	result.Message = messageFromResponse(responseObject)
+	if result.MatchFound {
+		result.Score = squyre.ClampScore(baseScore + pulseScore*responseObject.PulseInfo.Count)
+		result.Verdict = squyre.VerdictFromScore(result.Score)
+		result.Tags = tagsFromResponse(responseObject)
+		result.References = []string{pulseSearchURL(responseObject.Indicator)}
 	}
+	result.Raw = squyre.RawPayload(responseData)
 
-	if !result.MatchFound && OnlyLogMatches {
-		log.Infof("Skipping non match for %s", subject.Value)
-		return nil, nil
-	}
-	// Match found. Add the enriched details back to the results
-	result.Message = messageFromResponse(responseObject)
 	return result, nil
-
 }
 
 func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
-	log.Infof("Starting %s run for alert %s", provider, alert.ID)
-	log.Infof("OnlyLogMatches is set to %t", OnlyLogMatches)
-
-	if len(alert.Subjects) == 0 {
-		log.Info("Alert has no subjects to process.")
-		finalJSON, _ := json.Marshal(alert)
-		return string(finalJSON), nil
+	harness := squyre.EnrichmentHarness{
+		Provider:       provider,
+		NewEnricher:    newEnricher,
+		OnlyLogMatches: OnlyLogMatches,
+		Cache:          Cache,
 	}
-
-	client, err := InitClient()
-	if err != nil {
-		return "Failed to initialise client", err
-	}
-
-	// Process each subject in the alert we were passed
-	for _, subject := range alert.Subjects {
-		if !strings.Contains(supports, subject.Type) {
-			log.Info("Subject not supported by this provider. Skipping.")
-			continue
-		}
-		result, err := processSubject(client, subject)
-		if err != nil {
-			return "Error decoding response from API!", err
-		}
-		if result != nil {
-			alert.Results = append(alert.Results, *result)
-		}
-	}
-	log.Infof("Finished %s run. Yielded %d results for %d subjects.", provider, len(alert.Results), len(alert.Subjects))
-
-	// Convert the alert object into Json for the step function
-	finalJSON, _ := json.Marshal(alert)
-	return string(finalJSON), nil
+	return harness.HandleRequest(ctx, alert)
 }
 
 func removeDuplicates(strSlice []string) []string {
@@ -231,6 +232,24 @@ func removeDuplicates(strSlice []string) []string {
 	return list
 }
 
+func pulseSearchURL(indicator string) string {
+	return fmt.Sprintf("https://otx.alienvault.com/browse/global/pulses?q=%s", indicator)
+}
+
+// tagsFromResponse collects the tags and malware families from every pulse the indicator is in
+func tagsFromResponse(response otxResponse) []string {
+	var tags []string
+	for _, pulse := range response.PulseInfo.Pulses {
+		tags = append(tags, pulse.Tags...)
+		tags = append(tags, pulse.MalwareFamilies...)
+	}
+	tags = removeDuplicates(tags)
+	if len(tags) > maxTags {
+		tags = tags[:maxTags]
+	}
+	return tags
+}
+
 func messageFromResponse(response otxResponse) string {
 	if response.PulseInfo.Count == 0 {
 		return "Indicator not found in Alienvault OTX."
@@ -245,7 +264,7 @@ func messageFromResponse(response otxResponse) string {
 		response.PulseInfo.Count,
 		response.Indicator,
 		strings.Join(removeDuplicates(pulses), "\n"),
-		response.Indicator,
+		pulseSearchURL(response.Indicator),
 	)
 
 	return string(message)
@@ -254,5 +273,6 @@ func messageFromResponse(response otxResponse) string {
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
+	Cache = squyre.CacheFromEnv()
 	lambda.Start(handleRequest)
 }
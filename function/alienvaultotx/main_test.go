@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -17,20 +18,17 @@ import (
 var (
 	mockResponse string
 	TestAlert    squyre.Alert
-	ctx          context.Context
-	attempt      int
+	ctx          = context.Background()
 )
 
 func mockInitClient() (*apiClient, error) {
 	return &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(time.Second*30, squyre.DefaultRetryPolicy),
 	}, nil
 }
 
-func mockInfo(c *apiClient, indicator string, indicatorType string) (*http.Response, error) {
+func mockInfo(ctx context.Context, c *apiClient, indicator string, indicatorType string) (*http.Response, error) {
 	otxResp := otxResponse{
 		Indicator:  indicator,
 		Reputation: 0,
@@ -41,20 +39,10 @@ func mockInfo(c *apiClient, indicator string, indicatorType string) (*http.Respo
 		otxResp.PulseInfo.Count = 1
 		otxResp.PulseInfo.Pulses = []otxPulse{
 			{
-				Id:   "1234",
-				Name: "test",
-			},
-		}
-	case "1.1.1.1":
-		if attempt < 3 {
-			attempt += 1
-			return nil, errors.New("(Client.Timeout exceeded while awaiting headers)")
-		}
-		otxResp.PulseInfo.Count = 1
-		otxResp.PulseInfo.Pulses = []otxPulse{
-			{
-				Id:   "7890",
-				Name: "test2",
+				Id:              "1234",
+				Name:            "test",
+				Tags:            []string{"scanner", "botnet"},
+				MalwareFamilies: []string{"Mirai", "botnet"},
 			},
 		}
 	case "2.2.2.2":
@@ -66,7 +54,6 @@ func mockInfo(c *apiClient, indicator string, indicatorType string) (*http.Respo
 	otxRespJson, _ := json.Marshal(otxResp)
 	mockResponse = string(otxRespJson)
 
-	attempt += 1
 	return &http.Response{
 		Body: ioutil.NopCloser(bytes.NewReader([]byte(mockResponse))),
 	}, nil
@@ -84,7 +71,6 @@ func setup(t *testing.T) {
 		URL:        "https://127.0.0.1/test.html",
 		Timestamp:  "2022-12-12 18:00:00",
 	}
-	attempt = 1
 }
 
 func TestHandlerNonMatchNonIgnore(t *testing.T) {
@@ -102,6 +88,7 @@ func TestHandlerNonMatchNonIgnore(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	have := response.Results[0].Message
+	var responseObject otxResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := "Indicator not found in Alienvault OTX."
 
@@ -148,6 +135,7 @@ func TestHandlerMatch(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	have := response.Results[0].Message
+	var responseObject otxResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := messageFromResponse(responseObject)
 
@@ -193,6 +181,39 @@ func TestMultiSubject(t *testing.T) {
 func TestTempTimeout(t *testing.T) {
 	setup(t)
 
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		otxResp := otxResponse{Indicator: "1.1.1.1"}
+		otxResp.PulseInfo.Count = 1
+		otxResp.PulseInfo.Pulses = []otxPulse{
+			{
+				Id:   "7890",
+				Name: "test2",
+			},
+		}
+		otxRespJson, _ := json.Marshal(otxResp)
+		mockResponse = string(otxRespJson)
+		w.Write(otxRespJson)
+	}))
+	defer server.Close()
+
+	GetIndictatorInfo = getOTXIndictatorInfo
+	InitClient = func() (*apiClient, error) {
+		return &apiClient{
+			baseURL: server.URL,
+			httpClient: squyre.NewHTTPClient(time.Second, squyre.RetryPolicy{
+				Retries:   3,
+				BaseDelay: time.Millisecond,
+				MaxDelay:  10 * time.Millisecond,
+			}),
+		}, nil
+	}
+
 	TestAlert.Subjects = []squyre.Subject{
 		{
 			Type:  "ipv4",
@@ -205,6 +226,7 @@ func TestTempTimeout(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	have := response.Results[0].Message
+	var responseObject otxResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := messageFromResponse(responseObject)
 
@@ -212,8 +234,8 @@ func TestTempTimeout(t *testing.T) {
 		t.Errorf("Expected '%s', got '%s'", want, have)
 	}
 
-	if attempt-1 != 3 {
-		t.Errorf("Expected 3 attempts, got %d", attempt-1)
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
 	}
 }
 
@@ -245,3 +267,94 @@ func TestTimeout(t *testing.T) {
 		t.Fatalf("Unexpected output. \nHave: %t\nWant: %t", have2, want2)
 	}
 }
+
+func TestFileHashLookup(t *testing.T) {
+	setup(t)
+
+	var requested string
+	GetIndictatorInfo = func(ctx context.Context, c *apiClient, indicator string, indicatorType string) (*http.Response, error) {
+		requested = indicatorType
+		return mockInfo(ctx, c, indicator, indicatorType)
+	}
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "sha256",
+			Value: "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	if requested != "sha256" {
+		t.Fatalf("Expected a sha256 lookup, got '%s'", requested)
+	}
+
+	have := response.Results[0].Message
+	want := "Indicator not found in Alienvault OTX."
+
+	if have != want {
+		t.Errorf("Expected '%s', got '%s'", want, have)
+	}
+}
+
+func TestHandlerVerdict(t *testing.T) {
+	setup(t)
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "4.4.4.4",
+		},
+		{
+			Type:  "ipv4",
+			Value: "8.8.8.8",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	match := response.Results[0]
+	if match.Verdict != squyre.VerdictSuspicious || match.Score != 30 {
+		t.Errorf("unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", match.Verdict, match.Score, squyre.VerdictSuspicious, 30)
+	}
+	have := strings.Join(match.Tags, ",")
+	want := "scanner,botnet,Mirai"
+	if have != want {
+		t.Errorf("unexpected tags. \nHave: %s\nWant: %s", have, want)
+	}
+	if len(match.References) != 1 || match.References[0] != pulseSearchURL("4.4.4.4") {
+		t.Errorf("unexpected references. \nHave: %v\nWant: %v", match.References, []string{pulseSearchURL("4.4.4.4")})
+	}
+	if len(match.Raw) == 0 {
+		t.Error("expected the raw response to be kept")
+	}
+
+	noMatch := response.Results[1]
+	if noMatch.Verdict != squyre.VerdictUnknown || noMatch.Score != 0 || noMatch.References != nil {
+		t.Errorf("unexpected verdict. \nHave: %s (%d) %v\nWant: %s (%d)", noMatch.Verdict, noMatch.Score, noMatch.References, squyre.VerdictUnknown, 0)
+	}
+}
+
+func TestTimeoutVerdict(t *testing.T) {
+	setup(t)
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "2.2.2.2",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	if have := response.Results[0].Verdict; have != squyre.VerdictUnknown {
+		t.Errorf("unexpected verdict. \nHave: %s\nWant: %s", have, squyre.VerdictUnknown)
+	}
+}
@@ -4,7 +4,6 @@ go 1.17
 
 require (
 	github.com/aws/aws-lambda-go v1.41.0
-	github.com/aws/aws-sdk-go v1.45.11
 	github.com/crowdstrike/gofalcon v0.4.2
 	github.com/gyrospectre/squyre/pkg/squyre v0.0.0-20230227215344-4cf93284e6cd
 	github.com/sirupsen/logrus v1.9.3
@@ -12,6 +11,7 @@ require (
 
 require (
 	github.com/asaskevich/govalidator v0.0.0-20230301143203-a9d515a09cc2 // indirect
+	github.com/aws/aws-sdk-go v1.45.11 // indirect
 	github.com/blang/semver/v4 v4.0.0 // indirect
 	github.com/go-logr/logr v1.2.4 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
@@ -44,3 +44,5 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/gyrospectre/squyre/pkg/squyre => ../../pkg/squyre
@@ -24,15 +24,27 @@ import (
 const (
 	provider       = "CrowdStrike Falcon"
 	baseURL        = "https://api.crowdstrike.com"
-	supports       = "ipv4,domain,sha256,hostname"
 	secretLocation = "CrowdstrikeAPI"
+	searchURL      = "https://falcon.crowdstrike.com/search/?term=_all:~'%s'"
+	hostURL        = "https://falcon.crowdstrike.com/hosts/hosts?filter=_all:~'%s'"
 )
 
+// confidenceScores maps Falcon X malicious confidence levels to scores
+var confidenceScores = map[string]int{
+	"high":       90,
+	"medium":     60,
+	"low":        35,
+	"unverified": 10,
+}
+
 var (
 	// InitClient abstracts this function to allow for tests
 	InitClient        = InitFalconClient
 	OnlyLogMatches, _ = strconv.ParseBool(os.Getenv("ONLY_LOG_MATCHES"))
 	getIndicator      = getFalconIndicator
+	supports          = squyre.SubjectTypes{"ipv4", "domain", "email", "md5", "sha1", "sha256", "hostname"}
+	// Cache holds results between runs, set up from env vars when the function starts
+	Cache *squyre.ResultCache
 )
 
 var templateIntelIndicator = `
@@ -49,7 +61,7 @@ Vulnerabilities: %s
 Threat Types: %s
 Targets: %s
 
-More information at: https://falcon.crowdstrike.com/search/?term=_all:~'%s'
+More information at: %s
 
 `
 
@@ -68,7 +80,7 @@ External IP: %s
 Policies:
 - %s
 
-More information at: https://falcon.crowdstrike.com/hosts/hosts?filter=_all:~'%s'
+More information at: %s
 
 `
 
@@ -78,17 +90,15 @@ type apiKeySecret struct {
 	FalconCloud  string `json:"falconCloud"`
 }
 
-// InitFalconClient initialises a Falcon client using credentials from AWS Secrets Manager
+// InitFalconClient initialises a Falcon client using credentials from the secret provider
 func InitFalconClient() (*client.CrowdStrikeAPISpecification, error) {
-	// Fetch API key from Secrets Manager
-	smresponse, err := squyre.GetSecret(secretLocation)
-	if err != nil {
+	// Fetch API key from the secret provider. The cloud is optional, defaulting to US-1.
+	var secret apiKeySecret
+	if err := squyre.FetchSecretJSON(secretLocation, &secret, "clientID", "clientSecret"); err != nil {
 		log.Errorf("Failed to fetch Crowdstrike Falcon secret: %s", err)
+		return nil, err
 	}
 
-	var secret apiKeySecret
-	json.Unmarshal([]byte(*smresponse.SecretString), &secret)
-
 	// Connect to Crowdstrike Falcon
 	client, err := falcon.NewClient(&falcon.ApiConfig{
 		ClientId:     secret.ClientID,
@@ -97,6 +107,8 @@ func InitFalconClient() (*client.CrowdStrikeAPISpecification, error) {
 		Cloud:        falcon.Cloud(secret.FalconCloud),
 		Context:      context.Background(),
 		Debug:        false,
+		// Retry rate limiting and brief outages, as the other enrichment functions do
+		TransportDecorator: squyre.DefaultRetryPolicy.Transport,
 	})
 	if err != nil {
 		return nil, err
@@ -105,97 +117,114 @@ func InitFalconClient() (*client.CrowdStrikeAPISpecification, error) {
 	return client, nil
 }
 
-func processSubject(falconClient *client.CrowdStrikeAPISpecification, subject squyre.Subject) *squyre.Result {
-	result := &squyre.Result{
-		Source:         provider,
-		AttributeValue: subject.Value,
+type enricher struct {
+	squyre.SubjectTypes
+	client *client.CrowdStrikeAPISpecification
+}
+
+func newEnricher() (squyre.Enricher, error) {
+	falconClient, err := InitClient()
+	if err != nil {
+		return nil, err
 	}
+	return &enricher{SubjectTypes: supports, client: falconClient}, nil
+}
+
+// Enrich looks up hostnames as Falcon hosts, and everything else as Falcon X indicators
+func (e *enricher) Enrich(ctx context.Context, subject squyre.Subject) (squyre.Result, error) {
+	var result squyre.Result
 
 	if subject.Type == "hostname" {
-		hostDetail, hostLogins, err := getHost(falconClient, subject.Value)
+		hostDetail, hostLogins, err := getHost(ctx, e.client, subject.Value)
 		if err != nil {
-			log.Errorf("Failed to fetch data from %s", provider)
-			result.Message = err.Error()
-			return result
+			return result, err
 		}
-		result.Success = true
 
 		if hostDetail != nil {
 			log.Infof("Received %s response for %s", provider, subject.Value)
 			result.Message = messageFromHostDetail(hostDetail, hostLogins)
 			result.MatchFound = true
+			// Our own hosts are context rather than reputation, so there's no verdict to give
+			result.References = []string{fmt.Sprintf(hostURL, hostDetail.Hostname)}
+			result.Raw = rawPayload(hostDetail)
 		} else {
 			log.Infof("Host %s not found in %s", subject.Value, provider)
 			result.Message = fmt.Sprintf("Host '%s' not found in Falcon. Agent not installed?", subject.Value)
-			result.MatchFound = false
 		}
-		return result
+		return result, nil
 	}
 
-	indicator, err := getIndicator(falconClient, subject.Value)
+	indicator, err := getIndicator(ctx, e.client, subject.Value)
 	if err != nil {
-		log.Errorf("Failed to fetch data from %s", provider)
-		result.Message = err.Error()
-		return result
-	}
-	result.Success = true
-	if indicator != nil {
-		log.Infof("Received %s response for %s", provider, subject.Value)
-		result.MatchFound = true
-	} else {
-		result.MatchFound = false
+		return result, err
 	}
 
-	if !result.MatchFound && OnlyLogMatches {
-		log.Infof("Skipping non match for %s", subject.Value)
-		return nil
-	}
-
-	if !result.MatchFound {
+	if indicator == nil {
 		result.Message = "Indicator not found in Falcon X."
-	} else {
-		result.Message = messageFromIndicator(indicator)
+		return result, nil
 	}
-	return result
+	log.Infof("Received %s response for %s", provider, subject.Value)
+
+	result.MatchFound = true
+	result.Message = messageFromIndicator(indicator)
+	result.Verdict, result.Score = verdictFromIndicator(indicator)
+	result.Tags = tagsFromIndicator(indicator)
+	result.References = []string{fmt.Sprintf(searchURL, *indicator.Indicator)}
+	result.Raw = rawPayload(indicator)
+
+	return result, nil
 }
 
 func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
-	log.Infof("Starting %s run for alert %s", provider, alert.ID)
-	log.Infof("OnlyLogMatches is set to %t", OnlyLogMatches)
-
-	if len(alert.Subjects) == 0 {
-		log.Info("Alert has no subjects to process.")
-		finalJSON, _ := json.Marshal(alert)
-		return string(finalJSON), nil
+	harness := squyre.EnrichmentHarness{
+		Provider:       provider,
+		NewEnricher:    newEnricher,
+		OnlyLogMatches: OnlyLogMatches,
+		Cache:          Cache,
 	}
+	return harness.HandleRequest(ctx, alert)
+}
 
-	falconClient, err := InitClient()
-	if err != nil {
-		log.Error("Failed to initialise client")
-		return "Failed to initialise client", err
+func main() {
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetLevel(log.InfoLevel)
+	Cache = squyre.CacheFromEnv()
+	lambda.Start(handleRequest)
+}
+
+func verdictFromIndicator(indicator *models.DomainPublicIndicatorV3) (squyre.Verdict, int) {
+	if indicator.MaliciousConfidence == nil {
+		return squyre.VerdictUnknown, 0
 	}
+	score := confidenceScores[strings.ToLower(*indicator.MaliciousConfidence)]
+	return squyre.VerdictFromScore(score), score
+}
 
-	// Process each subject in the alert we were passed
-	for _, subject := range alert.Subjects {
-		if !strings.Contains(supports, subject.Type) {
-			log.Info("Subject not supported by this provider. Skipping.")
-			continue
-		}
-		if result := processSubject(falconClient, subject); result != nil {
-			alert.Results = append(alert.Results, *result)
+// tagsFromIndicator uses the malware families and threat types. Labels are left out, as they repeat the
+// confidence and kill chain details in a form that's noisy to read.
+func tagsFromIndicator(indicator *models.DomainPublicIndicatorV3) []string {
+	var tags []string
+	seen := make(map[string]bool)
+
+	add := func(values ...string) {
+		for _, value := range values {
+			if value != "" && !seen[value] {
+				seen[value] = true
+				tags = append(tags, value)
+			}
 		}
 	}
-	log.Infof("Successfully ran %s. Yielded %d results for %d subjects.", provider, len(alert.Results), len(alert.Subjects))
-
-	// Convert the alert object into Json for the step function
-	finalJSON, _ := json.Marshal(alert)
-	return string(finalJSON), nil
+	add(indicator.MalwareFamilies...)
+	add(indicator.ThreatTypes...)
+	return tags
 }
 
-func main() {
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetLevel(log.InfoLevel)
-	lambda.Start(handleRequest)
+func rawPayload(value interface{}) json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return squyre.RawPayload(data)
 }
 
 func messageFromIndicator(indicator *models.DomainPublicIndicatorV3) string {
@@ -215,7 +244,7 @@ func messageFromIndicator(indicator *models.DomainPublicIndicatorV3) string {
 		strings.Join(indicator.Vulnerabilities, ","),
 		strings.Join(indicator.ThreatTypes, ","),
 		strings.Join(indicator.Targets, ","),
-		*indicator.Indicator,
+		fmt.Sprintf(searchURL, *indicator.Indicator),
 	)
 
 	return string(message)
@@ -253,16 +282,20 @@ func messageFromHostDetail(host *models.DeviceapiDeviceSwagger, logins *models.D
 		host.OsVersion,
 		host.ExternalIP,
 		strings.Join(policies, "\n- "),
-		host.Hostname,
+		fmt.Sprintf(hostURL, host.Hostname),
 	)
 
 	return string(message)
 }
 
-func getFalconIndicator(client *client.CrowdStrikeAPISpecification, name string) (*models.DomainPublicIndicatorV3, error) {
+func getFalconIndicator(ctx context.Context, client *client.CrowdStrikeAPISpecification, name string) (*models.DomainPublicIndicatorV3, error) {
 	filter := fmt.Sprintf("indicator:'%s'", name)
 
-	indicatorsChannel, errorChannel := queryIntelIndicators(client, &filter, nil)
+	// Stop the query once we have the first indicator
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indicatorsChannel, errorChannel := queryIntelIndicators(ctx, client, &filter, nil)
 	for openChannels := 2; openChannels > 0; {
 		select {
 		case err, ok := <-errorChannel:
@@ -270,61 +303,75 @@ func getFalconIndicator(client *client.CrowdStrikeAPISpecification, name string)
 				log.Errorf("Failed to fetch data from %s", provider)
 				return nil, err
 			}
+			errorChannel = nil
 			openChannels--
 		case indicator, ok := <-indicatorsChannel:
 			if ok {
 				return indicator, nil
 			}
+			indicatorsChannel = nil
 			openChannels--
 		}
 	}
 	return nil, nil
 }
 
-func getHost(client *client.CrowdStrikeAPISpecification, name string) (*models.DeviceapiDeviceSwagger, *models.DeviceapiLoginDetailV1, error) {
+func getHost(ctx context.Context, client *client.CrowdStrikeAPISpecification, name string) (*models.DeviceapiDeviceSwagger, *models.DeviceapiLoginDetailV1, error) {
 	filter := fmt.Sprintf("hostname:'%s'", name)
 
-	var hostDetailBatch []*models.DeviceapiDeviceSwagger
-	var hostLoginsBatch []*models.DeviceapiLoginDetailV1
+	// Stop the query once we have the first batch of hosts
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	hostIDs, err := getHostIds(client, &filter)
-	if err != nil {
-		log.Error(falcon.ErrorExplain(err))
-		return nil, nil, err
-	}
-
-	for hostIDBatch := range hostIDs {
-		if len(hostIDBatch) == 0 {
-			return nil, nil, nil
-		}
-
-		hostDetailBatch, err = getHostsDetails(client, hostIDBatch)
-		if err != nil {
+	hostIDs, errorChannel := getHostIds(ctx, client, &filter)
+	hostIDBatch, ok := <-hostIDs
+	if !ok {
+		// The query failed, or ended without sending any hosts
+		if err := <-errorChannel; err != nil {
 			log.Error(falcon.ErrorExplain(err))
 			return nil, nil, err
 		}
+		return nil, nil, nil
+	}
+	if len(hostIDBatch) == 0 {
+		return nil, nil, nil
+	}
 
-		hostLoginsBatch, err = getHostsLoginDetails(client, hostIDBatch)
-		if err != nil {
-			log.Error(falcon.ErrorExplain(err))
-			return nil, nil, err
-		}
-		break
+	hostDetailBatch, err := getHostsDetails(ctx, client, hostIDBatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hostDetailBatch) == 0 || hostDetailBatch[0] == nil {
+		return nil, nil, nil
+	}
+
+	hostLoginsBatch, err := getHostsLoginDetails(ctx, client, hostIDBatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hostLoginsBatch) == 0 || hostLoginsBatch[0] == nil {
+		// A host that's never been logged in to
+		return hostDetailBatch[0], &models.DeviceapiLoginDetailV1{}, nil
 	}
 	return hostDetailBatch[0], hostLoginsBatch[0], nil
 }
 
-func queryIntelIndicators(client *client.CrowdStrikeAPISpecification, filter, sort *string) (<-chan *models.DomainPublicIndicatorV3, <-chan error) {
+// queryIntelIndicators sends each indicator matching the filter, until there are no more or ctx is done. If the
+// query fails, the error is sent and both channels are closed.
+func queryIntelIndicators(ctx context.Context, client *client.CrowdStrikeAPISpecification, filter, sort *string) (<-chan *models.DomainPublicIndicatorV3, <-chan error) {
 	indicatorsChannel := make(chan *models.DomainPublicIndicatorV3)
-	errorChannel := make(chan error)
+	errorChannel := make(chan error, 1)
 
 	go func() {
+		defer close(errorChannel)
+		defer close(indicatorsChannel)
+
 		limit := int64(1000)
 		var err error
 
 		for response := (*intel.QueryIntelIndicatorEntitiesOK)(nil); response.HasNextPage(); {
 			response, err = client.Intel.QueryIntelIndicatorEntities(&intel.QueryIntelIndicatorEntitiesParams{
-				Context: context.Background(),
+				Context: ctx,
 				Filter:  filter,
 				Sort:    sort,
 				Limit:   &limit,
@@ -333,35 +380,41 @@ func queryIntelIndicators(client *client.CrowdStrikeAPISpecification, filter, so
 			)
 			if err != nil {
 				errorChannel <- err
+				return
 			}
 			if response == nil || response.Payload == nil {
-				break
+				return
 			}
 
 			if err = falcon.AssertNoError(response.Payload.Errors); err != nil {
 				errorChannel <- err
+				return
 			}
 
-			indicators := response.Payload.Resources
-			for _, indicator := range indicators {
-				indicatorsChannel <- indicator
+			for _, indicator := range response.Payload.Resources {
+				select {
+				case indicatorsChannel <- indicator:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
-		close(indicatorsChannel)
-		close(errorChannel)
 	}()
 	return indicatorsChannel, errorChannel
 }
 
-func getHostsDetails(client *client.CrowdStrikeAPISpecification, hostIds []string) ([]*models.DeviceapiDeviceSwagger, error) {
+func getHostsDetails(ctx context.Context, client *client.CrowdStrikeAPISpecification, hostIds []string) ([]*models.DeviceapiDeviceSwagger, error) {
 	response, err := client.Hosts.PostDeviceDetailsV2(&hosts.PostDeviceDetailsV2Params{
 		Body:    &models.MsaIdsRequest{Ids: hostIds},
-		Context: context.Background(),
+		Context: ctx,
 	})
 	if err != nil {
 		log.Error(falcon.ErrorExplain(err))
 		return nil, err
 	}
+	if response == nil || response.Payload == nil {
+		return nil, nil
+	}
 	if err = falcon.AssertNoError(response.Payload.Errors); err != nil {
 		log.Error(falcon.ErrorExplain(err))
 		return nil, err
@@ -370,12 +423,12 @@ func getHostsDetails(client *client.CrowdStrikeAPISpecification, hostIds []strin
 	return response.Payload.Resources, nil
 }
 
-func getHostsLoginDetails(client *client.CrowdStrikeAPISpecification, hostIds []string) ([]*models.DeviceapiLoginDetailV1, error) {
+func getHostsLoginDetails(ctx context.Context, client *client.CrowdStrikeAPISpecification, hostIds []string) ([]*models.DeviceapiLoginDetailV1, error) {
 	response, err := client.Hosts.QueryDeviceLoginHistory(&hosts.QueryDeviceLoginHistoryParams{
 		Body: &models.MsaIdsRequest{
 			Ids: hostIds,
 		},
-		Context: context.Background(),
+		Context: ctx,
 	})
 	// returns a QueryDeviceLoginHistoryOK with Payload *models.DeviceapiLoginHistoryResponseV1
 	// In this Payload, Resources []*DeviceapiLoginDetailV1 `json:"resources"`
@@ -383,6 +436,9 @@ func getHostsLoginDetails(client *client.CrowdStrikeAPISpecification, hostIds []
 		log.Error(falcon.ErrorExplain(err))
 		return nil, err
 	}
+	if response == nil || response.Payload == nil {
+		return nil, nil
+	}
 	if err = falcon.AssertNoError(response.Payload.Errors); err != nil {
 		log.Error(falcon.ErrorExplain(err))
 		return nil, err
@@ -391,37 +447,53 @@ func getHostsLoginDetails(client *client.CrowdStrikeAPISpecification, hostIds []
 	return response.Payload.Resources, nil
 }
 
-func getHostIds(client *client.CrowdStrikeAPISpecification, filter *string) (<-chan []string, error) {
+// getHostIds sends each batch of host IDs matching the filter, until there are no more or ctx is done. If the
+// query fails, the error is sent and both channels are closed.
+func getHostIds(ctx context.Context, client *client.CrowdStrikeAPISpecification, filter *string) (<-chan []string, <-chan error) {
 	hostIds := make(chan []string)
+	errorChannel := make(chan error, 1)
 
-	var err error
-	err = nil
 	go func() {
+		defer close(errorChannel)
+		defer close(hostIds)
+
 		limit := int64(500)
 		for offset := ""; ; {
 			response, err := client.Hosts.QueryDevicesByFilterScroll(&hosts.QueryDevicesByFilterScrollParams{
 				Limit:   &limit,
 				Offset:  &offset,
 				Filter:  filter,
-				Context: context.Background(),
+				Context: ctx,
 			})
 			if err != nil {
-				log.Error(falcon.ErrorExplain(err))
+				errorChannel <- err
+				return
+			}
+			if response == nil || response.Payload == nil {
+				return
 			}
 			if err = falcon.AssertNoError(response.Payload.Errors); err != nil {
-				log.Error(falcon.ErrorExplain(err))
+				errorChannel <- err
+				return
 			}
 
 			hosts := response.Payload.Resources
-			hostIds <- hosts
+			select {
+			case hostIds <- hosts:
+			case <-ctx.Done():
+				return
+			}
 
-			if *response.Payload.Meta.Pagination.Offset == "" || int64(len(hosts)) < limit {
-				break // no more next page indicates we are done
+			if response.Payload.Meta == nil {
+				return
+			}
+			pagination := response.Payload.Meta.Pagination
+			if pagination == nil || pagination.Offset == nil || *pagination.Offset == "" || int64(len(hosts)) < limit {
+				return // no more next page indicates we are done
 			}
 
-			offset = *response.Payload.Meta.Pagination.Offset
+			offset = *pagination.Offset
 		}
-		close(hostIds)
 	}()
-	return hostIds, err
+	return hostIds, errorChannel
 }
@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/hosts"
+	"github.com/crowdstrike/gofalcon/falcon/client/intel"
 	"github.com/crowdstrike/gofalcon/falcon/models"
 	"github.com/gyrospectre/squyre/pkg/squyre"
 )
@@ -16,7 +19,7 @@ import (
 var (
 	// MockTicket is a fake ticket for tests
 	MockTicket int
-	Ctx        context.Context
+	Ctx        = context.Background()
 )
 
 func setup() {
@@ -34,7 +37,7 @@ func mockInitClient() (*client.CrowdStrikeAPISpecification, error) {
 	return &client.CrowdStrikeAPISpecification{}, nil
 }
 
-func mockGetFalconIndicator(client *client.CrowdStrikeAPISpecification, name string) (*models.DomainPublicIndicatorV3, error) {
+func mockGetFalconIndicator(ctx context.Context, client *client.CrowdStrikeAPISpecification, name string) (*models.DomainPublicIndicatorV3, error) {
 	conf := "high"
 	now := time.Now()
 	epoch := now.Unix()
@@ -45,6 +48,8 @@ func mockGetFalconIndicator(client *client.CrowdStrikeAPISpecification, name str
 			MaliciousConfidence: &conf,
 			PublishedDate:       &epoch,
 			LastUpdated:         &epoch,
+			MalwareFamilies:     []string{"Emotet"},
+			ThreatTypes:         []string{"Banking", "Emotet"},
 		}
 		return indicator, nil
 	} else if name == "9.9.9.9" {
@@ -54,11 +59,15 @@ func mockGetFalconIndicator(client *client.CrowdStrikeAPISpecification, name str
 	return nil, nil
 }
 
-func mockGetSecret(location string) (secretsmanager.GetSecretValueOutput, error) {
-	secret := `{"user":"test","apikey": "test123"}`
-	return secretsmanager.GetSecretValueOutput{
-		SecretString: &secret,
-	}, nil
+// mockSecrets is a secret provider holding secrets in memory
+type mockSecrets map[string]string
+
+func (m mockSecrets) Fetch(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", &squyre.SecretError{Name: name, Provider: "Mock", Err: squyre.ErrSecretNotFound}
+	}
+	return value, nil
 }
 
 func makeTestAlert() (squyre.Alert, string) {
@@ -112,7 +121,7 @@ func TestAlertWithSubjectsNoIgnore(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	client, _ := mockInitClient()
-	ind, _ := mockGetFalconIndicator(client, "8.8.8.8")
+	ind, _ := mockGetFalconIndicator(context.Background(), client, "8.8.8.8")
 
 	have := string(response.Results[0].Message)
 	want := messageFromIndicator(ind)
@@ -193,3 +202,163 @@ func TestAlertFailedLookup(t *testing.T) {
 		t.Fatalf("Unexpected output. \nHave: %t\nWant: %t", have2, want2)
 	}
 }
+
+func TestAlertVerdict(t *testing.T) {
+	setup()
+
+	alert, _ := makeTestAlert()
+	alert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "8.8.8.8",
+		},
+		{
+			Type:  "ipv4",
+			Value: "4.4.4.4",
+		},
+	}
+
+	output, err := handleRequest(Ctx, alert)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	match := response.Results[0]
+	if match.Verdict != squyre.VerdictMalicious || match.Score != 90 {
+		t.Errorf("Unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", match.Verdict, match.Score, squyre.VerdictMalicious, 90)
+	}
+	have := strings.Join(match.Tags, ",")
+	want := "Emotet,Banking"
+	if have != want {
+		t.Errorf("Unexpected tags. \nHave: %s\nWant: %s", have, want)
+	}
+	if len(match.References) != 1 || match.References[0] != fmt.Sprintf(searchURL, "8.8.8.8") {
+		t.Errorf("Unexpected references. \nHave: %v\nWant: %v", match.References, []string{fmt.Sprintf(searchURL, "8.8.8.8")})
+	}
+	if len(match.Raw) == 0 {
+		t.Error("Expected the raw indicator to be kept")
+	}
+
+	noMatch := response.Results[1]
+	if noMatch.Verdict != squyre.VerdictUnknown || noMatch.Score != 0 {
+		t.Errorf("Unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", noMatch.Verdict, noMatch.Score, squyre.VerdictUnknown, 0)
+	}
+}
+
+func TestVerdictFromIndicator(t *testing.T) {
+	tests := map[string]squyre.Verdict{
+		"high":       squyre.VerdictMalicious,
+		"Medium":     squyre.VerdictSuspicious,
+		"low":        squyre.VerdictSuspicious,
+		"unverified": squyre.VerdictUnknown,
+	}
+
+	for confidence, want := range tests {
+		confidence := confidence
+		have, _ := verdictFromIndicator(&models.DomainPublicIndicatorV3{MaliciousConfidence: &confidence})
+		if have != want {
+			t.Errorf("Unexpected verdict for '%s'. \nHave: %s\nWant: %s", confidence, have, want)
+		}
+	}
+}
+
+func TestInitFalconClientBadSecret(t *testing.T) {
+	defer func() { squyre.Secrets = nil }()
+
+	squyre.Secrets = mockSecrets{}
+	if _, err := InitFalconClient(); !errors.Is(err, squyre.ErrSecretNotFound) {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+
+	squyre.Secrets = mockSecrets{secretLocation: `{"clientID": "abc", "clientSecret": ""}`}
+	if _, err := InitFalconClient(); !errors.Is(err, squyre.ErrSecretMalformed) {
+		t.Errorf("Expected a malformed secret error, got %v", err)
+	}
+}
+
+// mockHosts is a Falcon hosts API with one host, 'web01', or failing with err if set
+type mockHosts struct {
+	hosts.ClientService
+	err     error
+	details []*models.DeviceapiDeviceSwagger
+}
+
+func (m *mockHosts) QueryDevicesByFilterScroll(params *hosts.QueryDevicesByFilterScrollParams, opts ...hosts.ClientOption) (*hosts.QueryDevicesByFilterScrollOK, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if err := params.Context.Err(); err != nil {
+		return nil, err
+	}
+	return &hosts.QueryDevicesByFilterScrollOK{Payload: &models.DeviceapiDeviceResponse{Resources: []string{"abc123"}}}, nil
+}
+
+func (m *mockHosts) PostDeviceDetailsV2(params *hosts.PostDeviceDetailsV2Params, opts ...hosts.ClientOption) (*hosts.PostDeviceDetailsV2OK, error) {
+	return &hosts.PostDeviceDetailsV2OK{Payload: &models.DeviceapiDeviceDetailsResponseSwagger{Resources: m.details}}, nil
+}
+
+func (m *mockHosts) QueryDeviceLoginHistory(params *hosts.QueryDeviceLoginHistoryParams, opts ...hosts.ClientOption) (*hosts.QueryDeviceLoginHistoryOK, error) {
+	return &hosts.QueryDeviceLoginHistoryOK{Payload: &models.DeviceapiLoginHistoryResponseV1{}}, nil
+}
+
+// mockIntel is a Falcon intel API that fails every query with err
+type mockIntel struct {
+	intel.ClientService
+	err error
+}
+
+func (m *mockIntel) QueryIntelIndicatorEntities(params *intel.QueryIntelIndicatorEntitiesParams, opts ...intel.ClientOption) (*intel.QueryIntelIndicatorEntitiesOK, error) {
+	return nil, m.err
+}
+
+// tests failed and cancelled host queries are returned as errors, rather than panicking
+func TestGetHostFailedQuery(t *testing.T) {
+	falconClient := &client.CrowdStrikeAPISpecification{Hosts: &mockHosts{err: errors.New("Timeout!")}}
+	if _, _, err := getHost(Ctx, falconClient, "web01"); err == nil || err.Error() != "Timeout!" {
+		t.Errorf("Expected the query error, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(Ctx)
+	cancel()
+	falconClient = &client.CrowdStrikeAPISpecification{Hosts: &mockHosts{}}
+	if _, _, err := getHost(cancelled, falconClient, "web01"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled error, got %v", err)
+	}
+}
+
+// tests hosts without details are not found, and hosts without logins are still returned
+func TestGetHost(t *testing.T) {
+	falconClient := &client.CrowdStrikeAPISpecification{Hosts: &mockHosts{}}
+	host, logins, err := getHost(Ctx, falconClient, "web01")
+	if host != nil || logins != nil || err != nil {
+		t.Errorf("Expected the host not to be found, got %v %v %v", host, logins, err)
+	}
+
+	web01 := &models.DeviceapiDeviceSwagger{Hostname: "web01"}
+	falconClient = &client.CrowdStrikeAPISpecification{Hosts: &mockHosts{details: []*models.DeviceapiDeviceSwagger{web01}}}
+	host, logins, err = getHost(Ctx, falconClient, "web01")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if host != web01 || logins == nil {
+		t.Errorf("Expected web01 with no logins, got %v %v", host, logins)
+	}
+	if !strings.Contains(messageFromHostDetail(host, logins), "web01") {
+		t.Error("Expected a message about web01")
+	}
+}
+
+// tests failed indicator queries are returned as errors, rather than waiting for the deadline
+func TestGetFalconIndicatorFailedQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(Ctx, time.Second)
+	defer cancel()
+
+	falconClient := &client.CrowdStrikeAPISpecification{Intel: &mockIntel{err: errors.New("Timeout!")}}
+	_, err := getFalconIndicator(ctx, falconClient, "8.8.8.8")
+	if err == nil || err.Error() != "Timeout!" {
+		t.Errorf("Expected the query error, got %v", err)
+	}
+}
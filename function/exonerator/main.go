@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -20,7 +21,6 @@ import (
 const (
 	provider = "ExoneraTor"
 	baseURL  = "https://metrics.torproject.org/exonerator.html"
-	supports = "ipv4"
 )
 
 var (
@@ -28,6 +28,9 @@ var (
 	GetIPInfo         = getIPInfo
 	InitClient        = initExoneraTorClient
 	OnlyLogMatches, _ = strconv.ParseBool(os.Getenv("ONLY_LOG_MATCHES"))
+	supports          = squyre.SubjectTypes{"ipv4", "ipv6"}
+	// Cache holds results between runs, set up from env vars when the function starts
+	Cache *squyre.ResultCache
 )
 
 var template = `
@@ -38,16 +41,14 @@ More information at: %s
 `
 
 type apiClient struct {
-	httpClient *http.Client
+	httpClient *squyre.HTTPClient
 	baseURL    string
 }
 
 func initExoneraTorClient() (*apiClient, error) {
 	client := &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(squyre.DefaultRequestTimeout, squyre.DefaultRetryPolicy),
 	}
 
 	return client, nil
@@ -57,10 +58,11 @@ func dayBeforeYesterday() string {
 	return time.Now().AddDate(0, 0, -2).Format("2006-01-02")
 }
 
-func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getIPInfo(ctx context.Context, c *apiClient, ip string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
-		fmt.Sprintf("%s?ip=%s&timestamp=%s&lang=en", c.baseURL, ipv4, dayBeforeYesterday()),
+		fmt.Sprintf("%s?ip=%s&timestamp=%s&lang=en", c.baseURL, url.QueryEscape(ip), dayBeforeYesterday()),
 		nil,
 	)
 	if err != nil {
@@ -70,91 +72,81 @@ func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
 	return c.httpClient.Do(request)
 }
 
-func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
-	log.Infof("Starting %s run for alert %s", provider, alert.ID)
-	log.Infof("OnlyLogMatches is set to %t", OnlyLogMatches)
+type enricher struct {
+	squyre.SubjectTypes
+	client *apiClient
+}
 
-	if len(alert.Subjects) == 0 {
-		log.Info("Alert has no subjects to process.")
-		finalJSON, _ := json.Marshal(alert)
-		return string(finalJSON), nil
+func newEnricher() (squyre.Enricher, error) {
+	client, err := InitClient()
+	if err != nil {
+		return nil, err
 	}
+	return &enricher{SubjectTypes: supports, client: client}, nil
+}
 
-	client, err := InitClient()
+// Enrich checks whether an IP address was recently a Tor relay
+func (e *enricher) Enrich(ctx context.Context, subject squyre.Subject) (squyre.Result, error) {
+	var result squyre.Result
+
+	response, err := GetIPInfo(ctx, e.client, subject.Value)
 	if err != nil {
-		return "Failed to initialise client", err
+		return result, err
 	}
+	defer response.Body.Close()
 
-	// Process each subject in the alert we were passed
-	for _, subject := range alert.Subjects {
-		if strings.Contains(supports, subject.Type) {
-
-			// Build a result object to hold our goodies
-			var result = squyre.Result{
-				Source:         provider,
-				AttributeValue: subject.Value,
-				MatchFound:     false,
-				Success:        false,
-			}
-
-			response, err := GetIPInfo(client, subject.Value)
-
-			if err != nil || response.StatusCode != http.StatusOK {
-				log.Errorf("Failed to fetch data from %s", provider)
-				result.Success = false
-				result.Message = err.Error() + fmt.Sprintf("(statuscode: %d)", response.StatusCode)
-				alert.Results = append(alert.Results, result)
-			} else {
-				result.Success = true
-				responseData, err := ioutil.ReadAll(response.Body)
-
-				if err == nil {
-					log.Infof("Received %s response for %s", provider, subject.Value)
-
-					if strings.Contains(string(responseData), "Result is positive") {
-						result.MatchFound = true
-					} else if strings.Contains(string(responseData), "Result is negative") {
-						result.MatchFound = false
-					} else {
-						log.Errorf("Unexpected response from %s", provider)
-						result.Success = false
-						result.Message = "Bad response, no result found in provider output!"
-						alert.Results = append(alert.Results, result)
-					}
-
-					if !result.MatchFound && OnlyLogMatches {
-						log.Infof("Skipping non match for %s", subject.Value)
-					} else {
-						// Match found. Add the enriched details back to the results
-						result.Message = messageFromResponse(subject.Value, result.MatchFound)
-						alert.Results = append(alert.Results, result)
-						log.Infof("Added %s to result set", subject.Value)
-					}
-				} else {
-					log.Errorf("Unexpected response from %s for %s", provider, subject.Value)
-					return "Error decoding response from API!", err
-				}
-			}
-		} else {
-			log.Info("Subject not supported by this provider. Skipping.")
-		}
+	if response.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Unexpected response from %s (statuscode: %d)", provider, response.StatusCode)
+	}
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return result, fmt.Errorf("error decoding response from API: %w", err)
 	}
+	log.Infof("Received %s response for %s", provider, subject.Value)
+
+	if strings.Contains(string(responseData), "Result is positive") {
+		result.MatchFound = true
+	} else if !strings.Contains(string(responseData), "Result is negative") {
+		return result, errors.New("Bad response, no result found in provider output!")
+	}
+
+	result.Message = messageFromResponse(subject.Value, result.MatchFound)
+	result.References = []string{lookupURL(subject.Value)}
+	result.Raw = squyre.RawPayload(responseData)
+	if result.MatchFound {
+		// Tor relays aren't bad in themselves, but are worth knowing about
+		result.Verdict = squyre.VerdictSuspicious
+		result.Score = 50
+		result.Tags = []string{"tor"}
+	}
+
+	return result, nil
+}
+
+func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
+	harness := squyre.EnrichmentHarness{
+		Provider:       provider,
+		NewEnricher:    newEnricher,
+		OnlyLogMatches: OnlyLogMatches,
+		Cache:          Cache,
+	}
+	return harness.HandleRequest(ctx, alert)
+}
 
-	log.Infof("Successfully ran %s. Yielded %d results for %d subjects.", provider, len(alert.Results), len(alert.Subjects))
-	// Convert the alert object into Json for the step function
-	finalJSON, _ := json.Marshal(alert)
-	return string(finalJSON), nil
+func lookupURL(ip string) string {
+	return fmt.Sprintf("%s?ip=%s&timestamp=%s&lang=en", baseURL, url.QueryEscape(ip), dayBeforeYesterday())
 }
 
-func messageFromResponse(ipv4 string, matchfound bool) string {
+func messageFromResponse(ip string, matchfound bool) string {
 	negate := ""
 	if !matchfound {
 		negate = "NOT "
 	}
 	message := fmt.Sprintf(template,
-		ipv4,
+		ip,
 		negate,
-		fmt.Sprintf("%s?ip=%s&timestamp=%s&lang=en", baseURL, ipv4, dayBeforeYesterday()),
+		lookupURL(ip),
 	)
 
 	return string(message)
@@ -163,5 +155,6 @@ func messageFromResponse(ipv4 string, matchfound bool) string {
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
+	Cache = squyre.CacheFromEnv()
 	lambda.Start(handleRequest)
 }
@@ -15,21 +15,25 @@ import (
 var (
 	mockResponse string
 	TestAlert    squyre.Alert
-	ctx          context.Context
+	ctx          = context.Background()
 )
 
 func mockInitClient() (*apiClient, error) {
 	return &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(time.Second*30, squyre.DefaultRetryPolicy),
 	}, nil
 }
 
-func mockIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
-	// 4.4.4.4 is a Tor node, all other IPs are not
-	if ipv4 == "4.4.4.4" {
+func mockIPInfo(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
+	// 4.4.4.4 and 2001:db8::4 are Tor nodes, 5.5.5.5 errors, all other IPs are not
+	if ipv4 == "5.5.5.5" {
+		return &http.Response{
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("Service Unavailable"))),
+			StatusCode: 503,
+		}, nil
+	}
+	if ipv4 == "4.4.4.4" || ipv4 == "2001:db8::4" {
 		mockResponse = "blah blah blah Result is positive <html woot yeh"
 	} else {
 		mockResponse = "blah blah blah Result is negative <html woot yeh"
@@ -154,3 +158,89 @@ func TestMultiSubject(t *testing.T) {
 		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
 	}
 }
+
+func TestHandlerMatchIPv6(t *testing.T) {
+	setup()
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv6",
+			Value: "2001:db8::4",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	have := response.Results[0].Message
+	want := messageFromResponse("2001:db8::4", true)
+
+	if have != want {
+		t.Errorf("Expected '%s', got '%s'", want, have)
+	}
+}
+
+func TestHandlerVerdict(t *testing.T) {
+	setup()
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "4.4.4.4",
+		},
+		{
+			Type:  "ipv4",
+			Value: "8.8.8.8",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var respAlert squyre.Alert
+	json.Unmarshal([]byte(output), &respAlert)
+
+	relay := respAlert.Results[0]
+	if relay.Verdict != squyre.VerdictSuspicious || relay.Score != 50 {
+		t.Errorf("unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", relay.Verdict, relay.Score, squyre.VerdictSuspicious, 50)
+	}
+	if len(relay.Tags) != 1 || relay.Tags[0] != "tor" {
+		t.Errorf("unexpected tags. \nHave: %v\nWant: %v", relay.Tags, []string{"tor"})
+	}
+	if len(relay.References) != 1 || relay.References[0] != lookupURL("4.4.4.4") {
+		t.Errorf("unexpected references. \nHave: %v\nWant: %v", relay.References, []string{lookupURL("4.4.4.4")})
+	}
+
+	notRelay := respAlert.Results[1]
+	if notRelay.Verdict != squyre.VerdictUnknown || notRelay.Score != 0 || notRelay.Tags != nil {
+		t.Errorf("unexpected verdict. \nHave: %s (%d) %v\nWant: %s (%d)", notRelay.Verdict, notRelay.Score, notRelay.Tags, squyre.VerdictUnknown, 0)
+	}
+}
+
+func TestHandlerBadStatus(t *testing.T) {
+	setup()
+	OnlyLogMatches = true
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "5.5.5.5",
+		},
+	}
+	output, err := handleRequest(ctx, TestAlert)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	var respAlert squyre.Alert
+	json.Unmarshal([]byte(output), &respAlert)
+
+	if len(respAlert.Results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(respAlert.Results))
+	}
+
+	have := respAlert.Results[0]
+	want := "Unexpected response from ExoneraTor (statuscode: 503)"
+	if have.Success || have.Message != want {
+		t.Fatalf("unexpected output. \nHave: %s (success %t)\nWant: %s", have.Message, have.Success, want)
+	}
+}
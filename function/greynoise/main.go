@@ -9,7 +9,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,15 +19,16 @@ import (
 const (
 	provider = "GreyNoise"
 	baseURL  = "https://api.greynoise.io/v3/community"
-	supports = "ipv4"
 )
 
 var (
 	// GetIPInfo abstracts this function to allow for tests
 	GetIPInfo         = getIPInfo
-	responseObject    greynoiseResponse
 	InitClient        = initGreynoiseClient
 	OnlyLogMatches, _ = strconv.ParseBool(os.Getenv("ONLY_LOG_MATCHES"))
+	supports          = squyre.SubjectTypes{"ipv4"}
+	// Cache holds results between runs, set up from env vars when the function starts
+	Cache *squyre.ResultCache
 )
 
 var template = `
@@ -43,7 +43,7 @@ More information at: %s
 `
 
 type apiClient struct {
-	httpClient *http.Client
+	httpClient *squyre.HTTPClient
 	baseURL    string
 }
 
@@ -60,17 +60,16 @@ type greynoiseResponse struct {
 
 func initGreynoiseClient() (*apiClient, error) {
 	client := &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(squyre.DefaultRequestTimeout, squyre.DefaultRetryPolicy),
 	}
 
 	return client, nil
 }
 
-func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getIPInfo(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf("%s/%s", c.baseURL, ipv4),
 		nil,
@@ -78,87 +77,63 @@ func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.httpClient.Do(request)
+	// GreyNoise responds with a 404 for IPs it hasn't seen
+	return c.httpClient.Do(request, http.StatusNotFound)
 }
 
-func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
-	log.Infof("Starting %s run for alert %s", provider, alert.ID)
-	log.Infof("OnlyLogMatches is set to %t", OnlyLogMatches)
+type enricher struct {
+	squyre.SubjectTypes
+	client *apiClient
+}
 
-	if len(alert.Subjects) == 0 {
-		log.Info("Alert has no subjects to process.")
-		finalJSON, _ := json.Marshal(alert)
-		return string(finalJSON), nil
+func newEnricher() (squyre.Enricher, error) {
+	client, err := InitClient()
+	if err != nil {
+		return nil, err
 	}
+	return &enricher{SubjectTypes: supports, client: client}, nil
+}
 
-	client, err := InitClient()
+// Enrich looks up an IP address on GreyNoise
+func (e *enricher) Enrich(ctx context.Context, subject squyre.Subject) (squyre.Result, error) {
+	var result squyre.Result
+
+	response, err := GetIPInfo(ctx, e.client, subject.Value)
 	if err != nil {
-		return "Failed to initialise client", err
+		return result, err
 	}
+	defer response.Body.Close()
 
-	// Process each subject in the alert we were passed
-	for _, subject := range alert.Subjects {
-		if strings.Contains(supports, subject.Type) {
-
-			// Build a result object to hold our goodies
-			var result = squyre.Result{
-				Source:         provider,
-				AttributeValue: subject.Value,
-				MatchFound:     false,
-				Success:        false,
-			}
-
-			response, err := GetIPInfo(client, subject.Value)
-
-			if err != nil {
-				log.Errorf("Failed to fetch data from %s", provider)
-				result.Success = false
-				result.Message = err.Error()
-				alert.Results = append(alert.Results, result)
-			} else {
-				result.Success = true
-				responseData, err := ioutil.ReadAll(response.Body)
-
-				if err == nil {
-					log.Infof("Received %s response for %s", provider, subject.Value)
-
-					json.Unmarshal(responseData, &responseObject)
-
-					if responseObject.Classification != "" {
-						// A blank classification means nothing was found
-						result.MatchFound = true
-					} else {
-						result.MatchFound = false
-					}
-
-					if !result.MatchFound && OnlyLogMatches {
-						log.Infof("Skipping non match for %s", subject.Value)
-					} else {
-						// Match found. Add the enriched details back to the results
-						result.Message = messageFromResponse(responseObject)
-						alert.Results = append(alert.Results, result)
-						log.Infof("Added %s to result set", subject.Value)
-					}
-
-					// Clear results ready for next cycle
-					responseObject.Classification = ""
-					responseObject.Name = ""
-					responseObject.Link = ""
-					responseObject.LastSeen = ""
-				} else {
-					log.Errorf("Unexpected response from %s for %s", provider, subject.Value)
-					return "Error decoding response from API!", err
-				}
-			}
-		} else {
-			log.Info("Subject not supported by this provider. Skipping.")
-		}
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return result, fmt.Errorf("error decoding response from API: %w", err)
 	}
+	log.Infof("Received %s response for %s", provider, subject.Value)
+
+	var responseObject greynoiseResponse
+	json.Unmarshal(responseData, &responseObject)
+
+	// A blank classification means nothing was found
+	result.MatchFound = responseObject.Classification != ""
+	result.Message = messageFromResponse(responseObject)
+	result.Verdict, result.Score = verdictFromResponse(responseObject)
+	result.Tags = tagsFromResponse(responseObject)
+	if responseObject.Link != "" {
+		result.References = []string{responseObject.Link}
+	}
+	result.Raw = squyre.RawPayload(responseData)
+
+	return result, nil
+}
 
-	log.Infof("Successfully ran %s. Yielded %d results for %d subjects.", provider, len(alert.Results), len(alert.Subjects))
-	// Convert the alert object into Json for the step function
-	finalJSON, _ := json.Marshal(alert)
-	return string(finalJSON), nil
+func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
+	harness := squyre.EnrichmentHarness{
+		Provider:       provider,
+		NewEnricher:    newEnricher,
+		OnlyLogMatches: OnlyLogMatches,
+		Cache:          Cache,
+	}
+	return harness.HandleRequest(ctx, alert)
 }
 
 func messageFromResponse(response greynoiseResponse) string {
@@ -178,8 +153,38 @@ func messageFromResponse(response greynoiseResponse) string {
 	return string(message)
 }
 
+// verdictFromResponse maps the GreyNoise classification to a verdict and score. IPs in the RIOT dataset belong to
+// common business services, and noise without a classification is scanning GreyNoise hasn't made its mind up on.
+func verdictFromResponse(response greynoiseResponse) (squyre.Verdict, int) {
+	switch {
+	case response.Classification == "malicious":
+		return squyre.VerdictMalicious, 90
+	case response.Classification == "benign", response.Riot:
+		return squyre.VerdictBenign, 0
+	case response.Noise:
+		return squyre.VerdictSuspicious, 40
+	default:
+		return squyre.VerdictUnknown, 0
+	}
+}
+
+func tagsFromResponse(response greynoiseResponse) []string {
+	var tags []string
+	if response.Noise {
+		tags = append(tags, "noise")
+	}
+	if response.Riot {
+		tags = append(tags, "riot")
+	}
+	if response.Name != "" && response.Name != "unknown" {
+		tags = append(tags, response.Name)
+	}
+	return tags
+}
+
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
+	Cache = squyre.CacheFromEnv()
 	lambda.Start(handleRequest)
 }
@@ -15,19 +15,17 @@ import (
 var (
 	mockResponse string
 	TestAlert    squyre.Alert
-	ctx          context.Context
+	ctx          = context.Background()
 )
 
 func mockInitClient() (*apiClient, error) {
 	return &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(time.Second*30, squyre.DefaultRetryPolicy),
 	}, nil
 }
 
-func mockIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
+func mockIPInfo(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
 	// 4.4.4.4 is bad, all other IPs good
 	var gnResp greynoiseResponse
 	if ipv4 == "4.4.4.4" {
@@ -59,6 +57,7 @@ func setup() {
 	GetIPInfo = mockIPInfo
 	InitClient = mockInitClient
 	OnlyLogMatches = false
+	Cache = nil
 	TestAlert = squyre.Alert{
 		RawMessage: "Testing",
 		ID:         "1234-1234",
@@ -83,6 +82,7 @@ func TestHandlerNonMatchNonIgnore(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	have := response.Results[0].Message
+	var responseObject greynoiseResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := messageFromResponse(responseObject)
 
@@ -129,6 +129,7 @@ func TestHandlerMatch(t *testing.T) {
 	json.Unmarshal([]byte(output), &response)
 
 	have := response.Results[0].Message
+	var responseObject greynoiseResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := messageFromResponse(responseObject)
 
@@ -162,3 +163,92 @@ func TestMultiSubject(t *testing.T) {
 		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
 	}
 }
+
+func TestHandlerVerdict(t *testing.T) {
+	setup()
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "4.4.4.4",
+		},
+		{
+			Type:  "ipv4",
+			Value: "8.8.8.8",
+		},
+	}
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var respAlert squyre.Alert
+	json.Unmarshal([]byte(output), &respAlert)
+
+	bad := respAlert.Results[0]
+	if bad.Verdict != squyre.VerdictMalicious || bad.Score != 90 {
+		t.Errorf("unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", bad.Verdict, bad.Score, squyre.VerdictMalicious, 90)
+	}
+	if len(bad.Tags) != 1 || bad.Tags[0] != "noise" {
+		t.Errorf("unexpected tags. \nHave: %v\nWant: %v", bad.Tags, []string{"noise"})
+	}
+	if len(bad.References) != 1 || bad.References[0] != "http://localhost" {
+		t.Errorf("unexpected references. \nHave: %v\nWant: %v", bad.References, []string{"http://localhost"})
+	}
+	if len(bad.Raw) == 0 {
+		t.Error("expected the raw response to be kept")
+	}
+
+	good := respAlert.Results[1]
+	if good.Verdict != squyre.VerdictUnknown || good.Score != 0 || good.Tags != nil {
+		t.Errorf("unexpected verdict. \nHave: %s (%d) %v\nWant: %s (%d)", good.Verdict, good.Score, good.Tags, squyre.VerdictUnknown, 0)
+	}
+}
+
+func TestVerdictFromResponse(t *testing.T) {
+	tests := []struct {
+		response greynoiseResponse
+		verdict  squyre.Verdict
+		score    int
+	}{
+		{greynoiseResponse{Classification: "malicious", Noise: true}, squyre.VerdictMalicious, 90},
+		{greynoiseResponse{Classification: "benign", Noise: true}, squyre.VerdictBenign, 0},
+		{greynoiseResponse{Riot: true}, squyre.VerdictBenign, 0},
+		{greynoiseResponse{Classification: "unknown", Noise: true}, squyre.VerdictSuspicious, 40},
+		{greynoiseResponse{}, squyre.VerdictUnknown, 0},
+	}
+
+	for _, test := range tests {
+		verdict, score := verdictFromResponse(test.response)
+		if verdict != test.verdict || score != test.score {
+			t.Errorf("unexpected verdict for %+v. \nHave: %s (%d)\nWant: %s (%d)", test.response, verdict, score, test.verdict, test.score)
+		}
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	setup()
+	Cache = squyre.NewResultCache(squyre.NewMemoryCache(), time.Hour)
+
+	lookups := 0
+	GetIPInfo = func(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
+		lookups++
+		return mockIPInfo(ctx, c, ipv4)
+	}
+
+	TestAlert.Subjects = []squyre.Subject{
+		{
+			Type:  "ipv4",
+			Value: "4.4.4.4",
+		},
+	}
+	handleRequest(ctx, TestAlert)
+	output, _ := handleRequest(ctx, TestAlert)
+
+	var respAlert squyre.Alert
+	json.Unmarshal([]byte(output), &respAlert)
+
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, got %d", lookups)
+	}
+	if !respAlert.Results[0].Cached || respAlert.Results[0].Verdict != squyre.VerdictMalicious {
+		t.Errorf("unexpected output. \nHave: %+v\nWant: a cached malicious result", respAlert.Results[0])
+	}
+}
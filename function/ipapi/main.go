@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,15 +17,16 @@ import (
 const (
 	provider       = "IP API"
 	baseURL        = "http://api.ipapi.com/"
-	supports       = "ipv4"
 	secretLocation = "IPAPI"
 )
 
 var (
 	// GetIPInfo abstracts this function to allow for tests
-	GetIPInfo      = getIPInfo
-	responseObject ipapiResponse
-	InitClient     = initIPAPIClient
+	GetIPInfo  = getIPInfo
+	InitClient = initIPAPIClient
+	supports   = squyre.SubjectTypes{"ipv4", "ipv6"}
+	// Cache holds results between runs, set up from env vars when the function starts
+	Cache *squyre.ResultCache
 )
 
 var template = `
@@ -42,7 +42,7 @@ type apiKeySecret struct {
 }
 
 type apiClient struct {
-	httpClient *http.Client
+	httpClient *squyre.HTTPClient
 	apiKey     string
 	baseURL    string
 }
@@ -63,35 +63,37 @@ type ipapiResponse struct {
 	CountryFlag             string `json:"country_flag"`
 	CountryFlagEmoji        string `json:"country_flag_emoji"`
 	CountryFlagEmojiUnicode string `json:"country_flag_emoji_unicode"`
-	calling_code            string `json:"calling_code"`
+	CallingCode             string `json:"calling_code"`
 	IsEu                    bool   `json:"is_eu"`
+	Error                   struct {
+		Code int    `json:"code"`
+		Type string `json:"type"`
+		Info string `json:"info"`
+	} `json:"error"`
 }
 
 func initIPAPIClient() (*apiClient, error) {
-	// Fetch API key from Secrets Manager
-	smresponse, err := squyre.GetSecret(secretLocation)
-	if err != nil {
+	// Fetch API key from the secret provider
+	var secret apiKeySecret
+	if err := squyre.FetchSecretJSON(secretLocation, &secret, "apikey"); err != nil {
 		log.Errorf("Failed to fetch %s secret: %s", provider, err)
+		return nil, err
 	}
 
-	var secret apiKeySecret
-	json.Unmarshal([]byte(*smresponse.SecretString), &secret)
-
 	client := &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
-		apiKey: secret.ApiKey,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(squyre.DefaultRequestTimeout, squyre.DefaultRetryPolicy),
+		apiKey:     secret.ApiKey,
 	}
 
 	return client, nil
 }
 
-func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
-	request, err := http.NewRequest(
+func getIPInfo(ctx context.Context, c *apiClient, ip string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
-		fmt.Sprintf("%s/%s?access_key=%s", c.baseURL, ipv4, c.apiKey),
+		fmt.Sprintf("%s/%s?access_key=%s", c.baseURL, ip, c.apiKey),
 		nil,
 	)
 	if err != nil {
@@ -100,67 +102,58 @@ func getIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
 	return c.httpClient.Do(request)
 }
 
-func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
-	log.Infof("Starting %s run for alert %s", provider, alert.ID)
+type enricher struct {
+	squyre.SubjectTypes
+	client *apiClient
+}
 
-	if len(alert.Subjects) == 0 {
-		log.Info("Alert has no subjects to process.")
-		finalJSON, _ := json.Marshal(alert)
-		return string(finalJSON), nil
+func newEnricher() (squyre.Enricher, error) {
+	client, err := InitClient()
+	if err != nil {
+		return nil, err
 	}
+	return &enricher{SubjectTypes: supports, client: client}, nil
+}
 
-	client, err := InitClient()
+// Enrich looks up the location of an IP address on IP API
+func (e *enricher) Enrich(ctx context.Context, subject squyre.Subject) (squyre.Result, error) {
+	var result squyre.Result
+
+	response, err := GetIPInfo(ctx, e.client, subject.Value)
 	if err != nil {
-		return "Failed to initialise client", err
+		return result, err
 	}
+	defer response.Body.Close()
 
-	// Process each subject in the alert we were passed
-	for _, subject := range alert.Subjects {
-		if strings.Contains(supports, subject.Type) {
-
-			// Build a result object to hold our goodies
-			var result = squyre.Result{
-				Source:         provider,
-				AttributeValue: subject.Value,
-				MatchFound:     false,
-				Success:        false,
-			}
-
-			response, err := GetIPInfo(client, subject.Value)
-
-			if err != nil {
-				log.Errorf("Failed to fetch data from %s", provider)
-				result.Success = false
-				result.Message = err.Error()
-				alert.Results = append(alert.Results, result)
-			} else {
-				result.Success = true
-				responseData, err := ioutil.ReadAll(response.Body)
-
-				if err == nil {
-					log.Infof("Received %s response for %s", provider, subject.Value)
-
-					json.Unmarshal(responseData, &responseObject)
-
-					result.Success = true
-					result.Message = messageFromResponse(responseObject)
-				} else {
-					log.Errorf("Unexpected response from %s for %s", provider, subject.Value)
-					return "Error decoding response from API!", err
-				}
-				// Add the enriched details back to the results
-				alert.Results = append(alert.Results, result)
-				log.Infof("Added %s to result set", subject.Value)
-			}
-		} else {
-			log.Info("Subject not supported by this provider. Skipping.")
-		}
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return result, fmt.Errorf("error decoding response from API: %w", err)
+	}
+	log.Infof("Received %s response for %s", provider, subject.Value)
+
+	var responseObject ipapiResponse
+	json.Unmarshal(responseData, &responseObject)
+
+	// IP API reports errors, like running out of requests, in the body of a 200 response
+	if responseObject.Error.Type != "" {
+		return result, fmt.Errorf("%s error %d (%s): %s", provider, responseObject.Error.Code, responseObject.Error.Type, responseObject.Error.Info)
 	}
-	log.Infof("Successfully ran %s. Yielded %d results for %d subjects.", provider, len(alert.Results), len(alert.Subjects))
 
-	// Convert the alert object into Json for the step function
-	finalJSON, _ := json.Marshal(alert)
-	return string(finalJSON), nil
+	result.Message = messageFromResponse(responseObject)
+	// Geolocation is context rather than reputation, so there's no verdict to give
+	result.Tags = tagsFromResponse(responseObject)
+	result.Raw = squyre.RawPayload(responseData)
+
+	return result, nil
+}
+
+func handleRequest(ctx context.Context, alert squyre.Alert) (string, error) {
+	harness := squyre.EnrichmentHarness{
+		Provider:    provider,
+		NewEnricher: newEnricher,
+		Cache:       Cache,
+	}
+	return harness.HandleRequest(ctx, alert)
 }
 
 func messageFromResponse(response ipapiResponse) string {
@@ -174,8 +167,22 @@ func messageFromResponse(response ipapiResponse) string {
 	return string(message)
 }
 
+func tagsFromResponse(response ipapiResponse) []string {
+	var tags []string
+	for _, tag := range []string{response.CountryCode, response.ContinentName} {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if response.IsEu {
+		tags = append(tags, "EU")
+	}
+	return tags
+}
+
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
+	Cache = squyre.CacheFromEnv()
 	lambda.Start(handleRequest)
 }
@@ -18,15 +18,13 @@ var (
 
 func mockInitClient() (*apiClient, error) {
 	return &apiClient{
-		baseURL: strings.TrimSuffix(baseURL, "/"),
-		httpClient: &http.Client{
-			Timeout: time.Second * 30,
-		},
-		apiKey: "secret!",
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: squyre.NewHTTPClient(time.Second*30, squyre.DefaultRetryPolicy),
+		apiKey:     "secret!",
 	}, nil
 }
 
-func mockIPInfo(c *apiClient, ipv4 string) (*http.Response, error) {
+func mockIPInfo(ctx context.Context, c *apiClient, ipv4 string) (*http.Response, error) {
 	return &http.Response{
 		Body: ioutil.NopCloser(bytes.NewReader([]byte(mockResponse))),
 	}, nil
@@ -54,7 +52,7 @@ func TestHandlerSuccess(t *testing.T) {
 			Value: "8.8.8.8",
 		},
 	}
-	var ctx context.Context
+	ctx := context.Background()
 	mockResponse = `{"ip":"8.8.8.8", "city":"Okayville", "country_name":"Atlantis"}`
 
 	output, _ := handleRequest(ctx, alert)
@@ -64,6 +62,7 @@ func TestHandlerSuccess(t *testing.T) {
 
 	have := response.Results[0].Message
 
+	var responseObject ipapiResponse
 	json.Unmarshal([]byte(mockResponse), &responseObject)
 	want := messageFromResponse(responseObject)
 
@@ -71,3 +70,65 @@ func TestHandlerSuccess(t *testing.T) {
 		t.Errorf("Expected '%s', got '%s'", want, have)
 	}
 }
+
+func TestHandlerVerdict(t *testing.T) {
+	setup()
+
+	alert := squyre.Alert{
+		ID: "1234-1234",
+		Subjects: []squyre.Subject{
+			{
+				Type:  "ipv4",
+				Value: "8.8.8.8",
+			},
+		},
+	}
+	ctx := context.Background()
+	mockResponse = `{"ip":"8.8.8.8", "city":"Okayville", "country_code":"AT", "country_name":"Atlantis", "continent_name":"Europe", "is_eu":true}`
+
+	output, _ := handleRequest(ctx, alert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	result := response.Results[0]
+	if result.Verdict != squyre.VerdictUnknown || result.Score != 0 {
+		t.Errorf("Unexpected verdict. \nHave: %s (%d)\nWant: %s (%d)", result.Verdict, result.Score, squyre.VerdictUnknown, 0)
+	}
+
+	have := strings.Join(result.Tags, ",")
+	want := "AT,Europe,EU"
+	if have != want {
+		t.Errorf("Unexpected tags. \nHave: %s\nWant: %s", have, want)
+	}
+	if len(result.Raw) == 0 {
+		t.Error("Expected the raw response to be kept")
+	}
+}
+
+func TestHandlerErrorResponse(t *testing.T) {
+	setup()
+
+	alert := squyre.Alert{
+		ID: "1234-1234",
+		Subjects: []squyre.Subject{
+			{
+				Type:  "ipv4",
+				Value: "8.8.8.8",
+			},
+		},
+	}
+	ctx := context.Background()
+	mockResponse = `{"success":false,"error":{"code":104,"type":"usage_limit_reached","info":"Your monthly usage limit has been reached."}}`
+
+	output, _ := handleRequest(ctx, alert)
+
+	var response squyre.Alert
+	json.Unmarshal([]byte(output), &response)
+
+	result := response.Results[0]
+	want := "IP API error 104 (usage_limit_reached): Your monthly usage limit has been reached."
+	if result.Success || result.Message != want {
+		t.Errorf("Unexpected output. \nHave: %s (success %t)\nWant: %s", result.Message, result.Success, want)
+	}
+}
@@ -5,12 +5,12 @@ go 1.17
 require (
 	github.com/andygrunwald/go-jira v1.16.0
 	github.com/aws/aws-lambda-go v1.41.0
-	github.com/aws/aws-sdk-go v1.45.11
 	github.com/gyrospectre/squyre/pkg/squyre v0.0.0-20230227215344-4cf93284e6cd
 	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
+	github.com/aws/aws-sdk-go v1.45.11 // indirect
 	github.com/fatih/structs v1.1.0 // indirect
 	github.com/golang-jwt/jwt/v4 v4.5.2 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
@@ -19,3 +19,5 @@ require (
 	github.com/trivago/tgo v1.0.7 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 )
+
+replace github.com/gyrospectre/squyre/pkg/squyre => ../../pkg/squyre
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"sort"
@@ -70,18 +69,15 @@ func AddJiraComment(client *jira.Client, ticket string, rawComment string) error
 	return err
 }
 
-// InitJiraClient initialises a Jira client using credentials from AWS Secrets Manager
+// InitJiraClient initialises a Jira client using credentials from the secret provider
 func InitJiraClient() (*jira.Client, error) {
-	// Fetch API key from Secrets Manager
-	smresponse, err := squyre.GetSecret(secretLocation)
-	if err != nil {
-		log.Error("Failed to fetch Jira secret")
+	// Fetch API key from the secret provider
+	var secret apiKeySecret
+	if err := squyre.FetchSecretJSON(secretLocation, &secret, "user", "apikey"); err != nil {
+		log.Errorf("Failed to fetch Jira secret: %s", err)
 		return nil, err
 	}
 
-	var secret apiKeySecret
-	json.Unmarshal([]byte(*smresponse.SecretString), &secret)
-
 	// Connect to Jira Cloud
 	tp := jira.BasicAuthTransport{
 		Username: secret.User,
@@ -104,7 +100,14 @@ func handleRequest(ctx context.Context, rawAlerts [][]string) (string, error) {
 	}
 
 	// We have separate alerts by source, combine them first to prevent creating duplicate tickets
-	mergedAlerts := squyre.CombineResultsbyAlertID(rawAlerts)
+	mergedAlerts, err := squyre.MergeAlerts(rawAlerts)
+	if err != nil {
+		// Carry on with the alerts we could read, which note the missing results
+		log.Errorf("Failed to merge some enrichment results: %s", err)
+		if len(mergedAlerts) == 0 {
+			return "Failed to read enrichment results", err
+		}
+	}
 	log.Infof("Merged alerts. Was %d result groups, now %d individual results.", len(rawAlerts), len(mergedAlerts))
 
 	// Process enrichment result list
@@ -133,15 +136,23 @@ func handleRequest(ctx context.Context, rawAlerts [][]string) (string, error) {
 
 		log.Infof("Sending results of enrichment to %s", ticketnumber)
 
+		if note := alert.TruncationNote(); note != "" {
+			err = AddComment(jiraClient, ticketnumber, note)
+			if err != nil {
+				log.Errorf("Failed to add comment to ticket %s", ticketnumber)
+				return "Failed to add comment to ticket", err
+			}
+		}
+
 		for _, result := range alert.Results {
 			if result.Success {
-				err = AddComment(jiraClient, ticketnumber, fmt.Sprintf("Additional information on %s from %s:\n\n%s", result.AttributeValue, result.Source, result.Message))
+				err = AddComment(jiraClient, ticketnumber, alert.DefangText(fmt.Sprintf("Additional information on %s from %s:\n\n%s", alert.Describe(result.AttributeValue), result.Source, result.Message)))
 				if err != nil {
 					log.Errorf("Failed to add comment to ticket %s", ticketnumber)
 					return "Failed to add comment to ticket", err
 				}
 			} else {
-				err = AddComment(jiraClient, ticketnumber, fmt.Sprintf("Error looking up %s on %s!\nError: %s", result.AttributeValue, result.Source, result.Message))
+				err = AddComment(jiraClient, ticketnumber, alert.DefangText(fmt.Sprintf("Error looking up %s on %s!\nError: %s", alert.Describe(result.AttributeValue), result.Source, result.Message)))
 				if err != nil {
 					log.Errorf("Failed to add comment to ticket %s", ticketnumber)
 					return "Failed to add comment to ticket", err
@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/andygrunwald/go-jira"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/gyrospectre/squyre/pkg/squyre"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +17,7 @@ var (
 	MockTicket  int
 	Ctx         context.Context
 	LastComment string
+	Comments    []string
 )
 
 func setup() {
@@ -29,17 +31,24 @@ func setup() {
 
 	// Reset fake ticket number count
 	MockTicket = 1
+
+	// Forget comments from earlier tests
+	Comments = nil
 }
 
 func mockInitClient() (*jira.Client, error) {
 	return &jira.Client{}, nil
 }
 
-func mockGetSecret(location string) (secretsmanager.GetSecretValueOutput, error) {
-	secret := `{"user":"test","apikey": "test123"}`
-	return secretsmanager.GetSecretValueOutput{
-		SecretString: &secret,
-	}, nil
+// mockSecrets is a secret provider holding secrets in memory
+type mockSecrets map[string]string
+
+func (m mockSecrets) Fetch(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", &squyre.SecretError{Name: name, Provider: "Mock", Err: squyre.ErrSecretNotFound}
+	}
+	return value, nil
 }
 
 func mockCreateTicketForAlert(client *jira.Client, alert squyre.Alert) (string, error) {
@@ -50,6 +59,7 @@ func mockCreateTicketForAlert(client *jira.Client, alert squyre.Alert) (string,
 
 func mockAddComment(client *jira.Client, ticket string, rawComment string) error {
 	LastComment = rawComment
+	Comments = append(Comments, rawComment)
 	return nil
 }
 
@@ -203,3 +213,101 @@ func TestHandlerSuccessFailedLookup(t *testing.T) {
 		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
 	}
 }
+
+func TestHandlerDefangedSubject(t *testing.T) {
+	setup()
+
+	alert := squyre.Alert{
+		ID: "EXISTING-1",
+		Subjects: []squyre.Subject{
+			{
+				Type:     "ipv4",
+				Value:    "127.0.0.1",
+				Defanged: true,
+			},
+		},
+		Results: []squyre.Result{
+			{
+				Source:         "Gyro",
+				AttributeValue: "127.0.0.1",
+				Message:        "127.0.0.1 is bad",
+				Success:        true,
+			},
+		},
+	}
+	alertJSON, _ := json.Marshal(alert)
+
+	_, err := handleRequest(Ctx, [][]string{{string(alertJSON)}})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	have := LastComment
+	want := "Additional information on 127[.]0[.]0[.]1 from Gyro:\n\n127[.]0[.]0[.]1 is bad"
+
+	if have != want {
+		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestHandlerTruncatedSubjects(t *testing.T) {
+	setup()
+
+	alert := squyre.Alert{
+		ID:        "1",
+		Truncated: 3,
+		Results: []squyre.Result{
+			{
+				Source:         "Gyro",
+				AttributeValue: "127.0.0.1",
+				Message:        "Test",
+				Success:        true,
+			},
+		},
+	}
+	alertJSON, _ := json.Marshal(alert)
+
+	_, err := handleRequest(Ctx, [][]string{{string(alertJSON)}})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(Comments) != 2 || Comments[0] != alert.TruncationNote() {
+		t.Fatalf("Unexpected comments: %v", Comments)
+	}
+}
+
+func TestInitJiraClient(t *testing.T) {
+	defer func() { squyre.Secrets = nil }()
+
+	squyre.Secrets = mockSecrets{secretLocation: `{"user": "test", "apikey": "test123"}`}
+	if _, err := InitJiraClient(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	squyre.Secrets = mockSecrets{secretLocation: `{"apikey": "test123"}`}
+	if _, err := InitJiraClient(); !errors.Is(err, squyre.ErrSecretMalformed) {
+		t.Errorf("Expected a malformed secret error, got %v", err)
+	}
+}
+
+func TestHandlerUnreadableResults(t *testing.T) {
+	setup()
+
+	alerts, _ := makeTestAlerts(1, 1, "EXISTING-", true, true, true)
+	alerts = append(alerts, []string{"{not json"})
+
+	_, err := handleRequest(Ctx, alerts)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// The readable results are still sent, followed by a note about the rest
+	if len(Comments) != 2 || !strings.HasPrefix(LastComment, "Error looking up enrichment results on Squyre!") {
+		t.Errorf("Unexpected comments %v", Comments)
+	}
+
+	// With nothing to send, the output fails
+	if _, err := handleRequest(Ctx, [][]string{{"{not json"}}); err == nil {
+		t.Error("Expected an error when no results could be read")
+	}
+}
@@ -4,14 +4,14 @@ go 1.17
 
 require (
 	github.com/aws/aws-lambda-go v1.41.0
-	github.com/aws/aws-sdk-go v1.45.11
 	github.com/gyrospectre/squyre/pkg/squyre v0.0.0-20230227215344-4cf93284e6cd
 	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
+	github.com/aws/aws-sdk-go v1.45.11 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/stretchr/testify v1.7.2 // indirect
 	golang.org/x/sys v0.12.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/gyrospectre/squyre/pkg/squyre => ../../pkg/squyre
@@ -57,15 +57,14 @@ func (opsgenie *OpsGenieClient) Post(url, contentType string, body io.Reader) (r
 	return opsgenie.client.Do(req)
 }
 
-// InitOpsgenieClient initialises an Opsgenie client using credentials from AWS Secrets Manager
+// InitOpsgenieClient initialises an Opsgenie client using credentials from the secret provider
 func InitOpsgenieClient() (*OpsGenieClient, error) {
-	// Fetch API key from Secrets Manager
-	smresponse, err := squyre.GetSecret(secretLocation)
-	if err != nil {
+	// Fetch API key from the secret provider
+	var secret apiKeySecret
+	if err := squyre.FetchSecretJSON(secretLocation, &secret, "apikey"); err != nil {
 		log.Errorf("Failed to fetch OpsGenie secret: %s", err)
+		return nil, err
 	}
-	var secret apiKeySecret
-	json.Unmarshal([]byte(*smresponse.SecretString), &secret)
 
 	return &OpsGenieClient{
 		client:   &http.Client{},
@@ -103,7 +102,14 @@ func handleRequest(ctx context.Context, rawAlerts [][]string) (string, error) {
 	}
 
 	// We have separate alerts by source, combine them first to prevent creating duplicate tickets
-	mergedAlerts := squyre.CombineResultsbyAlertID(rawAlerts)
+	mergedAlerts, err := squyre.MergeAlerts(rawAlerts)
+	if err != nil {
+		// Carry on with the alerts we could read, which note the missing results
+		log.Errorf("Failed to merge some enrichment results: %s", err)
+		if len(mergedAlerts) == 0 {
+			return "Failed to read enrichment results", err
+		}
+	}
 	log.Infof("Merged alerts. Was %d result groups, now %d individual results.", len(rawAlerts), len(mergedAlerts))
 
 	var alerts []string
@@ -116,12 +122,26 @@ func handleRequest(ctx context.Context, rawAlerts [][]string) (string, error) {
 
 		log.Infof("Sending results of enrichment for alert %s", alert.ID)
 
+		if truncation := alert.TruncationNote(); truncation != "" {
+			note := &opsgenieNote{
+				User:   "Squyre",
+				Source: "Squyre",
+				Note:   truncation,
+			}
+
+			err := AddComment(client, note, alert.ID)
+			if err != nil {
+				log.Errorf("Failed to add comment to alert '%s'", alert.ID)
+				return "Failed to add comment to alert", err
+			}
+		}
+
 		for _, result := range alert.Results {
 			if result.Success {
 				note := &opsgenieNote{
 					User:   "Squyre",
 					Source: result.Source,
-					Note:   fmt.Sprintf("Additional information on %s from %s:\n\n%s", result.AttributeValue, result.Source, result.Message),
+					Note:   alert.DefangText(fmt.Sprintf("Additional information on %s from %s:\n\n%s", alert.Describe(result.AttributeValue), result.Source, result.Message)),
 				}
 
 				err := AddComment(client, note, alert.ID)
@@ -133,7 +153,7 @@ func handleRequest(ctx context.Context, rawAlerts [][]string) (string, error) {
 				note := &opsgenieNote{
 					User:   "Squyre",
 					Source: result.Source,
-					Note:   fmt.Sprintf("Error looking up %s on %s!\nError: %s", result.AttributeValue, result.Source, result.Message),
+					Note:   alert.DefangText(fmt.Sprintf("Error looking up %s on %s!\nError: %s", alert.Describe(result.AttributeValue), result.Source, result.Message)),
 				}
 
 				err := AddComment(client, note, alert.ID)
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/gyrospectre/squyre/pkg/squyre"
 	"sort"
 	"testing"
@@ -15,6 +15,7 @@ var (
 	MockTicket  int
 	Ctx         context.Context
 	LastComment string
+	Comments    []string
 )
 
 func setup() {
@@ -24,21 +25,29 @@ func setup() {
 
 	// Reset fake ticket number count
 	MockTicket = 1
+
+	// Forget comments from earlier tests
+	Comments = nil
 }
 
 func mockInitClient() (*OpsGenieClient, error) {
 	return &OpsGenieClient{}, nil
 }
 
-func mockGetSecret(location string) (secretsmanager.GetSecretValueOutput, error) {
-	secret := `{"user":"test","apikey": "test123"}`
-	return secretsmanager.GetSecretValueOutput{
-		SecretString: &secret,
-	}, nil
+// mockSecrets is a secret provider holding secrets in memory
+type mockSecrets map[string]string
+
+func (m mockSecrets) Fetch(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", &squyre.SecretError{Name: name, Provider: "Mock", Err: squyre.ErrSecretNotFound}
+	}
+	return value, nil
 }
 
 func mockAddComment(client *OpsGenieClient, note *opsgenieNote, id string) error {
 	LastComment = note.Note
+	Comments = append(Comments, note.Note)
 	return nil
 }
 
@@ -168,3 +177,59 @@ func TestHandlerSuccessFailedLookup(t *testing.T) {
 		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
 	}
 }
+
+func TestHandlerTruncatedSubjects(t *testing.T) {
+	setup()
+
+	alert := squyre.Alert{
+		ID:        "1",
+		Truncated: 3,
+		Results: []squyre.Result{
+			{
+				Source:         "Gyro",
+				AttributeValue: "127.0.0.1",
+				Message:        "Test",
+				Success:        true,
+			},
+		},
+	}
+	alertJSON, _ := json.Marshal(alert)
+
+	_, err := handleRequest(Ctx, [][]string{{string(alertJSON)}})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if len(Comments) != 2 || Comments[0] != alert.TruncationNote() {
+		t.Fatalf("Unexpected comments: %v", Comments)
+	}
+}
+
+func TestInitOpsgenieClient(t *testing.T) {
+	defer func() { squyre.Secrets = nil }()
+
+	squyre.Secrets = mockSecrets{secretLocation: `{"apikey": "test123"}`}
+	client, err := InitOpsgenieClient()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if client.apiToken != "test123" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", client.apiToken, "test123")
+	}
+
+	// Missing and malformed secrets are errors, rather than a client with no key
+	tests := []struct {
+		secrets mockSecrets
+		want    error
+	}{
+		{mockSecrets{}, squyre.ErrSecretNotFound},
+		{mockSecrets{secretLocation: `{"user": "test"}`}, squyre.ErrSecretMalformed},
+		{mockSecrets{secretLocation: "test123"}, squyre.ErrSecretMalformed},
+	}
+	for _, test := range tests {
+		squyre.Secrets = test.secrets
+		if _, err := InitOpsgenieClient(); !errors.Is(err, test.want) {
+			t.Errorf("Unexpected error. \nHave: %v\nWant: %v", err, test.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package squyre
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheEntry is an enrichment result stored in a cache
+type CacheEntry struct {
+	Result  Result
+	Stored  time.Time // When the result was looked up
+	Expires time.Time // When the result should no longer be used
+}
+
+// Expired reports whether the entry is past its expiry time
+func (e CacheEntry) Expired() bool {
+	return !time.Now().Before(e.Expires)
+}
+
+// CacheBackend stores cached enrichment results
+type CacheBackend interface {
+	// Get returns the entry stored under the key, or nil if there isn't one that has yet to expire
+	Get(key string) (*CacheEntry, error)
+	// Put stores an entry under the key, replacing any already there
+	Put(key string, entry CacheEntry) error
+}
+
+// CacheKey builds the key a result is cached under, from the service it came from and the subject looked up
+func CacheKey(provider string, subject Subject) string {
+	return strings.Join([]string{provider, subject.Type, subject.Value}, "|")
+}
+
+// ResultCache caches enrichment results, so that subjects seen in many alerts aren't looked up every time
+type ResultCache struct {
+	Backend    CacheBackend
+	DefaultTTL time.Duration            // How long to keep results for, unless set for the provider in TTLs
+	TTLs       map[string]time.Duration // How long to keep results for, by provider. Zero means don't cache.
+}
+
+// NewResultCache creates a cache which keeps results for the default TTL
+func NewResultCache(backend CacheBackend, defaultTTL time.Duration) *ResultCache {
+	return &ResultCache{
+		Backend:    backend,
+		DefaultTTL: defaultTTL,
+		TTLs:       make(map[string]time.Duration),
+	}
+}
+
+// TTL returns how long results from the provider are kept for
+func (c *ResultCache) TTL(provider string) time.Duration {
+	if ttl, ok := c.TTLs[provider]; ok {
+		return ttl
+	}
+	return c.DefaultTTL
+}
+
+// Get returns the cached result for a subject, marked with how old it is. A nil cache never has results.
+func (c *ResultCache) Get(provider string, subject Subject) (Result, bool) {
+	if c == nil || c.TTL(provider) <= 0 {
+		return Result{}, false
+	}
+
+	entry, err := c.Backend.Get(CacheKey(provider, subject))
+	if err != nil {
+		log.Warnf("Failed to read %s result for %s from cache: %s", provider, subject.Value, err)
+		return Result{}, false
+	}
+	if entry == nil || entry.Expired() {
+		return Result{}, false
+	}
+
+	result := entry.Result
+	result.Cached = true
+	result.CacheAge = int(time.Since(entry.Stored).Seconds())
+	return result, true
+}
+
+// Put caches a result for a subject. Failed lookups aren't cached, so they are tried again next time.
+func (c *ResultCache) Put(provider string, subject Subject, result Result) {
+	if c == nil || c.TTL(provider) <= 0 || !result.Success || result.Cached {
+		return
+	}
+
+	now := time.Now()
+	entry := CacheEntry{
+		Result:  result,
+		Stored:  now,
+		Expires: now.Add(c.TTL(provider)),
+	}
+	if err := c.Backend.Put(CacheKey(provider, subject), entry); err != nil {
+		log.Warnf("Failed to write %s result for %s to cache: %s", provider, subject.Value, err)
+	}
+}
+
+// MemoryCache keeps results in memory. In Lambda, this lasts as long as the execution environment is reused.
+type MemoryCache struct {
+	MaxEntries int // The most results to keep. When full, expired results are dropped to make room.
+
+	mu      sync.Mutex
+	entries map[string]CacheEntry
+}
+
+// DefaultMaxMemoryEntries is how many results a MemoryCache keeps, unless it's changed
+const DefaultMaxMemoryEntries = 10000
+
+// NewMemoryCache creates an empty in-memory cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		MaxEntries: DefaultMaxMemoryEntries,
+		entries:    make(map[string]CacheEntry),
+	}
+}
+
+// Get returns the entry stored under the key
+func (m *MemoryCache) Get(key string) (*CacheEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if entry.Expired() {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// Put stores an entry under the key
+func (m *MemoryCache) Put(key string, entry CacheEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.MaxEntries {
+		for existing, stored := range m.entries {
+			if stored.Expired() {
+				delete(m.entries, existing)
+			}
+		}
+		if len(m.entries) >= m.MaxEntries {
+			return fmt.Errorf("memory cache is full (%d entries)", m.MaxEntries)
+		}
+	}
+	m.entries[key] = entry
+	return nil
+}
+
+// FileCache keeps results as JSON files in a directory, one per key. Useful when running locally, e.g. with sam local.
+type FileCache struct {
+	Dir string
+}
+
+// NewFileCache creates a cache in the directory, creating it if needed
+func NewFileCache(dir string) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileCache{Dir: dir}, nil
+}
+
+// path names files after a hash of the key, as subject values aren't safe to use in file names
+func (f *FileCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(f.Dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// Get returns the entry stored under the key
+func (f *FileCache) Get(key string) (*CacheEntry, error) {
+	data, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("corrupt cache file %s: %w", f.path(key), err)
+	}
+	if entry.Expired() {
+		os.Remove(f.path(key))
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// Put stores an entry under the key. The file is written under a temporary name first, so a reader never sees
+// half an entry.
+func (f *FileCache) Put(key string, entry CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(f.Dir, "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), f.path(key))
+}
+
+// DefaultCacheTTL is how long results are cached for, unless set by the CACHE_TTL env var
+const DefaultCacheTTL = 6 * time.Hour
+
+// CacheFromEnv sets up the result cache from env vars, returning nil if caching is turned off or can't be set up.
+//   - CACHE_BACKEND: memory, file or dynamodb. Caching is off if not set.
+//   - CACHE_PATH: the directory for the file backend. Defaults to a folder in /tmp, the only writable path in Lambda.
+//   - CACHE_TABLE: the DynamoDB table for the dynamodb backend
+//   - CACHE_TTL: how long to keep results for e.g. '12h'
+//   - CACHE_TTLS: how long to keep results from particular providers for e.g. 'GreyNoise=24h,IP API=168h'
+func CacheFromEnv() *ResultCache {
+	var (
+		backend CacheBackend
+		err     error
+	)
+
+	switch kind := strings.ToLower(os.Getenv("CACHE_BACKEND")); kind {
+	case "", "none":
+		return nil
+	case "memory":
+		backend = NewMemoryCache()
+	case "file":
+		dir := os.Getenv("CACHE_PATH")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "squyre-cache")
+		}
+		backend, err = NewFileCache(dir)
+	case "dynamodb":
+		backend, err = NewDynamoDBCache(os.Getenv("CACHE_TABLE"))
+	default:
+		err = fmt.Errorf("unknown backend '%s'", kind)
+	}
+	if err != nil {
+		log.Errorf("Failed to set up result cache, continuing without it: %s", err)
+		return nil
+	}
+
+	cache := NewResultCache(backend, DefaultCacheTTL)
+	if ttl := os.Getenv("CACHE_TTL"); ttl != "" {
+		if cache.DefaultTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Errorf("Invalid CACHE_TTL '%s', using %s: %s", ttl, DefaultCacheTTL, err)
+			cache.DefaultTTL = DefaultCacheTTL
+		}
+	}
+	if cache.TTLs, err = parseTTLs(os.Getenv("CACHE_TTLS")); err != nil {
+		log.Errorf("Invalid CACHE_TTLS, ignoring them: %s", err)
+		cache.TTLs = make(map[string]time.Duration)
+	}
+
+	return cache
+}
+
+// parseTTLs parses a list of provider TTLs e.g. 'GreyNoise=24h,IP API=168h'
+func parseTTLs(value string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected provider=duration, got '%s'", pair)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		ttls[strings.TrimSpace(parts[0])] = ttl
+	}
+	return ttls, nil
+}
@@ -0,0 +1,242 @@
+package squyre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var cacheSubject = Subject{Type: "ipv4", Value: "4.4.4.4"}
+
+func makeCacheResult() Result {
+	return Result{
+		Source:         "Mock",
+		AttributeValue: "4.4.4.4",
+		Message:        "Bad!",
+		Success:        true,
+		MatchFound:     true,
+		Verdict:        VerdictMalicious,
+		Score:          90,
+		Tags:           []string{"scanner"},
+		Raw:            []byte(`{"ip":"4.4.4.4"}`),
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	cache := NewResultCache(NewMemoryCache(), time.Hour)
+
+	if _, ok := cache.Get("Mock", cacheSubject); ok {
+		t.Fatal("Expected an empty cache")
+	}
+
+	cache.Put("Mock", cacheSubject, makeCacheResult())
+
+	have, ok := cache.Get("Mock", cacheSubject)
+	if !ok {
+		t.Fatal("Expected a cached result")
+	}
+	want := makeCacheResult()
+	want.Cached = true
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+
+	// Results are cached per provider and subject type
+	if _, ok := cache.Get("Other", cacheSubject); ok {
+		t.Error("Expected no result for another provider")
+	}
+	if _, ok := cache.Get("Mock", Subject{Type: "domain", Value: "4.4.4.4"}); ok {
+		t.Error("Expected no result for another subject type")
+	}
+}
+
+func TestResultCacheSkipsFailures(t *testing.T) {
+	cache := NewResultCache(NewMemoryCache(), time.Hour)
+
+	failed := makeCacheResult()
+	failed.Success = false
+	cache.Put("Mock", cacheSubject, failed)
+
+	if _, ok := cache.Get("Mock", cacheSubject); ok {
+		t.Error("Expected failed lookups not to be cached")
+	}
+}
+
+func TestResultCacheTTLs(t *testing.T) {
+	backend := NewMemoryCache()
+	cache := NewResultCache(backend, time.Hour)
+	cache.TTLs["Never"] = 0
+	cache.TTLs["Short"] = time.Minute
+
+	cache.Put("Never", cacheSubject, makeCacheResult())
+	if _, ok := cache.Get("Never", cacheSubject); ok {
+		t.Error("Expected a zero TTL to turn off caching")
+	}
+
+	cache.Put("Short", cacheSubject, makeCacheResult())
+	entry, _ := backend.Get(CacheKey("Short", cacheSubject))
+	if entry == nil || entry.Expires.Sub(entry.Stored) != time.Minute {
+		t.Errorf("Expected the provider TTL to be used, got %v", entry)
+	}
+}
+
+func TestResultCacheAge(t *testing.T) {
+	backend := NewMemoryCache()
+	cache := NewResultCache(backend, time.Hour)
+
+	backend.Put(CacheKey("Mock", cacheSubject), CacheEntry{
+		Result:  makeCacheResult(),
+		Stored:  time.Now().Add(-90 * time.Second),
+		Expires: time.Now().Add(time.Hour),
+	})
+
+	have, ok := cache.Get("Mock", cacheSubject)
+	if !ok || have.CacheAge < 90 || have.CacheAge > 95 {
+		t.Errorf("Expected a result around 90 seconds old, got %d", have.CacheAge)
+	}
+
+	backend.Put(CacheKey("Mock", cacheSubject), CacheEntry{
+		Result:  makeCacheResult(),
+		Stored:  time.Now().Add(-2 * time.Hour),
+		Expires: time.Now().Add(-time.Hour),
+	})
+	if _, ok := cache.Get("Mock", cacheSubject); ok {
+		t.Error("Expected an expired result to be ignored")
+	}
+}
+
+func TestNilResultCache(t *testing.T) {
+	var cache *ResultCache
+
+	cache.Put("Mock", cacheSubject, makeCacheResult())
+	if _, ok := cache.Get("Mock", cacheSubject); ok {
+		t.Error("Expected a nil cache to have no results")
+	}
+}
+
+func TestMemoryCacheFull(t *testing.T) {
+	backend := NewMemoryCache()
+	backend.MaxEntries = 1
+
+	expired := CacheEntry{Expires: time.Now().Add(-time.Minute)}
+	fresh := CacheEntry{Expires: time.Now().Add(time.Minute)}
+
+	if err := backend.Put("a", expired); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// The expired entry makes room
+	if err := backend.Put("b", fresh); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := backend.Put("c", fresh); err == nil {
+		t.Error("Expected an error when the cache is full")
+	}
+	// Replacing an entry is always allowed
+	if err := backend.Put("b", fresh); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	backend, err := NewFileCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	cache := NewResultCache(backend, time.Hour)
+
+	cache.Put("Mock", Subject{Type: "url", Value: "https://evil.com/../../etc/passwd"}, makeCacheResult())
+
+	have, ok := cache.Get("Mock", Subject{Type: "url", Value: "https://evil.com/../../etc/passwd"})
+	if !ok {
+		t.Fatal("Expected a cached result")
+	}
+	want := makeCacheResult()
+	want.Cached = true
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected a single cache file, got %d", len(files))
+	}
+}
+
+func TestFileCacheExpiry(t *testing.T) {
+	backend, _ := NewFileCache(t.TempDir())
+
+	backend.Put("a", CacheEntry{Expires: time.Now().Add(-time.Minute)})
+	if entry, err := backend.Get("a"); entry != nil || err != nil {
+		t.Errorf("Expected an expired entry to be ignored, got %v, %v", entry, err)
+	}
+	if _, err := os.Stat(backend.path("a")); !os.IsNotExist(err) {
+		t.Error("Expected the expired entry to be removed")
+	}
+}
+
+func TestFileCacheCorrupt(t *testing.T) {
+	backend, _ := NewFileCache(t.TempDir())
+	ioutil.WriteFile(backend.path("a"), []byte("{not json"), 0600)
+
+	if _, err := backend.Get("a"); err == nil {
+		t.Error("Expected an error for a corrupt file")
+	}
+}
+
+func TestParseTTLs(t *testing.T) {
+	have, err := parseTTLs("GreyNoise=24h, IP API = 168h,")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	want := map[string]time.Duration{
+		"GreyNoise": 24 * time.Hour,
+		"IP API":    168 * time.Hour,
+	}
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+
+	for _, invalid := range []string{"GreyNoise", "GreyNoise=soon"} {
+		if _, err := parseTTLs(invalid); err == nil {
+			t.Errorf("Expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestCacheFromEnv(t *testing.T) {
+	t.Setenv("CACHE_BACKEND", "")
+	if cache := CacheFromEnv(); cache != nil {
+		t.Error("Expected caching to be off by default")
+	}
+
+	t.Setenv("CACHE_BACKEND", "carrier pigeon")
+	if cache := CacheFromEnv(); cache != nil {
+		t.Error("Expected caching to be off for an unknown backend")
+	}
+
+	t.Setenv("CACHE_BACKEND", "file")
+	t.Setenv("CACHE_PATH", t.TempDir())
+	t.Setenv("CACHE_TTL", "30m")
+	t.Setenv("CACHE_TTLS", "GreyNoise=24h")
+	cache := CacheFromEnv()
+	if cache == nil {
+		t.Fatal("Expected a cache")
+	}
+	if _, ok := cache.Backend.(*FileCache); !ok {
+		t.Errorf("Expected a file cache, got %T", cache.Backend)
+	}
+	if cache.TTL("GreyNoise") != 24*time.Hour || cache.TTL("IP API") != 30*time.Minute {
+		t.Errorf("Unexpected TTLs %s and %s", cache.TTL("GreyNoise"), cache.TTL("IP API"))
+	}
+
+	t.Setenv("CACHE_BACKEND", "dynamodb")
+	t.Setenv("CACHE_TABLE", "")
+	if cache := CacheFromEnv(); cache != nil {
+		t.Error("Expected caching to be off without a table")
+	}
+}
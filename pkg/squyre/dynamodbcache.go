@@ -0,0 +1,81 @@
+package squyre
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDBCache keeps results in a DynamoDB table, shared by every function. The table needs a string partition key
+// called 'key'. Turn on DynamoDB TTL for the 'expires' attribute to have expired results cleaned up.
+type DynamoDBCache struct {
+	Client dynamodbiface.DynamoDBAPI
+	Table  string
+}
+
+// NewDynamoDBCache creates a cache using the table
+func NewDynamoDBCache(table string) (*DynamoDBCache, error) {
+	if table == "" {
+		return nil, errors.New("no DynamoDB table set")
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DynamoDBCache{
+		Client: dynamodb.New(sess),
+		Table:  table,
+	}, nil
+}
+
+// Get returns the entry stored under the key
+func (d *DynamoDBCache) Get(key string) (*CacheEntry, error) {
+	output, err := d.Client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item, ok := output.Item["entry"]
+	if !ok || item.S == nil {
+		return nil, nil
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal([]byte(*item.S), &entry); err != nil {
+		return nil, err
+	}
+	// DynamoDB can take a while to remove expired items, so they have to be checked for
+	if entry.Expired() {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// Put stores an entry under the key
+func (d *DynamoDBCache) Put(key string, entry CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"key":     {S: aws.String(key)},
+			"entry":   {S: aws.String(string(data))},
+			"expires": {N: aws.String(strconv.FormatInt(entry.Expires.Unix(), 10))},
+		},
+	})
+	return err
+}
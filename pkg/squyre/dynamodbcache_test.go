@@ -0,0 +1,69 @@
+package squyre
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/google/go-cmp/cmp"
+)
+
+type mockedDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	Items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockedDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{
+		Item: m.Items[*input.Key["key"].S],
+	}, nil
+}
+
+func (m *mockedDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.Items[*input.Item["key"].S] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoDBCache(t *testing.T) {
+	client := &mockedDynamoDB{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	cache := NewResultCache(&DynamoDBCache{Client: client, Table: "cache"}, time.Hour)
+
+	cache.Put("Mock", cacheSubject, makeCacheResult())
+
+	item := client.Items[CacheKey("Mock", cacheSubject)]
+	if item == nil {
+		t.Fatal("Expected the result to be stored")
+	}
+	// The expiry is stored as epoch seconds for DynamoDB TTL
+	expires, _ := strconv.ParseInt(aws.StringValue(item["expires"].N), 10, 64)
+	if want := time.Now().Add(time.Hour).Unix(); expires < want-5 || expires > want {
+		t.Errorf("Unexpected expires attribute %d, want around %d", expires, want)
+	}
+
+	have, ok := cache.Get("Mock", cacheSubject)
+	if !ok {
+		t.Fatal("Expected a cached result")
+	}
+	want := makeCacheResult()
+	want.Cached = true
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
+
+func TestDynamoDBCacheExpired(t *testing.T) {
+	client := &mockedDynamoDB{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	backend := &DynamoDBCache{Client: client, Table: "cache"}
+
+	backend.Put("a", CacheEntry{Expires: time.Now().Add(-time.Minute)})
+
+	if entry, err := backend.Get("a"); entry != nil || err != nil {
+		t.Errorf("Expected an expired entry to be ignored, got %v, %v", entry, err)
+	}
+	if entry, err := backend.Get("b"); entry != nil || err != nil {
+		t.Errorf("Expected no entry, got %v, %v", entry, err)
+	}
+}
@@ -0,0 +1,147 @@
+package squyre
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Enricher looks up subjects on an enrichment service
+type Enricher interface {
+	// Supports reports whether the service can look up subjects of the given type e.g. 'ipv4'
+	Supports(subjectType string) bool
+	// Enrich looks up a subject, returning what the service knows about it. An error means the lookup failed, and is
+	// recorded in the alert as an unsuccessful result.
+	Enrich(ctx context.Context, subject Subject) (Result, error)
+}
+
+// SubjectTypes lists the types of subject an enrichment service supports. Embed it in an Enricher to provide Supports.
+type SubjectTypes []string
+
+// Supports reports whether the subject type is in the list
+func (types SubjectTypes) Supports(subjectType string) bool {
+	for _, supported := range types {
+		if supported == subjectType {
+			return true
+		}
+	}
+	return false
+}
+
+// EnrichmentHarness runs an Enricher over every supported subject in an alert. Its HandleRequest method is the
+// Lambda handler for an enrichment function.
+type EnrichmentHarness struct {
+	Provider       string                   // The name of the service, used as the Source of each result
+	NewEnricher    func() (Enricher, error) // Sets up the Enricher, only called when the alert has subjects
+	OnlyLogMatches bool                     // Whether to leave out results where the service had no match
+	Cache          *ResultCache             // Where to cache results, if anywhere
+	Timeout        time.Duration            // How long to spend on the alert, DefaultEnrichTimeout if not set
+}
+
+// DefaultEnrichTimeout is how long an enrichment function spends on an alert. It's under the step function's 10
+// second task timeout, so lookups still running are recorded as failed rather than losing the whole alert.
+const DefaultEnrichTimeout = 9 * time.Second
+
+// HandleRequest enriches the alert, returning it as JSON for the step function
+func (h EnrichmentHarness) HandleRequest(ctx context.Context, alert Alert) (string, error) {
+	log.Infof("Starting %s run for alert %s", h.Provider, alert.ID)
+	log.Infof("OnlyLogMatches is set to %t", h.OnlyLogMatches)
+
+	if len(alert.Subjects) == 0 {
+		log.Info("Alert has no subjects to process.")
+		finalJSON, _ := json.Marshal(alert)
+		return string(finalJSON), nil
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultEnrichTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	enricher, err := h.NewEnricher()
+	if err != nil {
+		log.Errorf("Failed to initialise %s client: %s", h.Provider, err)
+		return "Failed to initialise client", err
+	}
+
+	// Share the raw response budget between every result in the alert, including any it came with
+	rawBudget := MaxAlertRaw
+	for _, result := range alert.Results {
+		rawBudget -= len(result.Raw)
+	}
+
+	// Process each subject in the alert we were passed
+	for _, subject := range alert.Subjects {
+		if !enricher.Supports(subject.Type) {
+			log.Infof("Subject type %s not supported by %s. Skipping.", subject.Type, h.Provider)
+			continue
+		}
+		if !alert.enrichesType(subject.Type) {
+			log.Infof("Subject type %s is enriched by another branch. Skipping.", subject.Type)
+			continue
+		}
+
+		result, cached := h.Cache.Get(h.Provider, subject)
+		if cached {
+			log.Infof("Using cached %s result for %s, from %d seconds ago", h.Provider, subject.Value, result.CacheAge)
+		} else {
+			var err error
+			result, err = enricher.Enrich(ctx, subject)
+			result.Source = h.Provider
+			result.AttributeValue = subject.Value
+
+			if err != nil {
+				log.Errorf("Failed to fetch data from %s for %s: %s", h.Provider, subject.Value, err)
+				alert.Results = append(alert.Results, failedResult(result, err))
+				continue
+			}
+			result.Success = true
+			if result.Verdict == "" {
+				result.Verdict = VerdictUnknown
+			}
+			h.Cache.Put(h.Provider, subject, result)
+		}
+
+		if !result.MatchFound && h.OnlyLogMatches {
+			log.Infof("Skipping non match for %s", subject.Value)
+			continue
+		}
+		if len(result.Raw) > rawBudget {
+			log.Infof("Leaving out the raw %s response for %s, as the alert has too much already", h.Provider, subject.Value)
+			result.Raw = nil
+		}
+		rawBudget -= len(result.Raw)
+		alert.Results = append(alert.Results, result)
+		log.Infof("Added %s to result set", subject.Value)
+	}
+	log.Infof("Finished %s run. Yielded %d results for %d subjects.", h.Provider, len(alert.Results), len(alert.Subjects))
+
+	// Convert the alert object into Json for the step function
+	finalJSON, _ := json.Marshal(alert)
+	return string(finalJSON), nil
+}
+
+// enrichesType reports whether this branch of the step function enriches subjects of the given type
+func (alert Alert) enrichesType(subjectType string) bool {
+	if alert.EnrichTypes == "" {
+		return true
+	}
+	return SubjectTypes(strings.Split(alert.EnrichTypes, ",")).Supports(subjectType)
+}
+
+// failedResult records a failed lookup, dropping anything the enricher found before it failed
+func failedResult(result Result, err error) Result {
+	return Result{
+		Source:         result.Source,
+		AttributeValue: result.AttributeValue,
+		Message:        err.Error(),
+		Success:        false,
+		MatchFound:     false,
+		Verdict:        VerdictUnknown,
+	}
+}
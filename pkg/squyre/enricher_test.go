@@ -0,0 +1,261 @@
+package squyre
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type mockEnricher struct {
+	SubjectTypes
+	looked []string
+}
+
+func (e *mockEnricher) Enrich(ctx context.Context, subject Subject) (Result, error) {
+	e.looked = append(e.looked, subject.Value)
+
+	switch subject.Value {
+	case "4.4.4.4":
+		return Result{Message: "Bad!", MatchFound: true, Verdict: VerdictMalicious, Score: 90}, nil
+	case "9.9.9.9":
+		return Result{Message: "Half done", MatchFound: true}, errors.New("Timeout!")
+	}
+	return Result{Message: "Never heard of it"}, nil
+}
+
+func makeHarnessAlert() Alert {
+	return Alert{
+		ID: "1234-1234",
+		Subjects: []Subject{
+			{Type: "ipv4", Value: "4.4.4.4"},
+			{Type: "ipv4", Value: "8.8.8.8"},
+			{Type: "ipv6", Value: "2001:db8::4"},
+			{Type: "ipv4", Value: "9.9.9.9"},
+		},
+	}
+}
+
+func runHarness(t *testing.T, harness EnrichmentHarness, alert Alert) Alert {
+	t.Helper()
+
+	output, err := harness.HandleRequest(context.Background(), alert)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	var response Alert
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	return response
+}
+
+func TestSubjectTypes(t *testing.T) {
+	types := SubjectTypes{"ipv4", "sha256"}
+
+	if !types.Supports("ipv4") {
+		t.Error("expected ipv4 to be supported")
+	}
+	// The old strings.Contains check matched parts of type names
+	for _, unsupported := range []string{"ipv", "sha", "ipv6", ""} {
+		if types.Supports(unsupported) {
+			t.Errorf("expected '%s' not to be supported", unsupported)
+		}
+	}
+}
+
+func TestHarness(t *testing.T) {
+	enricher := &mockEnricher{SubjectTypes: SubjectTypes{"ipv4"}}
+	harness := EnrichmentHarness{
+		Provider:    "Mock",
+		NewEnricher: func() (Enricher, error) { return enricher, nil },
+	}
+
+	response := runHarness(t, harness, makeHarnessAlert())
+
+	have := response.Results
+	want := []Result{
+		{Source: "Mock", AttributeValue: "4.4.4.4", Message: "Bad!", Success: true, MatchFound: true, Verdict: VerdictMalicious, Score: 90},
+		{Source: "Mock", AttributeValue: "8.8.8.8", Message: "Never heard of it", Success: true, Verdict: VerdictUnknown},
+		{Source: "Mock", AttributeValue: "9.9.9.9", Message: "Timeout!", Verdict: VerdictUnknown},
+	}
+	if !cmp.Equal(have, want) {
+		t.Fatalf("unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+
+	if !cmp.Equal(enricher.looked, []string{"4.4.4.4", "8.8.8.8", "9.9.9.9"}) {
+		t.Errorf("unexpected lookups %v", enricher.looked)
+	}
+}
+
+func TestHarnessEnrichTypes(t *testing.T) {
+	enricher := &mockEnricher{SubjectTypes: SubjectTypes{"ipv4", "ipv6"}}
+	harness := EnrichmentHarness{
+		Provider:    "Mock",
+		NewEnricher: func() (Enricher, error) { return enricher, nil },
+	}
+
+	// Another branch of the step function enriches the IPv4s
+	alert := makeHarnessAlert()
+	alert.EnrichTypes = "ipv6,sha256"
+	response := runHarness(t, harness, alert)
+
+	if !cmp.Equal(enricher.looked, []string{"2001:db8::4"}) {
+		t.Errorf("unexpected lookups %v", enricher.looked)
+	}
+	if len(response.Results) != 1 {
+		t.Errorf("unexpected results %v", response.Results)
+	}
+}
+
+func TestHarnessOnlyLogMatches(t *testing.T) {
+	harness := EnrichmentHarness{
+		Provider:       "Mock",
+		OnlyLogMatches: true,
+		NewEnricher: func() (Enricher, error) {
+			return &mockEnricher{SubjectTypes: SubjectTypes{"ipv4"}}, nil
+		},
+	}
+
+	response := runHarness(t, harness, makeHarnessAlert())
+
+	// Failed lookups are always kept, so they aren't mistaken for a non match
+	var have []string
+	for _, result := range response.Results {
+		have = append(have, result.AttributeValue)
+	}
+	want := []string{"4.4.4.4", "9.9.9.9"}
+	if !cmp.Equal(have, want) {
+		t.Fatalf("unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
+
+func TestHarnessNoSubjects(t *testing.T) {
+	harness := EnrichmentHarness{
+		Provider: "Mock",
+		NewEnricher: func() (Enricher, error) {
+			t.Fatal("enricher should not be set up for an alert with no subjects")
+			return nil, nil
+		},
+	}
+
+	response := runHarness(t, harness, Alert{ID: "1234-1234"})
+	if len(response.Results) != 0 {
+		t.Fatalf("expected no results, got %d", len(response.Results))
+	}
+}
+
+func TestHarnessInitFailure(t *testing.T) {
+	harness := EnrichmentHarness{
+		Provider: "Mock",
+		NewEnricher: func() (Enricher, error) {
+			return nil, errors.New("no secret")
+		},
+	}
+
+	_, err := harness.HandleRequest(context.Background(), makeHarnessAlert())
+	if err == nil || err.Error() != "no secret" {
+		t.Fatalf("expected the init error, got %v", err)
+	}
+}
+
+func TestHarnessCache(t *testing.T) {
+	enricher := &mockEnricher{SubjectTypes: SubjectTypes{"ipv4"}}
+	harness := EnrichmentHarness{
+		Provider:    "Mock",
+		NewEnricher: func() (Enricher, error) { return enricher, nil },
+		Cache:       NewResultCache(NewMemoryCache(), time.Hour),
+	}
+
+	first := runHarness(t, harness, makeHarnessAlert())
+	second := runHarness(t, harness, makeHarnessAlert())
+
+	// Only the failed lookup is tried again
+	want := []string{"4.4.4.4", "8.8.8.8", "9.9.9.9", "9.9.9.9"}
+	if !cmp.Equal(enricher.looked, want) {
+		t.Errorf("unexpected lookups. \nHave: %v\nWant: %v", enricher.looked, want)
+	}
+
+	for i, result := range second.Results {
+		wantCached := result.Success
+		if result.Cached != wantCached {
+			t.Errorf("unexpected Cached for %s. \nHave: %t\nWant: %t", result.AttributeValue, result.Cached, wantCached)
+		}
+		if result.Message != first.Results[i].Message {
+			t.Errorf("unexpected output. \nHave: %s\nWant: %s", result.Message, first.Results[i].Message)
+		}
+	}
+}
+
+type deadlineEnricher struct {
+	SubjectTypes
+	deadlines []time.Time
+}
+
+func (e *deadlineEnricher) Enrich(ctx context.Context, subject Subject) (Result, error) {
+	deadline, _ := ctx.Deadline()
+	e.deadlines = append(e.deadlines, deadline)
+	return Result{}, ctx.Err()
+}
+
+func TestHarnessTimeout(t *testing.T) {
+	enricher := &deadlineEnricher{SubjectTypes: SubjectTypes{"ipv4"}}
+	harness := EnrichmentHarness{
+		Provider:    "Mock",
+		NewEnricher: func() (Enricher, error) { return enricher, nil },
+	}
+
+	runHarness(t, harness, makeHarnessAlert())
+	latest := time.Now().Add(DefaultEnrichTimeout)
+
+	// Lookups are given the harness deadline, so they finish before the step function gives up on us
+	for _, deadline := range enricher.deadlines {
+		if deadline.IsZero() || deadline.After(latest) {
+			t.Errorf("Unexpected deadline %s, want within %s", deadline, DefaultEnrichTimeout)
+		}
+	}
+
+	harness.Timeout = time.Nanosecond
+	response := runHarness(t, harness, makeHarnessAlert())
+	for _, result := range response.Results {
+		if result.Success || result.Message != context.DeadlineExceeded.Error() {
+			t.Errorf("Expected a timed out lookup, got %+v", result)
+		}
+	}
+}
+
+type rawEnricher struct {
+	SubjectTypes
+}
+
+func (e *rawEnricher) Enrich(ctx context.Context, subject Subject) (Result, error) {
+	return Result{Raw: json.RawMessage(`"` + subject.Value + `"`)}, nil
+}
+
+func TestHarnessRawBudget(t *testing.T) {
+	defer func(max int) { MaxAlertRaw = max }(MaxAlertRaw)
+	MaxAlertRaw = 20
+
+	harness := EnrichmentHarness{
+		Provider:    "Mock",
+		NewEnricher: func() (Enricher, error) { return &rawEnricher{SubjectTypes: SubjectTypes{"ipv4"}}, nil },
+	}
+
+	// The alert already carries 9 bytes, leaving room for one more 9 byte response
+	alert := makeHarnessAlert()
+	alert.Results = []Result{{Source: "Other", Raw: json.RawMessage(`"4.4.4.4"`)}}
+	response := runHarness(t, harness, alert)
+
+	var have []string
+	for _, result := range response.Results {
+		have = append(have, string(result.Raw))
+	}
+	want := []string{`"4.4.4.4"`, `"4.4.4.4"`, "", ""}
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
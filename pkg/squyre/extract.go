@@ -0,0 +1,132 @@
+package squyre
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Extractor finds subjects of interest in the text of an alert
+type Extractor interface {
+	// Name describes what the extractor looks for e.g. 'public IPv4 addresses'
+	Name() string
+	// Extract returns the subjects found in the given text
+	Extract(details string) []Subject
+}
+
+// ExtractorRegistry holds the extractors used to find subjects in alerts, run in the order they were registered
+type ExtractorRegistry struct {
+	extractors []Extractor
+}
+
+// NewExtractorRegistry creates a registry containing the supplied extractors
+func NewExtractorRegistry(extractors ...Extractor) *ExtractorRegistry {
+	return &ExtractorRegistry{
+		extractors: extractors,
+	}
+}
+
+// Register adds an extractor to the registry
+func (r *ExtractorRegistry) Register(extractor Extractor) {
+	r.extractors = append(r.extractors, extractor)
+}
+
+// Extractors returns the registered extractors
+func (r *ExtractorRegistry) Extractors() []Extractor {
+	return r.extractors
+}
+
+// Extract runs every registered extractor over the text, returning the unique subjects found and the
+// Scope they contribute to the alert i.e. each type of subject found. When more than one extractor finds a
+// subject, it's kept once, linked to the Parent it was derived from if any extractor knows it.
+func (r *ExtractorRegistry) Extract(details string) ([]Subject, []string) {
+	var subjects []Subject
+	var scope []string
+
+	seen := make(map[Subject]int)
+	scoped := make(map[string]bool)
+	for _, extractor := range r.extractors {
+		for _, subject := range extractor.Extract(details) {
+			key := Subject{Type: subject.Type, Value: subject.Value}
+			if idx, ok := seen[key]; ok {
+				if subjects[idx].Parent == "" {
+					subjects[idx].Parent = subject.Parent
+				}
+				continue
+			}
+			seen[key] = len(subjects)
+			subjects = append(subjects, subject)
+
+			if !scoped[subject.Type] {
+				scoped[subject.Type] = true
+				scope = append(scope, subject.Type)
+			}
+		}
+	}
+	return subjects, scope
+}
+
+type funcExtractor struct {
+	name    string
+	extract func(details string) []Subject
+}
+
+func (e funcExtractor) Name() string {
+	return e.name
+}
+
+func (e funcExtractor) Extract(details string) []Subject {
+	return e.extract(details)
+}
+
+// NewExtractor wraps a function as an Extractor
+func NewExtractor(name string, extract func(details string) []Subject) Extractor {
+	return funcExtractor{
+		name:    name,
+		extract: extract,
+	}
+}
+
+// RegexExtractor finds subjects of a single type that match a regular expression. Matches must be bounded
+// by a space, start/end of line, '=', ',' or braces, which prevents a lot of false positives!
+type RegexExtractor struct {
+	Type    string
+	Pattern *regexp.Regexp
+}
+
+// NewRegexExtractor creates a RegexExtractor for the given subject type and Go regular expression
+func NewRegexExtractor(subjectType string, pattern string) (*RegexExtractor, error) {
+	re, err := regexp.Compile(`(^|[ =\{\}\[])` + pattern + `($|[ ,\{\}\]])`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegexExtractor{
+		Type:    subjectType,
+		Pattern: re,
+	}, nil
+}
+
+// Name describes what the extractor looks for
+func (e *RegexExtractor) Name() string {
+	return e.Type
+}
+
+// Extract returns the unique subjects matching our pattern
+func (e *RegexExtractor) Extract(details string) []Subject {
+	var subjectList []Subject
+
+	seen := make(map[string]bool)
+	for _, match := range e.Pattern.FindAllString(details, -1) {
+		value := strings.Trim(match, " {}=[],")
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+
+		subjectList = append(subjectList, Subject{
+			Type:  e.Type,
+			Value: value,
+		})
+	}
+	return subjectList
+}
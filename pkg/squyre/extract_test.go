@@ -0,0 +1,94 @@
+package squyre
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegexExtractor(t *testing.T) {
+	extractor, err := NewRegexExtractor("hostname", `ABC-\d{5}`)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	have := extractor.Extract("ABC-12345  [X123487822, ABC-54321] xABC-99999 ABC-12345}")
+	want := []Subject{
+		{Type: "hostname", Value: "ABC-12345"},
+		{Type: "hostname", Value: "ABC-54321"},
+	}
+
+	if !cmp.Equal(have, want) {
+		t.Fatalf("unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
+
+func TestInvalidRegexExtractor(t *testing.T) {
+	_, err := NewRegexExtractor("hostname", `ABC-(`)
+	if err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestExtractorRegistry(t *testing.T) {
+	upper := NewExtractor("shouting", func(details string) []Subject {
+		var subjects []Subject
+		for _, word := range strings.Fields(details) {
+			if word == strings.ToUpper(word) {
+				subjects = append(subjects, Subject{Type: "shout", Value: word})
+			}
+		}
+		return subjects
+	})
+	ids, _ := NewRegexExtractor("employee", `E\d{3}`)
+
+	registry := NewExtractorRegistry(upper)
+	registry.Register(ids)
+
+	if len(registry.Extractors()) != 2 {
+		t.Fatalf("expected 2 extractors, got %d", len(registry.Extractors()))
+	}
+
+	subjects, scope := registry.Extract("HEY E123 there E123 HEY")
+	wantSubjects := []Subject{
+		{Type: "shout", Value: "HEY"},
+		{Type: "shout", Value: "E123"},
+		{Type: "employee", Value: "E123"},
+	}
+	wantScope := []string{"shout", "employee"}
+
+	if !cmp.Equal(subjects, wantSubjects) {
+		t.Fatalf("unexpected subjects. \nHave: %v\nWant: %v", subjects, wantSubjects)
+	}
+	if !cmp.Equal(scope, wantScope) {
+		t.Fatalf("unexpected scope. \nHave: %v\nWant: %v", scope, wantScope)
+	}
+}
+
+func TestExtractorRegistryParent(t *testing.T) {
+	domains := NewExtractor("domains", func(details string) []Subject {
+		return []Subject{{Type: "domain", Value: "evil.com"}}
+	})
+	urls := NewExtractor("urls", func(details string) []Subject {
+		return []Subject{
+			{Type: "url", Value: "https://evil.com/x"},
+			{Type: "domain", Value: "evil.com", Parent: "https://evil.com/x"},
+		}
+	})
+
+	// The domain is found first on its own, then again in the URL it came from
+	subjects, scope := NewExtractorRegistry(domains, urls).Extract("https://evil.com/x")
+	wantSubjects := []Subject{
+		{Type: "domain", Value: "evil.com", Parent: "https://evil.com/x"},
+		{Type: "url", Value: "https://evil.com/x"},
+	}
+	wantScope := []string{"domain", "url"}
+
+	if !cmp.Equal(subjects, wantSubjects) {
+		t.Fatalf("unexpected subjects. \nHave: %v\nWant: %v", subjects, wantSubjects)
+	}
+	if !cmp.Equal(scope, wantScope) {
+		t.Fatalf("unexpected scope. \nHave: %v\nWant: %v", scope, wantScope)
+	}
+}
@@ -0,0 +1,155 @@
+package squyre
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// GenericAlertMapping holds the dot separated paths to each of our alert fields in a webhook payload
+type GenericAlertMapping struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Timestamp  string `json:"timestamp"`
+	RawMessage string `json:"message"` // Leave empty to use the whole payload
+}
+
+// GenericAlert defines an alert from any webhook capable tool, mapped to our standard form by configured paths
+type GenericAlert struct {
+	Payload string
+	Mapping GenericAlertMapping
+}
+
+// Normaliser comverts a generic alert to our standard form
+func (alert GenericAlert) Normaliser() Alert {
+	payload, _ := decodeJSON(alert.Payload)
+
+	rawMessage := alert.Payload
+	if alert.Mapping.RawMessage != "" {
+		var parts []string
+		for _, node := range nodesAtPath(payload, splitPath(alert.Mapping.RawMessage)) {
+			if str, ok := node.(string); ok {
+				parts = append(parts, str)
+				continue
+			}
+			encoded, _ := json.Marshal(node)
+			parts = append(parts, string(encoded))
+		}
+		rawMessage = strings.Join(parts, "\n")
+	}
+
+	// Fall back to a hash of the payload, so results for this alert can still be grouped together
+	id := firstValueAtPath(payload, alert.Mapping.ID)
+	if id == "" {
+		sum := sha256.Sum256([]byte(alert.Payload))
+		id = hex.EncodeToString(sum[:])[:16]
+	}
+
+	return Alert{
+		RawMessage: rawMessage,
+		ID:         id,
+		Name:       firstValueAtPath(payload, alert.Mapping.Name),
+		Timestamp:  firstValueAtPath(payload, alert.Mapping.Timestamp),
+		URL:        firstValueAtPath(payload, alert.Mapping.URL),
+	}
+}
+
+// ValuesAtPath finds the values at a dot separated path in some JSON data. Arrays along the path are
+// expanded, unless the path picks an index, and strings holding JSON are decoded, as some alert sources
+// embed their results this way.
+func ValuesAtPath(data interface{}, path string) []string {
+	var values []string
+	for _, node := range nodesAtPath(data, splitPath(path)) {
+		values = append(values, leafValues(node)...)
+	}
+	return values
+}
+
+func firstValueAtPath(data interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+	values := ValuesAtPath(data, path)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// decodeJSON decodes JSON data, keeping numbers as they were written so large IDs and timestamps aren't rounded
+func decodeJSON(data string) (interface{}, error) {
+	var decoded interface{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func leafValues(data interface{}) []string {
+	switch value := data.(type) {
+	case string:
+		return []string{value}
+	case json.Number:
+		return []string{value.String()}
+	case float64:
+		return []string{strconv.FormatFloat(value, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(value)}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			values = append(values, leafValues(item)...)
+		}
+		return values
+	}
+	return nil
+}
+
+func nodesAtPath(data interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{data}
+	}
+
+	if str, ok := data.(string); ok {
+		decoded, err := decodeJSON(str)
+		if err != nil {
+			return nil
+		}
+		data = decoded
+	}
+
+	switch node := data.(type) {
+	case map[string]interface{}:
+		// Field names can contain dots themselves, so try the longest matching key first
+		for i := len(path); i > 0; i-- {
+			if child, ok := node[strings.Join(path[:i], ".")]; ok {
+				return nodesAtPath(child, path[i:])
+			}
+		}
+	case []interface{}:
+		if idx, err := strconv.Atoi(path[0]); err == nil {
+			if idx >= 0 && idx < len(node) {
+				return nodesAtPath(node[idx], path[1:])
+			}
+			return nil
+		}
+		var nodes []interface{}
+		for _, item := range node {
+			nodes = append(nodes, nodesAtPath(item, path)...)
+		}
+		return nodes
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package squyre
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValuesAtPath(t *testing.T) {
+	payload := `{
+		"result": {"src_ip": "8.8.8.8", "dest.ip": "9.9.9.9", "urls": ["http://a.com", "http://b.com"], "count": 2},
+		"results": "[{\"host\": \"x.com\"}, {\"host\": \"y.com\"}]"
+	}`
+
+	tests := map[string][]string{
+		"result.src_ip":  {"8.8.8.8"},
+		"result.dest.ip": {"9.9.9.9"},
+		"result.urls":    {"http://a.com", "http://b.com"},
+		"result.urls.1":  {"http://b.com"},
+		"result.count":   {"2"},
+		"results.host":   {"x.com", "y.com"},
+		"result.missing": nil,
+	}
+	for path, want := range tests {
+		have := ValuesAtPath(payload, path)
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("unexpected values for %s. \nHave: %v\nWant: %v", path, have, want)
+		}
+	}
+}
+
+func TestNormaliseGenericAlert(t *testing.T) {
+	generic := GenericAlert{
+		Payload: `{"event": {"id": "1234-1234", "title": "Test Alert", "link": "https://127.0.0.1/test.html", "at": "2022-12-12 18:00:00", "data": {"ip": "8.8.8.8"}}}`,
+		Mapping: GenericAlertMapping{
+			ID:         "event.id",
+			Name:       "event.title",
+			URL:        "event.link",
+			Timestamp:  "event.at",
+			RawMessage: "event.data",
+		},
+	}
+
+	have := generic.Normaliser()
+	want := Alert{
+		RawMessage: `{"ip":"8.8.8.8"}`,
+		ID:         "1234-1234",
+		Name:       "Test Alert",
+		URL:        "https://127.0.0.1/test.html",
+		Timestamp:  "2022-12-12 18:00:00",
+	}
+
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
+
+// tests large numbers are kept as written, rather than rounded or put in exponent form
+func TestNormaliseGenericAlertNumbers(t *testing.T) {
+	generic := GenericAlert{
+		Payload: `{"id": 9007199254740993123, "at": 1670868000123, "data": {"score": 1.5}}`,
+		Mapping: GenericAlertMapping{
+			ID:         "id",
+			Timestamp:  "at",
+			RawMessage: "data",
+		},
+	}
+
+	have := generic.Normaliser()
+	if have.ID != "9007199254740993123" || have.Timestamp != "1670868000123" {
+		t.Fatalf("unexpected output. \nHave: %s, %s\nWant: %s, %s", have.ID, have.Timestamp, "9007199254740993123", "1670868000123")
+	}
+	if have.RawMessage != `{"score":1.5}` {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have.RawMessage, `{"score":1.5}`)
+	}
+
+	// Already decoded data may still hold floats
+	if values := ValuesAtPath(map[string]interface{}{"at": float64(1e21)}, "at"); !reflect.DeepEqual(values, []string{"1000000000000000000000"}) {
+		t.Fatalf("unexpected values %v", values)
+	}
+}
+
+func TestNormaliseGenericAlertDefaults(t *testing.T) {
+	generic := GenericAlert{
+		Payload: `{"title": "Test Alert", "message": "hi 8.8.8.8"}`,
+		Mapping: GenericAlertMapping{
+			Name: "title",
+		},
+	}
+
+	have := generic.Normaliser()
+
+	if have.RawMessage != generic.Payload {
+		t.Fatalf("unexpected raw message. \nHave: %s\nWant: %s", have.RawMessage, generic.Payload)
+	}
+
+	if len(have.ID) != 16 || have.ID != generic.Normaliser().ID {
+		t.Fatalf("expected a stable ID from the payload hash, got %s", have.ID)
+	}
+}
@@ -5,10 +5,12 @@ go 1.17
 require (
 	github.com/aws/aws-sdk-go v1.45.11
 	github.com/google/go-cmp v0.5.6
+	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
@@ -0,0 +1,291 @@
+package squyre
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatusClass groups HTTP status codes by what an enrichment function should do about them
+type StatusClass int
+
+const (
+	// StatusSuccess is a 2xx response
+	StatusSuccess StatusClass = iota
+	// StatusTransient is a failure worth retrying e.g. rate limiting, or the service being briefly unavailable
+	StatusTransient
+	// StatusPermanent is a failure retrying won't fix e.g. a bad API key
+	StatusPermanent
+)
+
+// ClassifyStatus works out the StatusClass of an HTTP status code
+func ClassifyStatus(code int) StatusClass {
+	switch {
+	case code >= 200 && code < 300:
+		return StatusSuccess
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code == http.StatusTooManyRequests:
+		return StatusTransient
+	case code >= 500 && code != http.StatusNotImplemented && code != http.StatusHTTPVersionNotSupported:
+		return StatusTransient
+	default:
+		return StatusPermanent
+	}
+}
+
+// StatusError is returned by HTTPClient when a service responds with a status code the caller didn't accept
+type StatusError struct {
+	StatusCode int
+	Class      StatusClass
+	URL        string // The URL requested, without the query string as it may hold API keys
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// ErrResponseTooLarge is returned by HTTPClient when a response is larger than its MaxResponseSize
+var ErrResponseTooLarge = errors.New("response too large")
+
+// RetryPolicy controls how failed requests are retried
+type RetryPolicy struct {
+	Retries   int           // How many times to retry a failed request
+	BaseDelay time.Duration // The delay before the first retry, doubled for each retry after that
+	MaxDelay  time.Duration // The longest to wait before a retry. Requests asking us to wait longer are not retried.
+}
+
+// DefaultRetryPolicy retries twice, waiting around half a second, then one. Services asking us to wait more than two
+// seconds aren't retried, as the step function only gives each enrichment function 10 seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	Retries:   2,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  2 * time.Second,
+}
+
+// DefaultRequestTimeout is how long an HTTPClient spends on a request, including any retries, unless it's created
+// with a different timeout. It leaves room within the step function's 10 second task timeout to report the failure.
+const DefaultRequestTimeout = 6 * time.Second
+
+// Transport wraps a RoundTripper, retrying requests that fail with a network error or a transient status code. When
+// the retries run out, the last response or error is returned. Use it to add retries to SDKs that accept a
+// RoundTripper, such as gofalcon's TransportDecorator.
+func (p RetryPolicy) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base, policy: p}
+}
+
+// backoff returns the delay before a retry, growing exponentially with equal jitter to spread out retries
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		attempt := request
+		if retry > 0 {
+			var err error
+			if attempt, err = rewind(request); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := t.base.RoundTrip(attempt)
+
+		delay, retryable := t.retryDelay(response, err, retry)
+		if !retryable || !canRewind(request) {
+			return response, err
+		}
+		if response != nil {
+			log.Warnf("Retrying %s in %s after %d response (retry %d of %d)", redactURL(request.URL), delay, response.StatusCode, retry+1, t.policy.Retries)
+			// Drain the body so the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, 4096))
+			response.Body.Close()
+		} else {
+			log.Warnf("Retrying %s in %s after error: %s (retry %d of %d)", redactURL(request.URL), delay, err, retry+1, t.policy.Retries)
+		}
+
+		if deadline, ok := request.Context().Deadline(); ok && time.Until(deadline) < delay {
+			// We'd run out of time before sending the retry, so give up now with what we have
+			return nil, fmt.Errorf("no time left to retry: %w", context.DeadlineExceeded)
+		}
+
+		select {
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay decides whether to retry a request, and how long to wait first
+func (t *retryTransport) retryDelay(response *http.Response, err error, retry int) (time.Duration, bool) {
+	if retry >= t.policy.Retries {
+		return 0, false
+	}
+	if err != nil {
+		// Network errors are worth retrying, unless the request was cancelled
+		return t.policy.backoff(retry + 1), !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	if ClassifyStatus(response.StatusCode) != StatusTransient {
+		return 0, false
+	}
+
+	if wait, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+		// Honour the service's request, but don't hold up the whole step function waiting on it
+		return wait, wait <= t.policy.MaxDelay
+	}
+	return t.policy.backoff(retry + 1), true
+}
+
+// retryAfter parses a Retry-After header, which holds either a number of seconds or an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// canRewind reports whether a request can be sent again, which needs a way to get a fresh copy of any body
+func canRewind(request *http.Request) bool {
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
+
+func rewind(request *http.Request) (*http.Request, error) {
+	attempt := request.Clone(request.Context())
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt.Body = body
+	}
+	return attempt, nil
+}
+
+// redactURL drops the query string and any credentials from a URL, so it can be logged and shown in tickets
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	return redacted.String()
+}
+
+// HTTPClient makes requests to enrichment services, retrying transient failures and checking the response
+type HTTPClient struct {
+	client          *http.Client
+	MaxResponseSize int64 // The largest response body to read, in bytes
+}
+
+// DefaultMaxResponseSize is the largest response body read by an HTTPClient, unless it's changed
+const DefaultMaxResponseSize = 1 << 20
+
+// NewHTTPClient creates an HTTPClient that retries with the policy. The timeout covers the whole request, retries
+// included. It's shared between the attempts, so a slow service is retried rather than failing the whole lookup.
+func NewHTTPClient(timeout time.Duration, policy RetryPolicy) *HTTPClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout / time.Duration(policy.Retries+1)
+
+	return &HTTPClient{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: policy.Transport(transport),
+		},
+		MaxResponseSize: DefaultMaxResponseSize,
+	}
+}
+
+// Get fetches a URL, giving up when the context is done. See Do.
+func (c *HTTPClient) Get(ctx context.Context, rawURL string, acceptStatus ...int) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", redactError(err))
+	}
+	return c.Do(request, acceptStatus...)
+}
+
+// Do sends a request, retrying transient failures until the request's context is done. The response body is read in
+// full, and the connection closed, before it's returned. A *StatusError is returned for any status other than 2xx or
+// those in acceptStatus e.g. a 404 that means a service has never seen a subject.
+func (c *HTTPClient) Do(request *http.Request, acceptStatus ...int) (*http.Response, error) {
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", redactURL(request.URL), redactError(err))
+	}
+	defer response.Body.Close()
+
+	if !acceptable(response.StatusCode, acceptStatus) {
+		return nil, &StatusError{
+			StatusCode: response.StatusCode,
+			Class:      ClassifyStatus(response.StatusCode),
+			URL:        redactURL(request.URL),
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, c.MaxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s failed: %w", redactURL(request.URL), redactError(err))
+	}
+	if int64(len(body)) > c.MaxResponseSize {
+		return nil, fmt.Errorf("%s sent more than %d bytes: %w", redactURL(request.URL), c.MaxResponseSize, ErrResponseTooLarge)
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	return response, nil
+}
+
+func acceptable(code int, acceptStatus []int) bool {
+	if ClassifyStatus(code) == StatusSuccess {
+		return true
+	}
+	for _, accepted := range acceptStatus {
+		if code == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// redactError strips the URL from errors returned by http.Client, as it includes the query string
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
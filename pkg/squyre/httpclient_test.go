@@ -0,0 +1,257 @@
+package squyre
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPolicy = RetryPolicy{
+	Retries:   3,
+	BaseDelay: time.Millisecond,
+	MaxDelay:  10 * time.Millisecond,
+}
+
+// serveSequence responds with each status in turn, repeating the last one, and counts the requests made
+func serveSequence(t *testing.T, statuses []int, header http.Header) (*httptest.Server, *int) {
+	t.Helper()
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := map[int]StatusClass{
+		200: StatusSuccess,
+		204: StatusSuccess,
+		400: StatusPermanent,
+		401: StatusPermanent,
+		404: StatusPermanent,
+		408: StatusTransient,
+		429: StatusTransient,
+		500: StatusTransient,
+		501: StatusPermanent,
+		503: StatusTransient,
+		504: StatusTransient,
+	}
+
+	for code, want := range tests {
+		if have := ClassifyStatus(code); have != want {
+			t.Errorf("Unexpected class for %d. \nHave: %d\nWant: %d", code, have, want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if have, ok := retryAfter("7"); !ok || have != 7*time.Second {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, 7*time.Second)
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if have, ok := retryAfter(date); !ok || have < 50*time.Second || have > time.Minute {
+		t.Errorf("Unexpected wait for '%s': %s", date, have)
+	}
+
+	if _, ok := retryAfter("soon"); ok {
+		t.Error("Expected an invalid header to be ignored")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{Retries: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	for retry, max := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 4: 300} {
+		max *= time.Millisecond
+		have := policy.backoff(retry)
+		if have < max/2 || have > max {
+			t.Errorf("Unexpected delay for retry %d: %s, want between %s and %s", retry, have, max/2, max)
+		}
+	}
+}
+
+func TestHTTPClientRetriesTransient(t *testing.T) {
+	server, calls := serveSequence(t, []int{503, 429, 200}, nil)
+
+	response, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "OK" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", body, "OK")
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 requests, got %d", *calls)
+	}
+}
+
+func TestHTTPClientGivesUp(t *testing.T) {
+	server, calls := serveSequence(t, []int{500}, nil)
+
+	_, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 500 || statusErr.Class != StatusTransient {
+		t.Fatalf("Expected a transient StatusError, got %v", err)
+	}
+	if *calls != 4 {
+		t.Errorf("Expected 4 requests, got %d", *calls)
+	}
+}
+
+func TestHTTPClientPermanent(t *testing.T) {
+	server, calls := serveSequence(t, []int{401, 200}, nil)
+
+	_, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Class != StatusPermanent {
+		t.Fatalf("Expected a permanent StatusError, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 request, got %d", *calls)
+	}
+}
+
+func TestHTTPClientAcceptStatus(t *testing.T) {
+	server, _ := serveSequence(t, []int{404}, nil)
+
+	response, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL, http.StatusNotFound)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 404 || string(body) != "Not Found" {
+		t.Errorf("Unexpected output. \nHave: %d %s\nWant: %d %s", response.StatusCode, body, 404, "Not Found")
+	}
+}
+
+func TestHTTPClientRetryAfter(t *testing.T) {
+	server, calls := serveSequence(t, []int{429, 200}, http.Header{"Retry-After": {"0"}})
+
+	if _, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected 2 requests, got %d", *calls)
+	}
+}
+
+func TestHTTPClientRetryAfterTooLong(t *testing.T) {
+	server, calls := serveSequence(t, []int{429, 200}, http.Header{"Retry-After": {"120"}})
+
+	_, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 429 {
+		t.Fatalf("Expected a 429 StatusError, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 request, got %d", *calls)
+	}
+}
+
+func TestHTTPClientResponseTooLarge(t *testing.T) {
+	server, _ := serveSequence(t, []int{200}, nil)
+
+	client := NewHTTPClient(time.Second, testPolicy)
+	client.MaxResponseSize = 1
+
+	if _, err := client.Get(context.Background(), server.URL); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("Expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestHTTPClientRetriesBody(t *testing.T) {
+	var bodies []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if !failed {
+			failed = true
+			w.WriteHeader(502)
+		}
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("hello"))
+	if _, err := NewHTTPClient(time.Second, testPolicy).Do(request); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if strings.Join(bodies, ",") != "hello,hello" {
+		t.Errorf("Expected the body to be sent with each attempt, got %v", bodies)
+	}
+}
+
+func TestHTTPClientRedactsErrors(t *testing.T) {
+	server, _ := serveSequence(t, []int{401}, nil)
+
+	_, err := NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL+"/lookup?access_key=hunter2")
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected an error without the API key, got %v", err)
+	}
+
+	server.Close()
+	_, err = NewHTTPClient(time.Second, testPolicy).Get(context.Background(), server.URL+"/lookup?access_key=hunter2")
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected an error without the API key, got %v", err)
+	}
+}
+
+func TestHTTPClientNoRetryPastDeadline(t *testing.T) {
+	server, calls := serveSequence(t, []int{503, 200}, nil)
+	policy := RetryPolicy{Retries: 3, BaseDelay: time.Second, MaxDelay: time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewHTTPClient(5*time.Second, policy).Get(ctx, server.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 request, got %d", *calls)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Expected to give up straight away, took %s", elapsed)
+	}
+}
+
+func TestHTTPClientCancelled(t *testing.T) {
+	server, calls := serveSequence(t, []int{200}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewHTTPClient(time.Second, testPolicy).Get(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if *calls != 0 {
+		t.Errorf("Expected no requests, got %d", *calls)
+	}
+}
@@ -1,10 +1,16 @@
 package squyre
 
 import (
+	"errors"
+	"sync"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
 // Secret abstracts AWS Secrets Manager secrets
@@ -23,15 +29,96 @@ func (s *Secret) getValue() (*secretsmanager.GetSecretValueOutput, error) {
 	return output, err
 }
 
-// GetSecret fetches a secret value from AWS Secrets Manager given a secret location
-func GetSecret(location string) (secretsmanager.GetSecretValueOutput, error) {
-	sess := session.Must(session.NewSession())
+var (
+	awsSession     *session.Session
+	awsSessionOnce sync.Once
+)
+
+// sharedSession returns an AWS session shared by every secret lookup, rather than creating one per call
+func sharedSession() *session.Session {
+	awsSessionOnce.Do(func() {
+		awsSession = session.Must(session.NewSession())
+	})
+	return awsSession
+}
 
+// GetSecret fetches a secret value from AWS Secrets Manager given a secret location. Prefer FetchSecret, which
+// supports other providers and caches secrets.
+func GetSecret(location string) (secretsmanager.GetSecretValueOutput, error) {
 	s := Secret{
-		Client:   secretsmanager.New(sess),
+		Client:   secretsmanager.New(sharedSession()),
 		SecretID: location,
 	}
 	output, err := s.getValue()
+	if err != nil || output == nil {
+		return secretsmanager.GetSecretValueOutput{}, secretsManagerError(location, err)
+	}
+
+	return *output, nil
+}
+
+// SecretsManagerProvider fetches secrets from AWS Secrets Manager
+type SecretsManagerProvider struct {
+	Client secretsmanageriface.SecretsManagerAPI
+}
+
+// NewSecretsManagerProvider sets up a Secrets Manager provider using the shared AWS session
+func NewSecretsManagerProvider() *SecretsManagerProvider {
+	return &SecretsManagerProvider{Client: secretsmanager.New(sharedSession())}
+}
+
+// Fetch returns the secret's string value, or its binary value if it has no string
+func (p *SecretsManagerProvider) Fetch(name string) (string, error) {
+	s := Secret{Client: p.Client, SecretID: name}
 
-	return *output, err
+	output, err := s.getValue()
+	if err != nil || output == nil {
+		return "", secretsManagerError(name, err)
+	}
+	if output.SecretString != nil {
+		return secretValue("Secrets Manager", name, *output.SecretString)
+	}
+	return secretValue("Secrets Manager", name, string(output.SecretBinary))
+}
+
+func secretsManagerError(name string, err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		err = ErrSecretNotFound
+	}
+	if err == nil {
+		err = ErrSecretEmpty
+	}
+	return &SecretError{Name: name, Provider: "Secrets Manager", Err: err}
+}
+
+// SSMProvider fetches secrets from AWS Systems Manager Parameter Store. SecureString parameters are decrypted.
+type SSMProvider struct {
+	Client ssmiface.SSMAPI
+	Prefix string // Prepended to secret names e.g. '/squyre/'
+}
+
+// NewSSMProvider sets up a Parameter Store provider using the shared AWS session
+func NewSSMProvider(prefix string) *SSMProvider {
+	return &SSMProvider{Client: ssm.New(sharedSession()), Prefix: prefix}
+}
+
+// Fetch returns the parameter's value
+func (p *SSMProvider) Fetch(name string) (string, error) {
+	output, err := p.Client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(p.Prefix + name),
+		WithDecryption: aws.Bool(true),
+	})
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return "", &SecretError{Name: name, Provider: "Parameter Store", Err: ErrSecretNotFound}
+	}
+	if err != nil {
+		return "", &SecretError{Name: name, Provider: "Parameter Store", Err: err}
+	}
+	if output == nil || output.Parameter == nil {
+		return "", &SecretError{Name: name, Provider: "Parameter Store", Err: ErrSecretEmpty}
+	}
+	return secretValue("Parameter Store", name, aws.StringValue(output.Parameter.Value))
 }
@@ -0,0 +1,188 @@
+package squyre
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PayloadError describes an enrichment output that couldn't be merged
+type PayloadError struct {
+	Group int   // The enrichment group the output was in, from 0
+	Index int   // The position of the output in its group, from 0
+	Err   error // Why it couldn't be read
+}
+
+func (e PayloadError) Error() string {
+	return fmt.Sprintf("group %d output %d: %s", e.Group, e.Index, e.Err)
+}
+
+func (e PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// MergeError lists the enrichment outputs that MergeAlerts had to leave out
+type MergeError struct {
+	Payloads []PayloadError
+}
+
+func (e *MergeError) Error() string {
+	var failures []string
+	for _, payload := range e.Payloads {
+		failures = append(failures, payload.Error())
+	}
+	return fmt.Sprintf("%d enrichment outputs could not be read: %s", len(e.Payloads), strings.Join(failures, "; "))
+}
+
+// mergeSource is the Source of the result noting outputs that couldn't be read
+const mergeSource = "Squyre"
+
+// CombineResultsbyAlertID merges a slice of alerts for the same Id into one. Outputs that can't be read are left out.
+//
+// Deprecated: Use MergeAlerts, which keeps the alerts in order and reports the outputs it had to leave out.
+func CombineResultsbyAlertID(raw [][]string) map[string]Alert {
+	merged, _ := MergeAlerts(raw)
+
+	alerts := make(map[string]Alert)
+	for _, alert := range merged {
+		alerts[alert.ID] = alert
+	}
+	return alerts
+}
+
+// MergeAlerts merges the alerts output by each enrichment function, giving one alert per alert ID.
+// Alerts are returned in the order they first appear. Subjects are combined, and results are de-duplicated by source
+// and attribute, preferring a successful lookup over a failed one.
+//
+// Outputs that can't be read are left out, and returned in a *MergeError alongside the alerts that could be. They are
+// also noted on each alert as a failed result, so analysts know enrichment is incomplete.
+func MergeAlerts(raw [][]string) ([]Alert, error) {
+
+	/*
+		The output function(s) are called with a slice of slice of srings.
+		Each slice is an output from a group of enrichments e.g. IPv4, Domain etc. which contains
+		another slice of the outputs from each function (as Alerts). This is the way the Step
+		Function groups the results of parallel executions.
+
+		This function collapses all of that structure down, grouping by alert ID with all the separate
+		results within.
+	*/
+
+	var merged []*alertMerge
+	byID := make(map[string]*alertMerge)
+	var failures []PayloadError
+
+	for g, group := range raw {
+		for i, payload := range group {
+			var alert Alert
+			err := json.Unmarshal([]byte(payload), &alert)
+			if err == nil && alert.ID == "" {
+				err = errors.New("alert has no ID")
+			}
+			if err != nil {
+				failures = append(failures, PayloadError{Group: g, Index: i, Err: err})
+				continue
+			}
+
+			m, ok := byID[alert.ID]
+			if !ok {
+				m = newAlertMerge(alert)
+				byID[alert.ID] = m
+				merged = append(merged, m)
+			}
+			m.add(alert)
+		}
+	}
+
+	alerts := make([]Alert, 0, len(merged))
+	for _, m := range merged {
+		alerts = append(alerts, m.alert)
+	}
+
+	if len(failures) == 0 {
+		return alerts, nil
+	}
+	mergeErr := &MergeError{Payloads: failures}
+	for i := range alerts {
+		alerts[i].Results = append(alerts[i].Results, Result{
+			Source:         mergeSource,
+			AttributeValue: "enrichment results",
+			Message:        mergeErr.Error(),
+			Success:        false,
+			Verdict:        VerdictUnknown,
+		})
+	}
+	return alerts, mergeErr
+}
+
+// alertMerge collects the copies of one alert
+type alertMerge struct {
+	alert    Alert
+	subjects map[Subject]bool
+	scope    map[string]bool
+	results  map[[2]string]int // Index of each result in alert.Results, by source and attribute
+}
+
+func newAlertMerge(alert Alert) *alertMerge {
+	alert.Subjects = nil
+	alert.Results = nil
+	alert.Scope = ""
+	alert.EnrichTypes = ""
+
+	return &alertMerge{
+		alert:    alert,
+		subjects: make(map[Subject]bool),
+		scope:    make(map[string]bool),
+		results:  make(map[[2]string]int),
+	}
+}
+
+// add merges another copy of the alert in
+func (m *alertMerge) add(alert Alert) {
+	if m.alert.Timestamp == "" {
+		m.alert.Timestamp = alert.Timestamp
+	}
+	if m.alert.Name == "" {
+		m.alert.Name = alert.Name
+	}
+	if m.alert.RawMessage == "" {
+		m.alert.RawMessage = alert.RawMessage
+	}
+	if m.alert.URL == "" {
+		m.alert.URL = alert.URL
+	}
+	if alert.Truncated > m.alert.Truncated {
+		m.alert.Truncated = alert.Truncated
+	}
+
+	for _, subject := range alert.Subjects {
+		key := Subject{Type: subject.Type, Value: subject.Value}
+		if !m.subjects[key] {
+			m.subjects[key] = true
+			m.alert.Subjects = append(m.alert.Subjects, subject)
+		}
+	}
+
+	for _, subjectType := range strings.Split(alert.Scope, ",") {
+		if subjectType != "" && !m.scope[subjectType] {
+			m.scope[subjectType] = true
+			if m.alert.Scope != "" {
+				m.alert.Scope += ","
+			}
+			m.alert.Scope += subjectType
+		}
+	}
+
+	for _, result := range alert.Results {
+		key := [2]string{result.Source, result.AttributeValue}
+		index, seen := m.results[key]
+		if !seen {
+			m.results[key] = len(m.alert.Results)
+			m.alert.Results = append(m.alert.Results, result)
+		} else if result.Success && !m.alert.Results[index].Success {
+			// A later branch managed the lookup that an earlier one failed
+			m.alert.Results[index] = result
+		}
+	}
+}
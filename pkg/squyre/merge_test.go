@@ -0,0 +1,121 @@
+package squyre
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func encodeAlert(alert Alert) string {
+	encoded, _ := json.Marshal(alert)
+	return string(encoded)
+}
+
+func TestMergeAlerts(t *testing.T) {
+	ipv4 := Subject{Type: "ipv4", Value: "8.8.8.8"}
+	domain := Subject{Type: "domain", Value: "evil.com"}
+
+	raw := [][]string{
+		{
+			encodeAlert(Alert{ID: "b", Name: "Second", Subjects: []Subject{ipv4}, Scope: "ipv4", Results: []Result{
+				{Source: "GreyNoise", AttributeValue: "8.8.8.8", Message: "Timeout!"},
+			}}),
+			encodeAlert(Alert{ID: "a", Name: "First", Subjects: []Subject{ipv4}, Scope: "ipv4", Results: []Result{
+				{Source: "IP API", AttributeValue: "8.8.8.8", Message: "Somewhere", Success: true},
+			}}),
+		},
+		{
+			// The multipurpose branch looks up the same subjects again
+			encodeAlert(Alert{ID: "b", Subjects: []Subject{ipv4, domain}, Scope: "ipv4,domain", Truncated: 2, EnrichTypes: "ipv4,domain", Results: []Result{
+				{Source: "GreyNoise", AttributeValue: "8.8.8.8", Message: "Scanner", Success: true},
+				{Source: "OTX", AttributeValue: "evil.com", Message: "Evil", Success: true},
+			}}),
+			encodeAlert(Alert{ID: "a", Subjects: []Subject{ipv4}, Scope: "ipv4", Results: []Result{
+				{Source: "IP API", AttributeValue: "8.8.8.8", Message: "Somewhere", Success: true},
+			}}),
+		},
+	}
+
+	have, err := MergeAlerts(raw)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	want := []Alert{
+		{
+			SchemaVersion: CurrentSchemaVersion,
+			ID:            "b",
+			Name:          "Second",
+			Subjects:      []Subject{ipv4, domain},
+			Scope:         "ipv4,domain",
+			Truncated:     2,
+			Results: []Result{
+				{Source: "GreyNoise", AttributeValue: "8.8.8.8", Message: "Scanner", Success: true},
+				{Source: "OTX", AttributeValue: "evil.com", Message: "Evil", Success: true},
+			},
+		},
+		{
+			SchemaVersion: CurrentSchemaVersion,
+			ID:            "a",
+			Name:          "First",
+			Subjects:      []Subject{ipv4},
+			Scope:         "ipv4",
+			Results: []Result{
+				{Source: "IP API", AttributeValue: "8.8.8.8", Message: "Somewhere", Success: true},
+			},
+		},
+	}
+	if !cmp.Equal(have, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", have, want)
+	}
+}
+
+func TestMergeAlertsBadPayloads(t *testing.T) {
+	raw := [][]string{
+		{encodeAlert(Alert{ID: "a", Results: []Result{{Source: "OTX", AttributeValue: "evil.com", Success: true}}})},
+		{`{"ID": "a", "Results": [`, `{"Name": "No ID"}`},
+	}
+
+	have, err := MergeAlerts(raw)
+
+	var mergeErr *MergeError
+	if !errors.As(err, &mergeErr) {
+		t.Fatalf("Expected a merge error, got %v", err)
+	}
+	var failed [][2]int
+	for _, payload := range mergeErr.Payloads {
+		failed = append(failed, [2]int{payload.Group, payload.Index})
+	}
+	if want := [][2]int{{1, 0}, {1, 1}}; !cmp.Equal(failed, want) {
+		t.Errorf("Unexpected failures. \nHave: %v\nWant: %v", failed, want)
+	}
+
+	// The alerts that could be read are still returned, noting the missing results
+	if len(have) != 1 || len(have[0].Results) != 2 {
+		t.Fatalf("Expected one alert with two results, got %v", have)
+	}
+	note := have[0].Results[1]
+	if note.Source != mergeSource || note.Success || note.Message != err.Error() {
+		t.Errorf("Unexpected note %v", note)
+	}
+}
+
+func TestMergeAlertsEmpty(t *testing.T) {
+	have, err := MergeAlerts(nil)
+	if err != nil || len(have) != 0 {
+		t.Errorf("Expected no alerts and no error, got %v, %v", have, err)
+	}
+}
+
+func TestCombineResultsbyAlertID(t *testing.T) {
+	raw := [][]string{
+		{encodeAlert(Alert{ID: "a", Results: []Result{{Source: "OTX", AttributeValue: "evil.com", Success: true}}})},
+		{encodeAlert(Alert{ID: "a", Results: []Result{{Source: "GreyNoise", AttributeValue: "8.8.8.8", Success: true}}})},
+	}
+
+	have := CombineResultsbyAlertID(raw)
+	if len(have) != 1 || len(have["a"].Results) != 2 {
+		t.Fatalf("Expected alert 'a' with two results, got %v", have)
+	}
+}
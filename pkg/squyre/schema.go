@@ -0,0 +1,52 @@
+package squyre
+
+import (
+	// Embeds the published schema
+	_ "embed"
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CurrentSchemaVersion is the version of the alert schema this package encodes. Bump it, and update
+// schema/alert.schema.json, when the meaning of a field changes. Adding optional fields doesn't need a new version,
+// as older components ignore fields they don't know.
+const CurrentSchemaVersion = 1
+
+// AlertSchema is the JSON Schema for alerts, as passed between the conductor, enrichment functions and outputs
+//
+//go:embed schema/alert.schema.json
+var AlertSchema []byte
+
+// alertJSON has the fields of Alert without its methods, to avoid recursing when encoding
+type alertJSON Alert
+
+// MarshalJSON encodes the alert, stamping it with the current schema version
+func (alert Alert) MarshalJSON() ([]byte, error) {
+	alert.SchemaVersion = CurrentSchemaVersion
+	return json.Marshal(alertJSON(alert))
+}
+
+// UnmarshalJSON decodes an alert tolerantly, so older and newer components can run side by side during a deploy.
+// Unknown fields are ignored, missing fields are left empty, and fields of an unexpected type are skipped with a
+// warning rather than failing the whole alert. Alerts from before versioning have a SchemaVersion of 0.
+func (alert *Alert) UnmarshalJSON(data []byte) error {
+	var decoded alertJSON
+
+	err := json.Unmarshal(data, &decoded)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		log.Warnf("Skipping alert field %s, expected %s but got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if decoded.SchemaVersion > CurrentSchemaVersion {
+		log.Warnf("Alert %s has schema version %d, newer than %d. Fields added since will be ignored.", decoded.ID, decoded.SchemaVersion, CurrentSchemaVersion)
+	}
+	*alert = Alert(decoded)
+	return nil
+}
@@ -0,0 +1,117 @@
+package squyre
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// jsonNames lists the JSON names of a struct's fields
+func jsonNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func schemaNames(properties map[string]json.RawMessage) []string {
+	var names []string
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tests the published schema describes every field, so it doesn't drift from the structs
+func TestAlertSchemaMatchesStructs(t *testing.T) {
+	type object struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	var schema struct {
+		object
+		Definitions map[string]object `json:"definitions"`
+	}
+	if err := json.Unmarshal(AlertSchema, &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %s", err)
+	}
+
+	tests := []struct {
+		have []string
+		want []string
+	}{
+		{schemaNames(schema.Properties), jsonNames(reflect.TypeOf(Alert{}))},
+		{schemaNames(schema.Definitions["subject"].Properties), jsonNames(reflect.TypeOf(Subject{}))},
+		{schemaNames(schema.Definitions["result"].Properties), jsonNames(reflect.TypeOf(Result{}))},
+	}
+	for _, test := range tests {
+		if !cmp.Equal(test.have, test.want) {
+			t.Errorf("Schema does not match struct. \nHave: %v\nWant: %v", test.have, test.want)
+		}
+	}
+}
+
+func TestAlertSchemaVersion(t *testing.T) {
+	encoded, _ := json.Marshal(Alert{ID: "1234"})
+
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+	if fields["SchemaVersion"] != float64(CurrentSchemaVersion) {
+		t.Errorf("Unexpected output. \nHave: %v\nWant: %d", fields["SchemaVersion"], CurrentSchemaVersion)
+	}
+	// The state machine chooses branches by these names
+	for _, name := range []string{"ID", "Scope", "Subjects", "Results"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Expected %s in %s", name, encoded)
+		}
+	}
+}
+
+func TestAlertDecodeLegacy(t *testing.T) {
+	// An alert from before versioning, as sent by an older conductor
+	legacy := `{"Timestamp":"","Name":"Test","RawMessage":"8.8.8.8","URL":"","ID":"1234","Subjects":[{"Type":"ipv4","Value":"8.8.8.8"}],"Results":[{"Source":"GreyNoise","AttributeValue":"8.8.8.8","Message":"Hi","Success":true,"MatchFound":false}],"Scope":"ipv4"}`
+
+	var alert Alert
+	if err := json.Unmarshal([]byte(legacy), &alert); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	want := Alert{
+		Name:       "Test",
+		RawMessage: "8.8.8.8",
+		ID:         "1234",
+		Subjects:   []Subject{{Type: "ipv4", Value: "8.8.8.8"}},
+		Results:    []Result{{Source: "GreyNoise", AttributeValue: "8.8.8.8", Message: "Hi", Success: true}},
+		Scope:      "ipv4",
+	}
+	if !cmp.Equal(alert, want) {
+		t.Fatalf("Unexpected output. \nHave: %v\nWant: %v", alert, want)
+	}
+}
+
+func TestAlertDecodeTolerant(t *testing.T) {
+	// An alert from a newer component, with a field we don't know and one whose type has changed
+	newer := `{"SchemaVersion":2,"ID":"1234","Priority":"P1","Truncated":"lots","Subjects":[{"Type":"ipv4","Value":"8.8.8.8"}],"Results":[{"Source":"GreyNoise","AttributeValue":"8.8.8.8","Score":"high","Success":true}]}`
+
+	var alert Alert
+	if err := json.Unmarshal([]byte(newer), &alert); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if alert.ID != "1234" || alert.SchemaVersion != 2 || alert.Truncated != 0 {
+		t.Errorf("Unexpected output %v", alert)
+	}
+	if len(alert.Subjects) != 1 || len(alert.Results) != 1 || !alert.Results[0].Success {
+		t.Errorf("Expected the rest of the alert to be decoded, got %v", alert)
+	}
+
+	for _, invalid := range []string{`{"ID": "1234"`, `["not", "an", "alert"]`, `"1234"`} {
+		if err := json.Unmarshal([]byte(invalid), &alert); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package squyre
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SecretProvider fetches secrets, such as API keys, by name e.g. 'JiraApi'
+type SecretProvider interface {
+	// Fetch returns the value of the secret. Errors are *SecretError.
+	Fetch(name string) (string, error)
+}
+
+var (
+	// ErrSecretNotFound means the secret doesn't exist, or we aren't allowed to read it
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrSecretEmpty means the secret exists, but has no value
+	ErrSecretEmpty = errors.New("secret is empty")
+	// ErrSecretMalformed means the secret's value isn't in the expected format e.g. it's missing a key
+	ErrSecretMalformed = errors.New("secret is malformed")
+)
+
+// SecretError describes a secret that couldn't be fetched or used. Use errors.Is to check for ErrSecretNotFound,
+// ErrSecretEmpty or ErrSecretMalformed.
+type SecretError struct {
+	Name     string // The secret requested
+	Provider string // Where it was requested from e.g. 'Secrets Manager'
+	Err      error  // What went wrong
+}
+
+func (e *SecretError) Error() string {
+	return fmt.Sprintf("%s secret '%s': %s", e.Provider, e.Name, e.Err)
+}
+
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+// secretValue checks a fetched value isn't empty
+func secretValue(provider string, name string, value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", &SecretError{Name: name, Provider: provider, Err: ErrSecretEmpty}
+	}
+	return value, nil
+}
+
+// EnvSecretProvider reads secrets from env vars, named after the secret with the prefix e.g. SQUYRE_SECRET_JIRAAPI
+// for 'JiraApi'. Handy for running locally.
+type EnvSecretProvider struct {
+	Prefix string
+}
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// envName converts a secret name to the env var it's read from
+func (p EnvSecretProvider) envName(name string) string {
+	return p.Prefix + envUnsafe.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// Fetch reads the secret from its env var
+func (p EnvSecretProvider) Fetch(name string) (string, error) {
+	value, ok := os.LookupEnv(p.envName(name))
+	if !ok {
+		return "", &SecretError{Name: name, Provider: "Environment", Err: ErrSecretNotFound}
+	}
+	return secretValue("Environment", name, value)
+}
+
+// FileSecretProvider reads secrets from files in a directory, named after the secret. Useful with mounted secrets.
+type FileSecretProvider struct {
+	Dir string
+}
+
+// Fetch reads the secret from its file
+func (p FileSecretProvider) Fetch(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", &SecretError{Name: name, Provider: "File", Err: errors.New("invalid secret name")}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(p.Dir, name))
+	if os.IsNotExist(err) {
+		return "", &SecretError{Name: name, Provider: "File", Err: ErrSecretNotFound}
+	}
+	if err != nil {
+		return "", &SecretError{Name: name, Provider: "File", Err: err}
+	}
+	return secretValue("File", name, strings.TrimRight(string(data), "\r\n"))
+}
+
+// CachedSecretProvider remembers secrets fetched from another provider, so they aren't fetched on every invocation.
+// Secrets are fetched again after the TTL, to pick up rotated values. Failures aren't cached.
+type CachedSecretProvider struct {
+	Provider SecretProvider
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	secrets map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// NewCachedSecretProvider wraps a provider with a cache
+func NewCachedSecretProvider(provider SecretProvider, ttl time.Duration) *CachedSecretProvider {
+	return &CachedSecretProvider{
+		Provider: provider,
+		TTL:      ttl,
+		secrets:  make(map[string]cachedSecret),
+	}
+}
+
+// Fetch returns the cached secret, fetching it if it's not cached or has expired
+func (c *CachedSecretProvider) Fetch(name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.secrets[name]; ok && time.Since(cached.fetched) < c.TTL {
+		return cached.value, nil
+	}
+
+	value, err := c.Provider.Fetch(name)
+	if err != nil {
+		return "", err
+	}
+	c.secrets[name] = cachedSecret{value: value, fetched: time.Now()}
+	return value, nil
+}
+
+// DefaultSecretTTL is how long secrets are cached for, unless set by the SECRET_TTL env var
+const DefaultSecretTTL = 15 * time.Minute
+
+// SecretsFromEnv sets up a cached secret provider from env vars:
+//   - SECRET_PROVIDER: secretsmanager (the default), ssm, env or file
+//   - SECRET_PREFIX: prepended to secret names e.g. '/squyre/' for SSM, or 'SQUYRE_SECRET_' (the default) for env
+//   - SECRET_DIR: the directory for the file provider
+//   - SECRET_TTL: how long to cache secrets for e.g. '1h'
+func SecretsFromEnv() (SecretProvider, error) {
+	var provider SecretProvider
+
+	switch kind := strings.ToLower(os.Getenv("SECRET_PROVIDER")); kind {
+	case "", "secretsmanager":
+		provider = NewSecretsManagerProvider()
+	case "ssm":
+		provider = NewSSMProvider(os.Getenv("SECRET_PREFIX"))
+	case "env":
+		prefix, ok := os.LookupEnv("SECRET_PREFIX")
+		if !ok {
+			prefix = "SQUYRE_SECRET_"
+		}
+		provider = EnvSecretProvider{Prefix: prefix}
+	case "file":
+		if os.Getenv("SECRET_DIR") == "" {
+			return nil, errors.New("SECRET_DIR must be set for the file secret provider")
+		}
+		provider = FileSecretProvider{Dir: os.Getenv("SECRET_DIR")}
+	default:
+		return nil, fmt.Errorf("unknown secret provider '%s'", kind)
+	}
+
+	ttl := DefaultSecretTTL
+	if value := os.Getenv("SECRET_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SECRET_TTL '%s': %w", value, err)
+		}
+		ttl = parsed
+	}
+
+	return NewCachedSecretProvider(provider, ttl), nil
+}
+
+var (
+	// Secrets is the provider used by FetchSecret. It's set up from env vars on first use, unless already set.
+	Secrets   SecretProvider
+	secretsMu sync.Mutex
+)
+
+// defaultSecrets returns the Secrets provider, setting it up if needed
+func defaultSecrets() SecretProvider {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if Secrets == nil {
+		provider, err := SecretsFromEnv()
+		if err != nil {
+			log.Errorf("Invalid secret provider settings, using Secrets Manager: %s", err)
+			provider = NewCachedSecretProvider(NewSecretsManagerProvider(), DefaultSecretTTL)
+		}
+		Secrets = provider
+	}
+	return Secrets
+}
+
+// FetchSecret fetches a secret from the default provider
+func FetchSecret(name string) (string, error) {
+	return defaultSecrets().Fetch(name)
+}
+
+// FetchSecretJSON fetches a secret holding a JSON object, decoding it into v. Each of the required keys must be
+// present with a non-empty value, or an ErrSecretMalformed SecretError is returned.
+func FetchSecretJSON(name string, v interface{}, required ...string) error {
+	value, err := FetchSecret(name)
+	if err != nil {
+		return err
+	}
+	return decodeSecret(name, value, v, required)
+}
+
+func decodeSecret(name string, value string, v interface{}, required []string) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return &SecretError{Name: name, Provider: "JSON", Err: fmt.Errorf("%w: not a JSON object", ErrSecretMalformed)}
+	}
+	for _, key := range required {
+		if field, ok := fields[key]; !ok || field == nil || field == "" {
+			return &SecretError{Name: name, Provider: "JSON", Err: fmt.Errorf("%w: missing '%s'", ErrSecretMalformed, key)}
+		}
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return &SecretError{Name: name, Provider: "JSON", Err: fmt.Errorf("%w: %s", ErrSecretMalformed, err)}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package squyre
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+type mockedSecretsManager struct {
+	mockedSecretValue
+	Err error
+}
+
+func (m mockedSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	return m.mockedSecretValue.GetSecretValue(input)
+}
+
+type mockedSSM struct {
+	ssmiface.SSMAPI
+	Params map[string]string
+	Input  *ssm.GetParameterInput
+}
+
+func (m *mockedSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	m.Input = input
+	value, ok := m.Params[*input.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+// countingSecrets counts how often each secret is fetched
+type countingSecrets struct {
+	fetches map[string]int
+}
+
+func (c *countingSecrets) Fetch(name string) (string, error) {
+	c.fetches[name]++
+	if name == "missing" {
+		return "", &SecretError{Name: name, Provider: "Mock", Err: ErrSecretNotFound}
+	}
+	return "value-" + name, nil
+}
+
+func TestSecretsManagerProvider(t *testing.T) {
+	provider := &SecretsManagerProvider{Client: mockedSecretsManager{
+		mockedSecretValue: mockedSecretValue{Resp: secretsmanager.GetSecretValueOutput{SecretString: aws.String("s3cret")}},
+	}}
+	have, err := provider.Fetch("test")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if have != "s3cret" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "s3cret")
+	}
+
+	provider.Client = mockedSecretsManager{
+		mockedSecretValue: mockedSecretValue{Resp: secretsmanager.GetSecretValueOutput{SecretBinary: []byte("b1nary")}},
+	}
+	if have, _ := provider.Fetch("test"); have != "b1nary" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "b1nary")
+	}
+}
+
+func TestSecretsManagerProviderErrors(t *testing.T) {
+	tests := []struct {
+		client mockedSecretsManager
+		want   error
+	}{
+		{mockedSecretsManager{Err: awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "gone", nil)}, ErrSecretNotFound},
+		{mockedSecretsManager{mockedSecretValue: mockedSecretValue{Resp: secretsmanager.GetSecretValueOutput{SecretString: aws.String(" ")}}}, ErrSecretEmpty},
+	}
+	for _, test := range tests {
+		provider := &SecretsManagerProvider{Client: test.client}
+		_, err := provider.Fetch("test")
+
+		var secretErr *SecretError
+		if !errors.As(err, &secretErr) || !errors.Is(err, test.want) {
+			t.Errorf("Unexpected error. \nHave: %v\nWant: %v", err, test.want)
+		}
+	}
+
+	// Other failures are passed on, rather than panicking on the missing output
+	provider := &SecretsManagerProvider{Client: mockedSecretsManager{Err: errors.New("throttled")}}
+	if _, err := provider.Fetch("test"); err == nil || err.Error() != "Secrets Manager secret 'test': throttled" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestSSMProvider(t *testing.T) {
+	client := &mockedSSM{Params: map[string]string{"/squyre/JiraApi": "s3cret"}}
+	provider := &SSMProvider{Client: client, Prefix: "/squyre/"}
+
+	have, err := provider.Fetch("JiraApi")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if have != "s3cret" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "s3cret")
+	}
+	if !aws.BoolValue(client.Input.WithDecryption) {
+		t.Error("Expected SecureString parameters to be decrypted")
+	}
+
+	if _, err := provider.Fetch("OpsGenieAPI"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+}
+
+func TestEnvSecretProvider(t *testing.T) {
+	provider := EnvSecretProvider{Prefix: "SQUYRE_SECRET_"}
+	t.Setenv("SQUYRE_SECRET_SQUYREWEBHOOK_SPLUNK", "s3cret")
+	t.Setenv("SQUYRE_SECRET_EMPTY", "")
+
+	have, err := provider.Fetch("SquyreWebhook-splunk")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if have != "s3cret" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "s3cret")
+	}
+
+	if _, err := provider.Fetch("Missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+	if _, err := provider.Fetch("Empty"); !errors.Is(err, ErrSecretEmpty) {
+		t.Errorf("Expected an empty secret error, got %v", err)
+	}
+}
+
+func TestFileSecretProvider(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "JiraApi"), []byte("s3cret\n"), 0600)
+	provider := FileSecretProvider{Dir: dir}
+
+	have, err := provider.Fetch("JiraApi")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if have != "s3cret" {
+		t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "s3cret")
+	}
+
+	if _, err := provider.Fetch("Missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+	for _, name := range []string{"../JiraApi", "..", ""} {
+		if _, err := provider.Fetch(name); err == nil {
+			t.Errorf("Expected an error for '%s'", name)
+		}
+	}
+}
+
+func TestCachedSecretProvider(t *testing.T) {
+	backend := &countingSecrets{fetches: map[string]int{}}
+	provider := NewCachedSecretProvider(backend, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if have, _ := provider.Fetch("a"); have != "value-a" {
+			t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, "value-a")
+		}
+		provider.Fetch("missing")
+	}
+	if backend.fetches["a"] != 1 {
+		t.Errorf("Expected the secret to be fetched once, was fetched %d times", backend.fetches["a"])
+	}
+	if backend.fetches["missing"] != 3 {
+		t.Errorf("Expected failures not to be cached, was fetched %d times", backend.fetches["missing"])
+	}
+
+	provider.TTL = 0
+	provider.Fetch("a")
+	if backend.fetches["a"] != 2 {
+		t.Error("Expected the secret to be fetched again after the TTL")
+	}
+}
+
+func TestFetchSecretJSON(t *testing.T) {
+	defer func() { Secrets = nil }()
+	Secrets = EnvSecretProvider{Prefix: "TEST_"}
+	t.Setenv("TEST_GOOD", `{"user": "test", "apikey": "test123"}`)
+	t.Setenv("TEST_BLANK", `{"user": "test", "apikey": ""}`)
+	t.Setenv("TEST_PLAIN", "test123")
+
+	var secret struct {
+		User string `json:"user"`
+		Key  string `json:"apikey"`
+	}
+	if err := FetchSecretJSON("good", &secret, "user", "apikey"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if secret.User != "test" || secret.Key != "test123" {
+		t.Errorf("Unexpected output %v", secret)
+	}
+
+	for _, name := range []string{"blank", "plain"} {
+		if err := FetchSecretJSON(name, &secret, "user", "apikey"); !errors.Is(err, ErrSecretMalformed) {
+			t.Errorf("Expected a malformed secret error for %s, got %v", name, err)
+		}
+	}
+	if err := FetchSecretJSON("missing", &secret); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+}
+
+func TestSecretsFromEnv(t *testing.T) {
+	t.Setenv("SECRET_PROVIDER", "env")
+	t.Setenv("SECRET_TTL", "1h")
+	provider, err := SecretsFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	cached, ok := provider.(*CachedSecretProvider)
+	if !ok || cached.TTL != time.Hour {
+		t.Fatalf("Expected a cached provider with a 1h TTL, got %v", provider)
+	}
+	if env, ok := cached.Provider.(EnvSecretProvider); !ok || env.Prefix != "SQUYRE_SECRET_" {
+		t.Errorf("Expected an env provider with the default prefix, got %v", cached.Provider)
+	}
+
+	t.Setenv("SECRET_PROVIDER", "file")
+	if _, err := SecretsFromEnv(); err == nil {
+		t.Error("Expected an error without SECRET_DIR")
+	}
+
+	t.Setenv("SECRET_PROVIDER", "vault")
+	if _, err := SecretsFromEnv(); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+}
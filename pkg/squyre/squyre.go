@@ -2,33 +2,113 @@ package squyre
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 )
 
 // Subject defines attributes about a thing that we want to know about
 type Subject struct {
-	Type  string // ipv4, domain, sha256 or hostname
-	Value string
+	Type     string `json:"Type"`     // ipv4, ipv6, domain, url, email, md5, sha1, sha256 or hostname
+	Value    string `json:"Value"`    // The subject itself e.g. '8.8.8.8'
+	Defanged bool   `json:"Defanged"` // Whether the subject was defanged in the original alert e.g. hxxp://evil[.]com
+	Field    string `json:"Field"`    // The alert field the subject came from, if known e.g. 'source IP'
+	Parent   string `json:"Parent"`   // The subject this one was derived from, if any e.g. the URL a domain is the host of
 }
 
 // Result holds enrichment results, and where they came from
 type Result struct {
-	Source         string // The service the result came from
-	AttributeValue string // The attribute used to search
-	Message        string // The response from the service
-	Success        bool   // Whether the lookup succeeded or not i.e. an error was encountered
-	MatchFound     bool   // Whether we found a match for this attribute on this service
+	Source         string          `json:"Source"`               // The service the result came from
+	AttributeValue string          `json:"AttributeValue"`       // The attribute used to search
+	Message        string          `json:"Message"`              // The response from the service
+	Success        bool            `json:"Success"`              // Whether the lookup succeeded or not i.e. an error was encountered
+	MatchFound     bool            `json:"MatchFound"`           // Whether we found a match for this attribute on this service
+	Verdict        Verdict         `json:"Verdict"`              // The service's opinion of the attribute, normalised across services
+	Score          int             `json:"Score"`                // How bad the service thinks the attribute is, from 0 (benign) to 100 (malicious)
+	Tags           []string        `json:"Tags,omitempty"`       // Labels the service has for the attribute e.g. malware families
+	References     []string        `json:"References,omitempty"` // Links to more information on the service
+	Raw            json.RawMessage `json:"Raw,omitempty"`        // The response from the service, as JSON, if small enough to carry
+	Cached         bool            `json:"Cached,omitempty"`     // Whether the result came from the cache, rather than the service
+	CacheAge       int             `json:"CacheAge,omitempty"`   // How long ago, in seconds, a cached result was looked up
 }
 
-// Alert holds information about an incoming alert
+// Alert holds information about an incoming alert. It is passed between the conductor, the state machine, the
+// enrichment functions and the outputs as JSON, described by schema/alert.schema.json. The JSON names must not
+// change, as the state machine refers to them, and in-flight executions carry the old names.
 type Alert struct {
-	Timestamp  string
-	Name       string
-	RawMessage string
-	URL        string
-	ID         string
-	Subjects   []Subject
-	Results    []Result
-	Scope      string // The types of Subjects in this alert, used by the step function
+	SchemaVersion int       `json:"SchemaVersion"` // The version of the schema the alert was encoded with, set on encoding
+	Timestamp     string    `json:"Timestamp"`
+	Name          string    `json:"Name"`
+	RawMessage    string    `json:"RawMessage"`
+	URL           string    `json:"URL"`
+	ID            string    `json:"ID"`
+	Subjects      []Subject `json:"Subjects"`
+	Results       []Result  `json:"Results"`
+	Scope         string    `json:"Scope"`                 // The types of Subjects in this alert, used by the step function
+	Truncated     int       `json:"Truncated"`             // How many subjects were left out, to keep within the configured limits
+	EnrichTypes   string    `json:"EnrichTypes,omitempty"` // The types of Subjects this branch of the step function enriches, all supported types if empty
+}
+
+// Defang converts an indicator to a defanged form that is safe to include in tickets
+func Defang(value string) string {
+	defanged := strings.ReplaceAll(value, ".", "[.]")
+	defanged = strings.ReplaceAll(defanged, "@", "[@]")
+
+	lower := strings.ToLower(defanged)
+	if strings.HasPrefix(lower, "http") {
+		defanged = "hxxp" + defanged[4:]
+	} else if strings.HasPrefix(lower, "ftp") {
+		defanged = "fxp" + defanged[3:]
+	}
+	return defanged
+}
+
+// DefangText re-defangs any subjects of the alert that were defanged in the original alert, wherever
+// they appear in the given text
+func (alert Alert) DefangText(text string) string {
+	var values []string
+	for _, subject := range alert.Subjects {
+		if subject.Defanged {
+			values = append(values, subject.Value)
+		}
+	}
+	// Longest first, so a URL is defanged as a whole before the domain within it
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, value := range values {
+		text = strings.ReplaceAll(text, value, Defang(value))
+	}
+	return text
+}
+
+// Describe labels a subject value with the alert field it came from and its parent subject, if known e.g. '1.2.3.4 (source IP)'
+func (alert Alert) Describe(value string) string {
+	for _, subject := range alert.Subjects {
+		if subject.Value != value {
+			continue
+		}
+
+		var details []string
+		if subject.Field != "" {
+			details = append(details, subject.Field)
+		}
+		if subject.Parent != "" {
+			details = append(details, "from "+subject.Parent)
+		}
+		if len(details) > 0 {
+			return fmt.Sprintf("%s (%s)", value, strings.Join(details, ", "))
+		}
+	}
+	return value
+}
+
+// TruncationNote tells analysts that some subjects in the alert were not enriched, if any were left out
+func (alert Alert) TruncationNote() string {
+	if alert.Truncated == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Note: %d subjects in this alert were not enriched, as it had more than the configured limit. Check the alert for the full list.", alert.Truncated)
 }
 
 // Alerter defines common functions for all alert types
@@ -119,42 +199,89 @@ func (alert SumoLogicAlert) Normaliser() Alert {
 	}
 }
 
-// CombineResultsbyAlertID merges a slice of alerts for the same Id into one
-func CombineResultsbyAlertID(raw [][]string) map[string]Alert {
+// ElasticAlert defines the format alerts come to us from Kibana rule webhook actions
+// See https://www.elastic.co/guide/en/kibana/current/rule-action-variables.html
+type ElasticAlert struct {
+	Date          string `json:"date"`
+	KibanaBaseURL string `json:"kibanaBaseUrl"`
+	Rule          struct {
+		ID   string   `json:"id"`
+		Name string   `json:"name"`
+		URL  string   `json:"url"`
+		Tags []string `json:"tags"`
+	} `json:"rule"`
+	Alert struct {
+		ID          string `json:"id"`
+		ActionGroup string `json:"actionGroup"`
+	} `json:"alert"`
+	Context struct {
+		ResultsLink string          `json:"results_link"`
+		Alerts      json.RawMessage `json:"alerts"`
+	} `json:"context"`
+}
 
-	/*
-		The output function(s) are called with a slice of slice of srings.
-		Each slice is an output from a group of enrichments e.g. IPv4, Domain etc. which contains
-		another slice of the outputs from each function (as Alerts). This is the way the Step
-		Function groups the results of parallel executions.
+// Normaliser comverts an Elastic alert to our standard form
+func (alert ElasticAlert) Normaliser() Alert {
+	// The alerting documents may be sent as raw JSON, or as a JSON encoded string
+	rawMessage := string(alert.Context.Alerts)
+	var encoded string
+	if json.Unmarshal(alert.Context.Alerts, &encoded) == nil {
+		rawMessage = encoded
+	}
 
-		This function collapses all of that structure down, grouping by alert ID with all the separate
-		results within.
-	*/
+	id := alert.Alert.ID
+	if id == "" {
+		id = alert.Rule.ID
+	}
 
-	resultsmap := make(map[string][]Result)
-	alerts := make(map[string]Alert)
+	url := alert.Context.ResultsLink
+	if url == "" {
+		url = alert.Rule.URL
+	}
 
-	// First, collapse the enrichment groups down into one big slice
-	mergedGroups := []string{}
-	for _, group := range raw {
-		mergedGroups = append(mergedGroups, group...)
+	return Alert{
+		RawMessage: rawMessage,
+		ID:         id,
+		Name:       alert.Rule.Name,
+		Timestamp:  alert.Date,
+		URL:        url,
 	}
+}
 
-	// Now, go through and organise as unique alerts with results contained within
-	for _, alertStr := range mergedGroups {
-		var alert Alert
-		json.Unmarshal([]byte(alertStr), &alert)
-		for _, result := range alert.Results {
-			resultsmap[alert.ID] = append(resultsmap[alert.ID], result)
-		}
-		alert.Results = nil
-		alerts[alert.ID] = alert
+// EventBridgeAlert defines the standard format of events from Amazon EventBridge, such as GuardDuty or Security Hub findings
+// See https://docs.aws.amazon.com/eventbridge/latest/userguide/eb-events-structure.html
+type EventBridgeAlert struct {
+	ID         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// Normaliser comverts an EventBridge event to our standard form
+func (alert EventBridgeAlert) Normaliser() Alert {
+	name := alert.DetailType
+	// Findings usually carry a more useful title
+	var detail struct {
+		Title    string `json:"title"`
+		Findings []struct {
+			Title string `json:"Title"`
+		} `json:"findings"`
+	}
+	json.Unmarshal(alert.Detail, &detail)
+	if detail.Title != "" {
+		name = fmt.Sprintf("%s: %s", alert.DetailType, detail.Title)
+	} else if len(detail.Findings) > 0 && detail.Findings[0].Title != "" {
+		name = fmt.Sprintf("%s: %s", alert.DetailType, detail.Findings[0].Title)
 	}
-	for id, results := range resultsmap {
-		temp := alerts[id]
-		temp.Results = results
-		alerts[id] = temp
+
+	return Alert{
+		RawMessage: string(alert.Detail),
+		ID:         alert.ID,
+		Name:       name,
+		Timestamp:  alert.Time,
 	}
-	return alerts
 }
@@ -1,6 +1,7 @@
 package squyre
 
 import (
+	"bytes"
 	"encoding/json"
 	"testing"
 
@@ -48,3 +49,138 @@ func TestNormaliseOGAlert(t *testing.T) {
 		t.Fatalf("expected value %s, got %s", expected, output)
 	}
 }
+
+func TestNormaliseElasticAlert(t *testing.T) {
+	payloads := []string{
+		`{"date": "2022-12-12T18:00:00.000Z", "kibanaBaseUrl": "https://kibana.local", "rule": {"id": "rule-1", "name": "Test Rule", "url": "https://kibana.local/rule-1"}, "alert": {"id": "1234-1234"}, "context": {"results_link": "https://kibana.local/results", "alerts": [{"source": {"ip": "8.8.8.8"}}]}}`,
+		`{"date": "2022-12-12T18:00:00.000Z", "kibanaBaseUrl": "https://kibana.local", "rule": {"id": "rule-1", "name": "Test Rule", "url": "https://kibana.local/rule-1"}, "alert": {"id": "1234-1234"}, "context": {"results_link": "https://kibana.local/results", "alerts": "[{\"source\":{\"ip\":\"8.8.8.8\"}}]"}}`,
+	}
+	want := Alert{
+		RawMessage: `[{"source":{"ip":"8.8.8.8"}}]`,
+		ID:         "1234-1234",
+		Name:       "Test Rule",
+		URL:        "https://kibana.local/results",
+		Timestamp:  "2022-12-12T18:00:00.000Z",
+	}
+
+	for _, payload := range payloads {
+		var elastic ElasticAlert
+		err := json.Unmarshal([]byte(payload), &elastic)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		have := elastic.Normaliser()
+		// Compact so raw and encoded alerts compare the same
+		var compacted bytes.Buffer
+		json.Compact(&compacted, []byte(have.RawMessage))
+		have.RawMessage = compacted.String()
+
+		if !cmp.Equal(have, want) {
+			t.Fatalf("unexpected output. \nHave: %v\nWant: %v", have, want)
+		}
+	}
+}
+
+func TestNormaliseElasticAlertFallbacks(t *testing.T) {
+	elastic := ElasticAlert{}
+	elastic.Rule.ID = "rule-1"
+	elastic.Rule.URL = "https://kibana.local/rule-1"
+
+	have := elastic.Normaliser()
+	if have.ID != "rule-1" || have.URL != "https://kibana.local/rule-1" {
+		t.Fatalf("unexpected output. \nHave: %v", have)
+	}
+}
+
+func TestNormaliseEventBridgeAlert(t *testing.T) {
+	payloads := map[string]string{
+		"GuardDuty Finding: Unusual traffic":    `{"id": "1234-1234", "detail-type": "GuardDuty Finding", "source": "aws.guardduty", "time": "2022-12-12T18:00:00Z", "detail": {"title": "Unusual traffic", "ip": "8.8.8.8"}}`,
+		"Security Hub Findings - Imported: Bad": `{"id": "1234-1234", "detail-type": "Security Hub Findings - Imported", "source": "aws.securityhub", "time": "2022-12-12T18:00:00Z", "detail": {"findings": [{"Title": "Bad"}]}}`,
+		"Custom Event":                          `{"id": "1234-1234", "detail-type": "Custom Event", "source": "my.app", "time": "2022-12-12T18:00:00Z", "detail": {}}`,
+	}
+
+	for want, payload := range payloads {
+		var eventbridge EventBridgeAlert
+		err := json.Unmarshal([]byte(payload), &eventbridge)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		have := eventbridge.Normaliser()
+		if have.Name != want || have.ID != "1234-1234" || have.Timestamp != "2022-12-12T18:00:00Z" {
+			t.Fatalf("unexpected output. \nHave: %v\nWant: %s", have, want)
+		}
+	}
+}
+
+func TestDefang(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":                "1[.]2[.]3[.]4",
+		"evil.com":               "evil[.]com",
+		"https://evil.com/a.php": "hxxps://evil[.]com/a[.]php",
+		"bad@evil.com":           "bad[@]evil[.]com",
+	}
+	for value, want := range tests {
+		have := Defang(value)
+		if have != want {
+			t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+		}
+	}
+}
+
+func TestDefangText(t *testing.T) {
+	alert := Alert{
+		Subjects: []Subject{
+			{Type: "domain", Value: "evil.com", Defanged: true},
+			{Type: "url", Value: "http://evil.com/x", Defanged: true},
+			{Type: "ipv4", Value: "8.8.8.8"},
+		},
+	}
+
+	have := alert.DefangText("Found http://evil.com/x on evil.com via 8.8.8.8")
+	want := "Found hxxp://evil[.]com/x on evil[.]com via 8.8.8.8"
+
+	if have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	alert := Alert{
+		Subjects: []Subject{
+			{Type: "ipv4", Value: "8.8.8.8", Field: "source IP"},
+			{Type: "ipv4", Value: "9.9.9.9"},
+			{Type: "ipv4", Value: "1.1.1.1", Parent: "http://1.1.1.1/x"},
+			{Type: "domain", Value: "evil.com", Field: "url", Parent: "http://evil.com/x"},
+		},
+	}
+
+	if have, want := alert.Describe("1.1.1.1"), "1.1.1.1 (from http://1.1.1.1/x)"; have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if have, want := alert.Describe("evil.com"), "evil.com (url, from http://evil.com/x)"; have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if have, want := alert.Describe("8.8.8.8"), "8.8.8.8 (source IP)"; have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+
+	if have, want := alert.Describe("9.9.9.9"), "9.9.9.9"; have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestTruncationNote(t *testing.T) {
+	if have := (Alert{}).TruncationNote(); have != "" {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, "")
+	}
+
+	have := Alert{Truncated: 12}.TruncationNote()
+	want := "Note: 12 subjects in this alert were not enriched, as it had more than the configured limit. Check the alert for the full list."
+	if have != want {
+		t.Fatalf("unexpected output. \nHave: %s\nWant: %s", have, want)
+	}
+}
@@ -0,0 +1,87 @@
+package squyre
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Verdict is a service's opinion of an attribute, normalised so results from different services can be compared
+type Verdict string
+
+const (
+	// VerdictMalicious means the service has the attribute as bad e.g. a known C2 server
+	VerdictMalicious Verdict = "malicious"
+	// VerdictSuspicious means the service has seen the attribute doing something worth a look e.g. scanning, or a Tor relay
+	VerdictSuspicious Verdict = "suspicious"
+	// VerdictBenign means the service has the attribute as good e.g. a well known business service
+	VerdictBenign Verdict = "benign"
+	// VerdictUnknown means the service has no opinion, the lookup failed, or the service only provides context e.g. geolocation
+	VerdictUnknown Verdict = "unknown"
+)
+
+const (
+	// MaliciousScore is the lowest score given a malicious verdict by VerdictFromScore
+	MaliciousScore = 70
+	// SuspiciousScore is the lowest score given a suspicious verdict by VerdictFromScore
+	SuspiciousScore = 30
+)
+
+// MaxRawPayload is the largest service response, in bytes, carried in a Result. Alerts pass through the step function
+// with every result attached, and step function payloads are limited to 256KB.
+var MaxRawPayload = 8192
+
+// MaxAlertRaw is the most service response, in bytes, an enrichment function carries across all of an alert's
+// results. Once it's used up, later results are kept without their Raw response. The functions run side by side,
+// and their alerts pass through the step function together, so this leaves room for several functions' results.
+var MaxAlertRaw = 32768
+
+// ClampScore keeps a score within 0 to 100
+func ClampScore(score int) int {
+	if score < 0 {
+		return 0
+	}
+	if score > 100 {
+		return 100
+	}
+	return score
+}
+
+// VerdictFromScore gives the verdict for a score. A low score is not evidence that an attribute is benign, so it
+// gives an unknown verdict; services must decide on benign themselves.
+func VerdictFromScore(score int) Verdict {
+	switch score = ClampScore(score); {
+	case score >= MaliciousScore:
+		return VerdictMalicious
+	case score >= SuspiciousScore:
+		return VerdictSuspicious
+	default:
+		return VerdictUnknown
+	}
+}
+
+// RawPayload prepares a service response to be carried in a Result. JSON is compacted, anything else is stored as a
+// JSON string, and responses larger than MaxRawPayload are left out.
+func RawPayload(data []byte) json.RawMessage {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	var raw bytes.Buffer
+	if json.Valid(data) {
+		if err := json.Compact(&raw, data); err != nil {
+			return nil
+		}
+	} else {
+		encoder := json.NewEncoder(&raw)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(string(data)); err != nil {
+			return nil
+		}
+	}
+
+	if raw.Len() > MaxRawPayload {
+		return nil
+	}
+	return bytes.TrimSpace(raw.Bytes())
+}
@@ -0,0 +1,59 @@
+package squyre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerdictFromScore(t *testing.T) {
+	tests := map[int]Verdict{
+		-5:  VerdictUnknown,
+		0:   VerdictUnknown,
+		29:  VerdictUnknown,
+		30:  VerdictSuspicious,
+		69:  VerdictSuspicious,
+		70:  VerdictMalicious,
+		100: VerdictMalicious,
+		150: VerdictMalicious,
+	}
+
+	for score, want := range tests {
+		if have := VerdictFromScore(score); have != want {
+			t.Errorf("Unexpected verdict for score %d. \nHave: %s\nWant: %s", score, have, want)
+		}
+	}
+}
+
+func TestClampScore(t *testing.T) {
+	if have := ClampScore(-1); have != 0 {
+		t.Errorf("Unexpected output. \nHave: %d\nWant: %d", have, 0)
+	}
+	if have := ClampScore(101); have != 100 {
+		t.Errorf("Unexpected output. \nHave: %d\nWant: %d", have, 100)
+	}
+	if have := ClampScore(42); have != 42 {
+		t.Errorf("Unexpected output. \nHave: %d\nWant: %d", have, 42)
+	}
+}
+
+func TestRawPayload(t *testing.T) {
+	tests := map[string]string{
+		"{\n  \"ip\": \"8.8.8.8\",\n  \"noise\": false\n}\n": `{"ip":"8.8.8.8","noise":false}`,
+		"<html>Result is positive</html>":                    `"<html>Result is positive</html>"`,
+		"   ":                                                "",
+	}
+
+	for input, want := range tests {
+		if have := string(RawPayload([]byte(input))); have != want {
+			t.Errorf("Unexpected output. \nHave: %s\nWant: %s", have, want)
+		}
+	}
+}
+
+func TestRawPayloadTooLarge(t *testing.T) {
+	large := `{"message":"` + strings.Repeat("a", MaxRawPayload) + `"}`
+
+	if have := RawPayload([]byte(large)); have != nil {
+		t.Errorf("Expected an oversized payload to be left out, got %d bytes", len(have))
+	}
+}
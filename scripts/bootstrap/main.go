@@ -3,10 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,7 +19,7 @@ import (
 )
 
 var (
-	Sources = []string{"OpsGenie", "Splunk", "Sumo Logic"}
+	Sources = []string{"Elastic", "OpsGenie", "Splunk", "Sumo Logic"}
 	Outputs = []string{"OpsGenie", "Jira"}
 )
 
@@ -31,8 +33,21 @@ type sqFunc struct {
 }
 
 type stateTemplate struct {
+	MultiTypes string
 	MultiTasks string
 	IPv4Tasks  string
+	IPv6Tasks  string
+	HashTasks  string
+}
+
+// typeBranches maps subject types to the state machine branch that processes them. Each branch tells its functions
+// which types to look up, so a function in more than one branch doesn't look up the same subject twice.
+var typeBranches = map[string]string{
+	"ipv4":   "ipv4",
+	"ipv6":   "ipv6",
+	"md5":    "hash",
+	"sha1":   "hash",
+	"sha256": "hash",
 }
 
 func main() {
@@ -120,73 +135,95 @@ func main() {
 	cls("Build")
 	fmt.Println("-+. building state machine ASL definition ..")
 
-	var state stateTemplate
+	prettyJson, err := buildStateMachine(useFunctions, "../../statemachine/templates")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	task, terr := template.ParseFiles("../../statemachine/templates/task.tmp")
-	pass, perr := template.ParseFiles("../../statemachine/templates/pass.tmp")
-	templ, tmperr := template.ParseFiles("../../statemachine/templates/template.tmp")
+	fmt.Println("-+. done.")
 
-	if terr != nil || perr != nil || tmperr != nil {
-		panic("Failed to load templates! Abort.")
+	cls("Save")
+
+	outFile := "../../statemachine/enrich.asl.json"
+	if promptYesNo("Overwrite main state machine definition (enrich.asl.json)?") == false {
+		now := time.Now()
+		outFile = fmt.Sprintf("../../statemachine/bootstrap-%s.asl.json", now.Format("20060102150405"))
 	}
 
-	for _, fn := range useFunctions {
-		buf := new(bytes.Buffer)
-		err = task.Execute(buf, fn)
-		if err != nil {
-			log.Fatal(err)
-		}
+	fmt.Printf("-+. saving to '%s' ..\n", outFile)
+	_ = os.WriteFile(outFile, prettyJson, 0644)
+
+	fmt.Println("-+. ok done, bootstrap run complete. woot!!")
+}
+
+// buildStateMachine renders the state machine ASL definition for the given functions, using the templates in dir
+func buildStateMachine(functions []sqFunc, dir string) ([]byte, error) {
+	task, terr := template.ParseFiles(filepath.Join(dir, "task.tmp"))
+	pass, perr := template.ParseFiles(filepath.Join(dir, "pass.tmp"))
+	templ, tmperr := template.ParseFiles(filepath.Join(dir, "template.tmp"))
+
+	if terr != nil || perr != nil || tmperr != nil {
+		return nil, errors.New("failed to load templates")
+	}
 
+	var multiTypes []string
+	branchTasks := make(map[string]string)
+	for _, fn := range functions {
+		// Multipurpose functions always run, looking up hashes in the hash branch and everything else they support
+		// in the multipurpose branch. Other functions get a task in the typed branch for each type they support.
+		var branches []string
 		if fn.Type == "multipurpose" {
-			state.MultiTasks = state.MultiTasks + buf.String()
-		} else if fn.Type == "ipv4" {
-			state.IPv4Tasks = state.IPv4Tasks + buf.String()
+			branches = []string{"multipurpose"}
+		}
+		for _, fnType := range strings.Split(fn.Supports, ",") {
+			branch := typeBranches[fnType]
+			if fn.Type == "multipurpose" && branch != "hash" {
+				if !contains(multiTypes, fnType) {
+					multiTypes = append(multiTypes, fnType)
+				}
+				continue
+			}
+			if !contains(branches, branch) {
+				branches = append(branches, branch)
+			}
 		}
-	}
 
-	if state.MultiTasks == "" {
-		buf := new(bytes.Buffer)
-		err = pass.Execute(buf, &sqFunc{
-			Type: "multipurpose",
-		})
-		if err != nil {
-			log.Fatal(err)
+		for _, branch := range branches {
+			typed := fn
+			typed.Type = branch
+
+			buf := new(bytes.Buffer)
+			if err := task.Execute(buf, typed); err != nil {
+				return nil, err
+			}
+			branchTasks[branch] = branchTasks[branch] + buf.String()
 		}
-		state.MultiTasks = buf.String()
 	}
 
-	if state.IPv4Tasks == "" {
-		buf := new(bytes.Buffer)
-		err = pass.Execute(buf, &sqFunc{
-			Type: "ipv4",
-		})
-		if err != nil {
-			log.Fatal(err)
+	for _, branch := range []string{"multipurpose", "ipv4", "ipv6", "hash"} {
+		if branchTasks[branch] == "" {
+			buf := new(bytes.Buffer)
+			if err := pass.Execute(buf, &sqFunc{Type: branch}); err != nil {
+				return nil, err
+			}
+			branchTasks[branch] = buf.String()
 		}
-		state.IPv4Tasks = buf.String()
+		branchTasks[branch] = strings.TrimRight(branchTasks[branch], ",")
 	}
 
-	state.MultiTasks = strings.TrimRight(state.MultiTasks, ",")
-	state.IPv4Tasks = strings.TrimRight(state.IPv4Tasks, ",")
+	state := stateTemplate{
+		MultiTypes: strings.Join(multiTypes, ","),
+		MultiTasks: branchTasks["multipurpose"],
+		IPv4Tasks:  branchTasks["ipv4"],
+		IPv6Tasks:  branchTasks["ipv6"],
+		HashTasks:  branchTasks["hash"],
+	}
 
 	buf := new(bytes.Buffer)
-	err = templ.Execute(buf, state)
-	prettyJson := pretty.Pretty(buf.Bytes())
-
-	fmt.Println("-+. done.")
-
-	cls("Save")
-
-	outFile := "../../statemachine/enrich.asl.json"
-	if promptYesNo("Overwrite main state machine definition (enrich.asl.json)?") == false {
-		now := time.Now()
-		outFile = fmt.Sprintf("../../statemachine/bootstrap-%s.asl.json", now.Format("20060102150405"))
+	if err := templ.Execute(buf, state); err != nil {
+		return nil, err
 	}
-
-	fmt.Printf("-+. saving to '%s' ..\n", outFile)
-	_ = os.WriteFile(outFile, prettyJson, 0644)
-
-	fmt.Println("-+. ok done, bootstrap run complete. woot!!")
+	return pretty.Pretty(buf.Bytes()), nil
 }
 
 func replaceInFile(file string, replace []byte, with []byte, backup bool) {
@@ -261,14 +298,14 @@ func getProviderInfo(fn string) (sqFunc, error) {
 	}
 
 	name := strings.Split(providerLine, "\"")[1]
-	supports := strings.Split(supportsLine, "\"")[1]
+	supports := supportedTypes(supportsLine)
 	fnName := fmt.Sprintf("%sFunction", strings.ReplaceAll(name, " ", ""))
 
 	if secretLocLine != "" {
 		secretLocLine = strings.Split(secretLocLine, "\"")[1]
 	}
 
-	if len(strings.Split(supports, ",")) == 1 {
+	if onlyBranchTypes(supports) {
 		ptype = supports
 	} else {
 		ptype = "multipurpose"
@@ -284,6 +321,37 @@ func getProviderInfo(fn string) (sqFunc, error) {
 	}, nil
 }
 
+var quoted = regexp.MustCompile(`"([^"]*)"`)
+
+// supportedTypes lists the subject types on a function's supports line, which is either a comma separated string or
+// a squyre.SubjectTypes list e.g. squyre.SubjectTypes{"ipv4", "ipv6"}
+func supportedTypes(line string) string {
+	var types []string
+	for _, match := range quoted.FindAllStringSubmatch(line, -1) {
+		types = append(types, match[1])
+	}
+	return strings.Join(types, ",")
+}
+
+// onlyBranchTypes checks if a function only supports subject types that have their own state machine branch
+func onlyBranchTypes(supports string) bool {
+	for _, sType := range strings.Split(supports, ",") {
+		if _, ok := typeBranches[sType]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
 func promptYesNo(prompt string) bool {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Printf("%s [Y/n]: ", prompt)
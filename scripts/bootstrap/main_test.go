@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -18,3 +22,124 @@ func TestGrep(t *testing.T) {
 		t.Fatalf("Unexpected output. \nHave: %s\nWant: %s", have, want)
 	}
 }
+
+// tests provider type detection for functions that run in typed branches
+func TestOnlyBranchTypes(t *testing.T) {
+	setup()
+
+	if !onlyBranchTypes("ipv4,ipv6") {
+		t.Fatal("Expected ipv4,ipv6 to be branch types only")
+	}
+
+	if !onlyBranchTypes("md5,sha1,sha256") {
+		t.Fatal("Expected md5,sha1,sha256 to be branch types only")
+	}
+
+	if onlyBranchTypes("ipv4,domain") {
+		t.Fatal("Expected ipv4,domain to not be branch types only")
+	}
+}
+
+// tests the state machine template renders to valid JSON, with pass states for branches without functions
+func TestStateTemplate(t *testing.T) {
+	setup()
+
+	have, err := buildStateMachine(nil, "../../statemachine/templates")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !json.Valid(have) {
+		t.Fatalf("Expected valid JSON, got %s", have)
+	}
+	if !bytes.Contains(have, []byte(`"Pass - hash"`)) {
+		t.Fatalf("Expected a pass state for the hash branch, got %s", have)
+	}
+}
+
+// tests multipurpose functions look up hashes in the hash branch, and everything else in the multipurpose branch
+func TestBuildStateMachine(t *testing.T) {
+	setup()
+
+	functions := []sqFunc{
+		{Name: "Multi", Type: "multipurpose", Supports: "ipv4,domain,sha256"},
+		{Name: "Hashes", Type: "md5,sha1", Supports: "md5,sha1"},
+	}
+	have, err := buildStateMachine(functions, "../../statemachine/templates")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	for _, want := range []string{`"Multi - multipurpose"`, `"Multi - hash"`, `"Hashes - hash"`, `"Pass - ipv4"`, `"Pass - ipv6"`, `"Result": "ipv4,domain"`} {
+		if !bytes.Contains(have, []byte(want)) {
+			t.Errorf("Expected %s in output, got %s", want, have)
+		}
+	}
+	if bytes.Contains(have, []byte(`"Hashes - multipurpose"`)) {
+		t.Errorf("Expected no multipurpose task for a hash function, got %s", have)
+	}
+}
+
+// tests the committed state machine is what bootstrap generates when every function is selected
+func TestCommittedStateMachine(t *testing.T) {
+	setup()
+
+	var functions []sqFunc
+	files, err := ioutil.ReadDir("../../function")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			provider, err := getProviderInfo("../../function/" + file.Name() + "/main.go")
+			if err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			functions = append(functions, provider)
+		}
+	}
+
+	generated, err := buildStateMachine(functions, "../../statemachine/templates")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	committed, err := ioutil.ReadFile("../../statemachine/enrich.asl.json")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// Compare the definitions rather than the bytes, as the committed file may be formatted differently
+	var have, want interface{}
+	if err := json.Unmarshal(generated, &have); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := json.Unmarshal(committed, &want); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("statemachine/enrich.asl.json is out of date, re-run bootstrap selecting every function. \nHave: %s\nWant: %s", generated, committed)
+	}
+}
+
+// tests reading the subject types a function supports
+func TestGetProviderInfo(t *testing.T) {
+	setup()
+
+	tests := []struct {
+		function string
+		supports string
+		ptype    string
+	}{
+		{"greynoise", "ipv4", "ipv4"},
+		{"exonerator", "ipv4,ipv6", "ipv4,ipv6"},
+		{"alienvaultotx", "ipv4,ipv6,domain,url,md5,sha1,sha256", "multipurpose"},
+	}
+	for _, test := range tests {
+		provider, err := getProviderInfo("../../function/" + test.function + "/main.go")
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if provider.Supports != test.supports || provider.Type != test.ptype {
+			t.Errorf("Unexpected output for %s. \nHave: %s (%s)\nWant: %s (%s)", test.function, provider.Supports, provider.Type, test.supports, test.ptype)
+		}
+	}
+}